@@ -53,18 +53,177 @@ func EncodeWithSignature(signature string, args ...any) string {
 	return ans
 }
 
-func NumArguments(signature string) int {
+// SplitSignature splits a signature like "transfer(address,uint256)"
+// into its name and the list of argument types.  Parentheses of
+// nested tuples are respected, i.e. "f((uint256,bool),address)"
+// results in "f" and ["(uint256,bool)", "address"].  A bare list of
+// types like "(uint256,string)" results in an empty name.
+func SplitSignature(signature string) (string, []string, error) {
 	opening := strings.Index(signature, "(")
-	closing := strings.Index(signature, ")")
+	if opening < 0 || !strings.HasSuffix(signature, ")") {
+		return "", nil, fmt.Errorf("invalid signature: %s", signature)
+	}
 
-	args := strings.Split(
-		signature[opening+1:closing],
-		",",
+	name := signature[:opening]
+	inner := signature[opening+1 : len(signature)-1]
+	if inner == "" {
+		return name, []string{}, nil
+	}
+
+	var (
+		types = make([]string, 0, 4)
+		depth = 0
+		start = 0
 	)
+	for i, r := range inner {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				types = append(types, inner[start:i])
+				start = i + 1
+			}
+		}
+		if depth < 0 {
+			return "", nil, fmt.Errorf("invalid signature: %s", signature)
+		}
+	}
+	if depth != 0 {
+		return "", nil, fmt.Errorf("invalid signature: %s", signature)
+	}
+	types = append(types, inner[start:])
+
+	for _, t := range types {
+		if t == "" {
+			return "", nil, fmt.Errorf("invalid signature: %s", signature)
+		}
+	}
+
+	return name, types, nil
+}
+
+func NumArguments(signature string) (int, error) {
+	_, types, err := SplitSignature(signature)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(types), nil
+}
+
+// ParseType parses a single elementary, array or slice ABI type like
+// "uint8", "bytes" or "address[]".  Tuples are not supported.
+func ParseType(t string) (abi.Type, error) {
+	if strings.Contains(t, "(") {
+		return abi.Type{}, fmt.Errorf("unsupported type: %s", t)
+	}
+
+	return abi.NewType(t, "", nil)
+}
+
+// ParseTypeList parses a parenthesized list of types like
+// "(uint256,string)".  A single type without parentheses is also
+// accepted.
+func ParseTypeList(list string) ([]abi.Type, error) {
+	if !strings.HasPrefix(list, "(") {
+		list = "(" + list + ")"
+	}
 
-	if len(args) == 1 && args[0] == "" {
-		return 0
+	_, names, err := SplitSignature(list)
+	if err != nil {
+		return nil, err
+	}
+
+	types := make([]abi.Type, len(names))
+	for i := range names {
+		if types[i], err = ParseType(names[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return types, nil
+}
+
+// IsSupportedType tells whether Mist can decode and encode values of
+// the given type: elementary static types, string, bytes and slices
+// of elementary static types.
+func IsSupportedType(t abi.Type) bool {
+	switch t.T {
+	case abi.ArrayTy, abi.TupleTy, abi.FixedPointTy, abi.FunctionTy:
+		return false
+	case abi.SliceTy:
+		return IsSupportedType(*t.Elem) && !IsDynamicType(*t.Elem)
+	default:
+		return true
+	}
+}
+
+// IsDynamicType tells whether values of the given type are encoded
+// in the tail, i.e. their head is just an offset.
+func IsDynamicType(t abi.Type) bool {
+	switch t.T {
+	case abi.StringTy, abi.BytesTy, abi.SliceTy:
+		return true
+	case abi.ArrayTy:
+		return IsDynamicType(*t.Elem)
+	default:
+		return false
+	}
+}
+
+// ABIArgument is an input or output of an ABIEntry.
+type ABIArgument struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Indexed bool   `json:"indexed,omitempty"`
+}
+
+// ABIEntry describes a function, an event or an error in the JSON
+// format produced by solc.
+type ABIEntry struct {
+	Type            string        `json:"type"`
+	Name            string        `json:"name"`
+	Inputs          []ABIArgument `json:"inputs"`
+	Outputs         []ABIArgument `json:"outputs,omitempty"`
+	StateMutability string        `json:"stateMutability,omitempty"`
+	Anonymous       bool          `json:"anonymous,omitempty"`
+}
+
+// NewABIEntry creates an entry of the given type ("function", "event"
+// or "error") out of a signature like "transfer(address,uint256)".
+func NewABIEntry(typ, signature string) (ABIEntry, error) {
+	name, types, err := SplitSignature(signature)
+	if err != nil {
+		return ABIEntry{}, err
+	}
+	if name == "" {
+		return ABIEntry{}, fmt.Errorf("invalid signature: %s", signature)
+	}
+
+	inputs := make([]ABIArgument, len(types))
+	for i, t := range types {
+		inputs[i] = ABIArgument{Name: "", Type: t, Indexed: false}
 	}
 
-	return len(args)
+	return ABIEntry{
+		Type:            typ,
+		Name:            name,
+		Inputs:          inputs,
+		Outputs:         nil,
+		StateMutability: "",
+		Anonymous:       false,
+	}, nil
+}
+
+// Signature returns the canonical signature of the entry, e.g.
+// "transfer(address,uint256)".
+func (e *ABIEntry) Signature() string {
+	types := make([]string, len(e.Inputs))
+	for i := range e.Inputs {
+		types[i] = e.Inputs[i].Type
+	}
+	return fmt.Sprintf("%s(%s)", e.Name, strings.Join(types, ","))
 }
@@ -36,9 +36,18 @@ func TestNumArguments(t *testing.T) {
 	want := []int{0, 1, 2, 2, 3}
 
 	for i := range signatures {
-		have := mist.NumArguments(signatures[i])
+		have, err := mist.NumArguments(signatures[i])
+		if err != nil {
+			t.Errorf("%s: %v", signatures[i], err)
+		}
 		if have != want[i] {
 			t.Errorf("%s: have %d, want %d", signatures[i], have, want[i])
 		}
 	}
+
+	for _, invalid := range []string{"", "Foo", "Foo(uint256", "Foo(,)"} {
+		if _, err := mist.NumArguments(invalid); err == nil {
+			t.Errorf("%s: want error, have none", invalid)
+		}
+	}
 }
@@ -0,0 +1,262 @@
+package mist
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// +-----------------+
+// | Inline assembly |
+// +-----------------+
+
+// stackEffect returns the number of words an instruction pops from
+// and pushes onto the stack.  PUSHn instructions are not included,
+// literal numbers are pushed instead.
+func stackEffect(op vm.OpCode) (int, int, bool) {
+	switch {
+	case op >= vm.DUP1 && op <= vm.DUP16:
+		n := int(op-vm.DUP1) + 1
+		return n, n + 1, true
+	case op >= vm.SWAP1 && op <= vm.SWAP16:
+		n := int(op-vm.SWAP1) + 2
+		return n, n, true
+	case op >= vm.LOG0 && op <= vm.LOG4:
+		return int(op-vm.LOG0) + 2, 0, true
+	}
+
+	switch op {
+	case vm.STOP, vm.JUMPDEST, vm.INVALID:
+		return 0, 0, true
+	case vm.ADDRESS, vm.ORIGIN, vm.CALLER, vm.CALLVALUE, vm.CALLDATASIZE,
+		vm.CODESIZE, vm.GASPRICE, vm.RETURNDATASIZE, vm.COINBASE,
+		vm.TIMESTAMP, vm.NUMBER, vm.PREVRANDAO, vm.GASLIMIT, vm.CHAINID,
+		vm.SELFBALANCE, vm.BASEFEE, vm.BLOBBASEFEE, vm.PC, vm.MSIZE,
+		vm.GAS, vm.PUSH0:
+		return 0, 1, true
+	case vm.ISZERO, vm.NOT, vm.BALANCE, vm.CALLDATALOAD, vm.EXTCODESIZE,
+		vm.EXTCODEHASH, vm.BLOCKHASH, vm.BLOBHASH, vm.MLOAD, vm.SLOAD,
+		vm.TLOAD:
+		return 1, 1, true
+	case vm.POP, vm.JUMP, vm.SELFDESTRUCT:
+		return 1, 0, true
+	case vm.ADD, vm.MUL, vm.SUB, vm.DIV, vm.SDIV, vm.MOD, vm.SMOD,
+		vm.EXP, vm.SIGNEXTEND, vm.LT, vm.GT, vm.SLT, vm.SGT, vm.EQ,
+		vm.AND, vm.OR, vm.XOR, vm.BYTE, vm.SHL, vm.SHR, vm.SAR,
+		vm.KECCAK256:
+		return 2, 1, true
+	case vm.MSTORE, vm.MSTORE8, vm.SSTORE, vm.TSTORE, vm.JUMPI,
+		vm.RETURN, vm.REVERT:
+		return 2, 0, true
+	case vm.ADDMOD, vm.MULMOD, vm.CREATE:
+		return 3, 1, true
+	case vm.CALLDATACOPY, vm.CODECOPY, vm.RETURNDATACOPY, vm.MCOPY:
+		return 3, 0, true
+	case vm.CREATE2:
+		return 4, 1, true
+	case vm.EXTCODECOPY:
+		return 4, 0, true
+	case vm.DELEGATECALL, vm.STATICCALL:
+		return 6, 1, true
+	case vm.CALL, vm.CALLCODE:
+		return 7, 1, true
+	default:
+		return 0, 0, false
+	}
+}
+
+// halts tells whether execution never continues past an instruction.
+func halts(op vm.OpCode) bool {
+	switch op {
+	case vm.STOP, vm.JUMP, vm.RETURN, vm.REVERT, vm.INVALID, vm.SELFDESTRUCT:
+		return true
+	default:
+		return false
+	}
+}
+
+// fnAsm compiles
+//
+// (asm (inputs...) [:in N] [:out M] items...)
+//
+// where inputs are expressions, pushed so that the first one ends up
+// on top, and items are instruction mnemonics like ADD, numbers to
+// push, expressions (lists) to evaluate and push, label definitions
+// like loop: and label references like @loop.
+//
+// :in and :out declare the stack effect of the items: they consume N
+// words (by default, the number of inputs) and leave M words, where M
+// is either 1 (the default) or 0, in which case the form results in
+// nil.  The declaration is verified by walking the items in order.
+// Label references have to be followed by JUMP or JUMPI, and the
+// stack height has to be the same at every jump to a label and where
+// it's defined.  Items can't reach below their inputs.
+func fnAsm(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+	ebp := esp
+
+	args := assertNargsGte("asm", call, 1)
+	inputs, items := args[0], args[1:]
+
+	if !inputs.IsList() && !inputs.IsNil() {
+		panic(NewCompilationError(
+			inputs.Origin,
+			fmt.Sprintf("invalid asm inputs: want list, have %v", &inputs),
+		))
+	}
+
+	in, out := inputs.NumChildren(), 1
+	for len(items) >= 2 && (items[0].IsThisSymbol(":in") || items[0].IsThisSymbol(":out")) {
+		n := items[1]
+		if n.Type != NodeNumber || !n.ValueNumber.IsUint64() {
+			panic(NewCompilationError(n.Origin, fmt.Sprintf("invalid stack effect: want number, have %v", &n)))
+		}
+		if items[0].IsThisSymbol(":in") {
+			in = int(n.ValueNumber.Uint64())
+		} else {
+			out = int(n.ValueNumber.Uint64())
+		}
+		items = items[2:]
+	}
+
+	if in != inputs.NumChildren() {
+		panic(NewCompilationError(
+			call.Origin,
+			fmt.Sprintf("asm declares %d inputs, have %d", in, inputs.NumChildren()),
+		))
+	}
+	if out > 1 {
+		panic(NewCompilationError(call.Origin, fmt.Sprintf("asm can leave at most 1 word, declared %d", out)))
+	}
+
+	// Labels can be referenced before they are defined.
+	labels := make(map[string]Segment)
+	for _, item := range items {
+		if name, ok := labelDefinition(item); ok {
+			if _, ok := labels[name]; ok {
+				panic(NewCompilationError(item.Origin, "asm label is already defined: "+name))
+			}
+			labels[name] = newSegmentJumpdest()
+		}
+	}
+
+	esp += VisitSequence(v, s, esp, inputs.Children, -1)
+
+	// Stack heights at the labels, as seen by the first jump or
+	// definition that reaches them.
+	heights := make(map[string]int)
+	reach := func(name string, height int, origin Origin) {
+		if want, ok := heights[name]; ok && want != height {
+			panic(NewCompilationError(
+				origin,
+				fmt.Sprintf("asm stack height at %s is %d, have %d", name, want, height),
+			))
+		}
+		heights[name] = height
+	}
+
+	halted := false
+	for i, item := range items {
+		if name, ok := labelDefinition(item); ok {
+			if height, ok := heights[name]; ok && halted {
+				// Reachable only by jumping.
+				esp = ebp + height
+			} else {
+				reach(name, esp-ebp, item.Origin)
+			}
+			v.addSegment(labels[name])
+			halted = false
+			continue
+		}
+
+		switch {
+		case item.Type == NodeNumber:
+			v.VisitNumber(item.ValueNumber)
+			esp += 1
+		case item.IsList():
+			item.Accept(v, s, esp)
+			esp += 1
+		case item.IsSymbol() && strings.HasPrefix(item.ValueString, "@"):
+			label, ok := labels[item.ValueString[1:]]
+			if !ok {
+				panic(NewCompilationError(item.Origin, "void asm label: "+item.ValueString[1:]))
+			}
+			jump := Node{}
+			if i+1 < len(items) && items[i+1].IsSymbol() {
+				jump = items[i+1]
+			}
+			switch strings.ToUpper(jump.ValueString) {
+			case "JUMP":
+				reach(item.ValueString[1:], esp-ebp, item.Origin)
+			case "JUMPI":
+				reach(item.ValueString[1:], esp-ebp-1, item.Origin)
+			default:
+				panic(NewCompilationError(item.Origin, "asm label reference isn't followed by JUMP or JUMPI: "+item.ValueString))
+			}
+			v.addPointer(label.id)
+			esp += 1
+		case item.IsSymbol():
+			op := parseMnemonic(item)
+			pop, push, _ := stackEffect(op)
+			if esp-pop < ebp {
+				panic(NewCompilationError(
+					item.Origin,
+					fmt.Sprintf("%s needs %d words, asm has %d", op, pop, esp-ebp),
+				))
+			}
+			v.addOp(op)
+			esp += push - pop
+			halted = halts(op)
+		default:
+			panic(NewCompilationError(item.Origin, fmt.Sprintf("invalid asm item: %v", &item)))
+		}
+	}
+
+	// Code following a halting instruction is unreachable, so there
+	// is nothing to check.
+	if !halted && esp-ebp != out {
+		panic(NewCompilationError(
+			call.Origin,
+			fmt.Sprintf("asm declares %d outputs, leaves %d", out, esp-ebp),
+		))
+	}
+	esp = ebp + out
+
+	if out == 0 {
+		// All expressions have a value.
+		v.VisitNil()
+		esp += 1
+	}
+
+	if esp != ebp+1 {
+		panic("broken invariant")
+	}
+}
+
+// labelDefinition recognizes label definitions like loop: and returns
+// the name of the label.
+func labelDefinition(item Node) (string, bool) {
+	if !item.IsSymbol() || len(item.ValueString) < 2 || !strings.HasSuffix(item.ValueString, ":") {
+		return "", false
+	}
+	return strings.TrimSuffix(item.ValueString, ":"), true
+}
+
+// parseMnemonic resolves an instruction mnemonic like ADD or add.
+func parseMnemonic(item Node) vm.OpCode {
+	name := strings.ToUpper(item.ValueString)
+	op := vm.StringToOp(name)
+
+	// Unknown mnemonics resolve to STOP.
+	if op.String() != name {
+		panic(NewCompilationError(item.Origin, "unknown instruction: "+item.ValueString))
+	}
+	if op.IsPush() && op != vm.PUSH0 {
+		panic(NewCompilationError(item.Origin, "use a number instead of "+name))
+	}
+	if _, _, ok := stackEffect(op); !ok {
+		panic(NewCompilationError(item.Origin, "unsupported instruction: "+name))
+	}
+
+	return op
+}
@@ -0,0 +1,89 @@
+package mist_test
+
+import (
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ydm/mist"
+)
+
+func TestCompileAsm(t *testing.T) {
+	t.Parallel()
+
+	cases := []string{
+		"(asm (1 2) :in 2 :out 1 ADD)",
+		"(asm () caller)",
+		"(asm (7) :out 0 0 MSTORE)",
+		"(asm () (+ 1 2) MLOAD)",
+		"(asm () :out 0 0 0 REVERT)",
+	}
+
+	want := []string{
+		"6002600101",
+		"33",
+		"60076000526000",
+		"600260010151",
+		"60006000fd6000",
+	}
+
+	// The cases are made of constants, which would be folded.
+	compileAndCompareOffopt(t, mist.OffoptArithmetic|mist.OffoptIf, cases, want)
+}
+
+func TestAsm(t *testing.T) {
+	t.Parallel()
+
+	const program = `
+(defun sum (n)
+  (asm (n) :out 1
+       0                        ; [acc n]
+       loop:
+       DUP2 ISZERO @end JUMPI
+       DUP2 ADD                 ; [acc+n n]
+       SWAP1 1 SWAP1 SUB SWAP1  ; [acc n-1]
+       @loop JUMP
+       end:
+       SWAP1 POP))
+
+(dispatch ("sum(uint256)" sum))`
+
+	ret, err := execute(t, program, encodeCall("sum(uint256)", "0a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := word(ret); !have.Eq(uint256.NewInt(55)) {
+		t.Errorf("have %v, want 55", have)
+	}
+}
+
+func TestAsmErrors(t *testing.T) {
+	t.Parallel()
+
+	cases := []string{
+		"(asm () FOO)",
+		"(asm () ADD)",
+		"(asm (1) :in 2 POP)",
+		"(asm (1 2) ADD ADD)",
+		"(asm (1 2) :out 1 POP POP)",
+		"(asm () :out 2 1 2)",
+		"(asm () PUSH1 1)",
+		"(asm () @nowhere)",
+		"(asm () a: a: 1)",
+		`(asm () "string")`,
+		"(asm 1 2)",
+		"(+ 100 (asm ((calldata-size)) @end JUMPI 5 end:))",
+		"(asm () :out 0 loop: 1 @loop JUMP)",
+		"(asm () @end end:)",
+	}
+
+	compile := func(program string) error {
+		_, err := mist.CompileContract(program, t.Name(), mist.Options{Init: true})
+		return err
+	}
+
+	for i, c := range cases {
+		if err := compile(c); err == nil {
+			t.Errorf("case %d: want error, have none: %s", i, c)
+		}
+	}
+}
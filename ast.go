@@ -262,9 +262,9 @@ func (n *Node) Accept(v Visitor, s *Scope, esp int) {
 	case NodeList:
 		if n.NumChildren() < 1 {
 			// TODO: I should support (empty) arrays too!
-			panic("TODO")
+			panic(NewCompilationError(n.Origin, "empty list can't be evaluated"))
 		} else if !n.Children[0].IsSymbol() {
-			panic(fmt.Sprintf("%v: %s is not a symbol", n.Children[0].Origin, n.Children[0].String()))
+			panic(NewCompilationError(n.Children[0].Origin, fmt.Sprintf("%s is not a symbol", n.Children[0].String())))
 		} else {
 			v.VisitFunction(s, esp, *n)
 			return
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"os"
@@ -10,6 +12,20 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "fmt" {
+		os.Exit(runFmt(os.Args[2:]))
+	}
+
+	checked := flag.Bool("checked", false, "revert on arithmetic overflow, as if the program was wrapped in (checked)")
+	strategy := flag.String("dispatch", "auto", "how (case) and (dispatch) look up keys: auto, linear or binary")
+	flag.Parse()
+
+	dispatch, ok := dispatchStrategies[*strategy]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "invalid dispatch strategy: "+*strategy)
+		os.Exit(2)
+	}
+
 	// source := argv[1]
 	// stream, err := os.Open(source)
 	// if err != nil {
@@ -30,21 +46,26 @@ func main() {
 
 	const (
 		// TODO: Turn into cli args.
-		init    = true
-		verbose = true
+		init      = true
+		verbose   = true
 		decompile = false
 	)
 
 	// Decorate with a contract constructor.
-	code, err := mist.Compile(decoded, source, init, 0)
+	contract, err := mist.CompileContract(decoded, source, mist.Options{
+		Init:     init,
+		Offopt:   0,
+		Checked:  *checked,
+		Dispatch: dispatch,
+	})
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	code := contract.Code
+	ctor := contract.Constructor
 
 	if verbose {
-		ctor := mist.MakeConstructor(code)
-
 		fmt.Println("combined:")
 		fmt.Println("0x" + ctor + code)
 		fmt.Println()
@@ -57,11 +78,102 @@ func main() {
 		fmt.Println("0x" + code)
 		fmt.Println()
 
+		printJSON("abi:", contract.ABI)
+		printJSON("storageLayout:", contract.StorageLayout)
+
 		if decompile {
 			fmt.Print(mist.Decompile(code))
 		}
 	} else {
-		ctor := mist.MakeConstructor(code)
 		fmt.Print("0x" + ctor + code)
 	}
 }
+
+var dispatchStrategies = map[string]mist.DispatchStrategy{
+	"auto":   mist.DispatchAuto,
+	"linear": mist.DispatchLinear,
+	"binary": mist.DispatchBinary,
+}
+
+func printJSON(title string, v any) {
+	fmt.Println(title)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		panic(err)
+	}
+
+	fmt.Println()
+}
+
+// runFmt implements
+//
+//	mist fmt [--check] [FILE...]
+//
+// which formats the given files in place, or stdin to stdout if there
+// are none.  With --check, nothing is written: the files that aren't
+// formatted are listed instead and the exit code is 1.
+func runFmt(args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	check := flags.Bool("check", false, "list unformatted files instead of rewriting them")
+	_ = flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		inp, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		formatted, err := mist.Format(string(inp), "stdin")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if *check {
+			if formatted != string(inp) {
+				fmt.Println("stdin")
+				return 1
+			}
+			return 0
+		}
+		fmt.Print(formatted)
+		return 0
+	}
+
+	status := 0
+	for _, path := range flags.Args() {
+		inp, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 2
+			continue
+		}
+		formatted, err := mist.Format(string(inp), path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 2
+			continue
+		}
+		if formatted == string(inp) {
+			continue
+		}
+		if *check {
+			fmt.Println(path)
+			status = max(status, 1)
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err == nil {
+			err = os.WriteFile(path, []byte(formatted), info.Mode().Perm())
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 2
+		}
+	}
+
+	return status
+}
@@ -2,6 +2,7 @@ package mist
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 	"sync/atomic"
 
@@ -14,6 +15,14 @@ const (
 	freeMemoryInitial = 0x80
 )
 
+// Codes of Solidity's Panic(uint256) error.
+const (
+	panicArithmetic     = 0x11 // Overflow or underflow.
+	panicDivisionByZero = 0x12 // Division or modulo by zero.
+	panicEmptyArray     = 0x31 // Pop from an empty array.
+	panicIndex          = 0x32 // Array index out of bounds.
+)
+
 // +---------+
 // | Segment |
 // +---------+
@@ -194,11 +203,35 @@ type StoredFunction struct {
 
 type BytecodeVisitor struct {
 	main []Segment
+	abi  []ABIEntry
+
+	// The data section follows the code, each entry is preceded by
+	// an empty segment used as its label.
+	data       []Segment
+	dataLabels map[string]int32
+
+	dispatch DispatchStrategy
+
+	// Placeholders for immutables in the runtime code: the IDs of
+	// the data segments that follow each PUSH32.
+	immutables map[string][]int32
+
+	// Set only while compiling the constructor.
+	constructor *constructorContext
 }
 
 func NewBytecodeVisitor(init bool) *BytecodeVisitor {
 	v := &BytecodeVisitor{
 		main: make([]Segment, 0, 2056),
+		abi:  make([]ABIEntry, 0, 16),
+
+		data:       make([]Segment, 0),
+		dataLabels: make(map[string]int32),
+
+		dispatch: DispatchAuto,
+
+		immutables:  make(map[string][]int32),
+		constructor: nil,
 	}
 
 	if init {
@@ -232,6 +265,19 @@ func (v *BytecodeVisitor) addPointer(dest int32) {
 	v.addSegment(newSegmentPointer(dest))
 }
 
+// addData appends hexadecimal data to the data section, unless it's
+// already there, and returns the ID of its label.
+func (v *BytecodeVisitor) addData(hex string) int32 {
+	if id, ok := v.dataLabels[hex]; ok {
+		return id
+	}
+
+	label := newEmptySegment()
+	v.data = append(v.data, label, newSegmentData(hex))
+	v.dataLabels[hex] = label.id
+	return label.id
+}
+
 func (v *BytecodeVisitor) addU256(x *uint256.Int) {
 	hex := x.Hex()
 
@@ -257,7 +303,7 @@ func (v *BytecodeVisitor) pushU256(x *uint256.Int) {
 
 	length := len(hex)/2 - 1 + len(hex)%2
 	if length < 1 || 32 < length {
-		panic("TODO")
+		panic(NewCompilationError(NewOriginEmpty(), "invalid number: "+hex))
 	}
 
 	op := vm.OpCode(byte(vm.PUSH0) + byte(length))
@@ -269,6 +315,217 @@ func (v *BytecodeVisitor) pushU64(x uint64) {
 	v.pushU256(uint256.NewInt(x))
 }
 
+// +------------------+
+// | Memory functions |
+// +------------------+
+
+// storeWords expects [PTR W0 W1 ... Wn-1] on the stack, stores each Wi
+// at memory offset PTR+0x20*i and leaves only [PTR] on the stack.
+func (v *BytecodeVisitor) storeWords(n int) {
+	for i := range n {
+		v.addOp(vm.SWAP1) // [Wi PTR ...]
+		v.addOp(vm.DUP2)  // [PTR Wi PTR ...]
+		if i > 0 {
+			v.pushU64(uint64(0x20 * i))
+			v.addOp(vm.ADD) // [PTR+OFF Wi PTR ...]
+		}
+		v.addOp(vm.MSTORE) // [PTR ...]
+	}
+}
+
+// copyString copies a string literal from the data section to newly
+// allocated memory, where its length is followed by the data, and
+// leaves [PP] on the stack.
+func (v *BytecodeVisitor) copyString(value string) {
+	encoded := EncodeString(value)
+	size := uint64(len(encoded) / 2)
+
+	v.pushU64(freeMemoryPointer)  // [FP]
+	v.addOp(vm.MLOAD)             // [PP]
+	v.pushU64(uint64(len(value))) // [LN PP]
+	v.addOp(vm.DUP2)              // [PP LN PP]
+	v.addOp(vm.MSTORE)            // [PP], m[PP]=LN
+	if size > 0 {
+		v.pushU64(size)                  // [SZ PP]
+		v.addPointer(v.addData(encoded)) // [CP SZ PP]
+		v.addOp(vm.DUP3)                 //
+		v.pushU64(0x20)                  //
+		v.addOp(vm.ADD)                  // [DD CP SZ PP]
+		v.addOp(vm.CODECOPY)             // [PP], m[DD:+SZ]=code[CP:+SZ]
+	}
+	v.addOp(vm.DUP1)             // [PP PP]
+	v.pushU64(0x20 + size)       //
+	v.addOp(vm.ADD)              // [NF PP]
+	v.pushU64(freeMemoryPointer) // [FP NF PP]
+	v.addOp(vm.MSTORE)           // [PP]
+}
+
+// allocate expects [SZ MM ...] on the stack, where MM is the current
+// free memory pointer, and bumps the free memory pointer past a
+// length word followed by SZ bytes (rounded up to a whole number of
+// words).  Leaves [MM ...].
+func (v *BytecodeVisitor) allocate() {
+	v.pushU64(0x1f)              // [1F SZ MM]
+	v.addOp(vm.ADD)              //
+	v.pushU64(0x1f)              //
+	v.addOp(vm.NOT)              // [~1F SZ+1F MM]
+	v.addOp(vm.AND)              // [RS MM], RS is SZ rounded up
+	v.addOp(vm.DUP2)             // [MM RS MM]
+	v.addOp(vm.ADD)              //
+	v.pushU64(0x20)              //
+	v.addOp(vm.ADD)              // [NF MM], NF=MM+0x20+RS
+	v.pushU64(freeMemoryPointer) // [FP NF MM]
+	v.addOp(vm.MSTORE)           // [MM]
+}
+
+// +-------------------+
+// | Control functions |
+// +-------------------+
+
+// revertUnless expects [COND ...] on the stack, pops COND and reverts
+// with empty data if it's zero.
+func (v *BytecodeVisitor) revertUnless() {
+	ok := newSegmentJumpdest()
+	v.addPointer(ok.id)
+	v.addOp(vm.JUMPI)
+	v.pushU64(0)
+	v.addOp(vm.DUP1)
+	v.addOp(vm.REVERT)
+	v.addSegment(ok)
+}
+
+// panicUnless expects [COND ...] on the stack, pops COND and reverts
+// with Solidity's Panic(uint256) error with the given code if it's
+// zero.
+func (v *BytecodeVisitor) panicUnless(code uint64) {
+	ok := newSegmentJumpdest()
+	v.addPointer(ok.id)
+	v.addOp(vm.JUMPI)
+	v.addOp(vm.PUSH4)
+	v.addHex("4e487b71") // Panic(uint256)
+	v.pushU64(0xe0)
+	v.addOp(vm.SHL)
+	v.pushU64(0)
+	v.addOp(vm.MSTORE)
+	v.pushU64(code)
+	v.pushU64(0x04)
+	v.addOp(vm.MSTORE)
+	v.pushU64(0x24)
+	v.pushU64(0)
+	v.addOp(vm.REVERT)
+	v.addSegment(ok)
+}
+
+// +----------------------+
+// | Arithmetic functions |
+// +----------------------+
+
+// checkedAdd expects [A B ...] on the stack and leaves [A+B ...], or
+// panics on overflow.
+func (v *BytecodeVisitor) checkedAdd() {
+	v.addOp(vm.DUP2)               // [B A B]
+	v.addOp(vm.ADD)                // [S B]
+	v.addOp(vm.SWAP1)              // [B S]
+	v.addOp(vm.DUP2)               // [S B S]
+	v.addOp(vm.LT)                 //
+	v.addOp(vm.ISZERO)             // [OK S], OK=S>=B
+	v.panicUnless(panicArithmetic) // [S]
+}
+
+// checkedSub expects [A B ...] on the stack and leaves [A-B ...], or
+// panics on underflow.
+func (v *BytecodeVisitor) checkedSub() {
+	v.addOp(vm.DUP2)               // [B A B]
+	v.addOp(vm.DUP2)               // [A B A B]
+	v.addOp(vm.LT)                 //
+	v.addOp(vm.ISZERO)             // [OK A B], OK=A>=B
+	v.panicUnless(panicArithmetic) // [A B]
+	v.addOp(vm.SUB)                // [D]
+}
+
+// checkedMul expects [A B ...] on the stack and leaves [A*B ...], or
+// panics on overflow.
+func (v *BytecodeVisitor) checkedMul() {
+	v.addOp(vm.DUP2)               // [B A B]
+	v.addOp(vm.DUP2)               // [A B A B]
+	v.addOp(vm.MUL)                // [P A B]
+	v.addOp(vm.DUP2)               // [A P A B]
+	v.addOp(vm.DUP2)               // [P A P A B]
+	v.addOp(vm.DIV)                // [Q P A B], Q=P/A
+	v.addOp(vm.DUP4)               // [B Q P A B]
+	v.addOp(vm.EQ)                 // [EQ P A B]
+	v.addOp(vm.DUP3)               // [A EQ P A B]
+	v.addOp(vm.ISZERO)             //
+	v.addOp(vm.OR)                 // [OK P A B], OK=(A=0 or P/A=B)
+	v.panicUnless(panicArithmetic) // [P A B]
+	v.addOp(vm.SWAP2)              // [B A P]
+	v.addOp(vm.POP)                //
+	v.addOp(vm.POP)                // [P]
+}
+
+// checkedExp expects [A B ...] on the stack and leaves [A**B ...], or
+// panics on overflow.  Uses exponentiation by squaring.
+func (v *BytecodeVisitor) checkedExp() {
+	loop := newSegmentJumpdest()
+	skip := newSegmentJumpdest()
+	done := newSegmentJumpdest()
+
+	v.pushU64(1)       // [R A B]
+	v.addSegment(loop) //
+	v.addOp(vm.DUP3)   // [B R A B]
+	v.addOp(vm.ISZERO) //
+	v.addPointer(done.id)
+	v.addOp(vm.JUMPI)  // [R A B]
+	v.addOp(vm.DUP3)   // [B R A B]
+	v.pushU64(1)       //
+	v.addOp(vm.AND)    //
+	v.addOp(vm.ISZERO) //
+	v.addPointer(skip.id)
+	v.addOp(vm.JUMPI)  // [R A B]
+	v.addOp(vm.DUP2)   // [A R A B]
+	v.checkedMul()     // [R A B], R=R*A
+	v.addSegment(skip) //
+	v.addOp(vm.SWAP2)  // [B A R]
+	v.pushU64(1)       //
+	v.addOp(vm.SHR)    //
+	v.addOp(vm.SWAP2)  // [R A B], B=B>>1
+	v.addOp(vm.DUP3)   // [B R A B]
+	v.addOp(vm.ISZERO) //
+	v.addPointer(done.id)
+	v.addOp(vm.JUMPI) // [R A B]
+	v.addOp(vm.SWAP1) // [A R B]
+	v.addOp(vm.DUP1)  // [A A R B]
+	v.checkedMul()    // [A R B], A=A*A
+	v.addOp(vm.SWAP1) // [R A B]
+	v.addPointer(loop.id)
+	v.addOp(vm.JUMP)
+	v.addSegment(done) // [R A B]
+	v.addOp(vm.SWAP2)  // [B A R]
+	v.addOp(vm.POP)    //
+	v.addOp(vm.POP)    // [R]
+}
+
+// checkedDiv expects [A B ...] on the stack and leaves the result of
+// op (DIV or MOD) applied to A and B, or panics if B is zero.
+func (v *BytecodeVisitor) checkedDiv(op vm.OpCode) {
+	v.addOp(vm.DUP2)                   // [B A B]
+	v.panicUnless(panicDivisionByZero) // [A B]
+	v.addOp(op)                        // [Q]
+}
+
+// useBinarySearch tells whether n keys known at compile time should
+// be looked up by a binary search instead of a linear one.
+func (v *BytecodeVisitor) useBinarySearch(n int) bool {
+	switch v.dispatch {
+	case DispatchLinear:
+		return false
+	case DispatchBinary:
+		return n > 1
+	default:
+		return n >= BinarySearchThreshold
+	}
+}
+
 // +-----------------+
 // | Visit functions |
 // +-----------------+
@@ -287,14 +544,16 @@ func (v *BytecodeVisitor) VisitNumber(x *uint256.Int) {
 
 func (v *BytecodeVisitor) VisitString(n Node) {
 	if !n.IsString() {
-		panic("TODO")
+		panic(NewCompilationError(n.Origin, fmt.Sprintf("want string, have %v", &n)))
 	}
 
 	encoded := EncodeRLP(n.ValueString)
 	length := len(encoded) / 2
 	if length > 32 {
-		// Still not supporting strings bigger than a single word.
-		panic("string literal is longer than 31 characters")
+		// Strings that don't fit in a single word are copied to
+		// memory instead.
+		v.copyString(n.ValueString)
+		return
 	}
 
 	op := vm.OpCode(byte(vm.PUSH0) + byte(length))
@@ -321,9 +580,19 @@ func (v *BytecodeVisitor) VisitSymbol(s *Scope, esp int, symbol Node) {
 		return
 	}
 
-	if pos, ok := s.GetStorageVariable(symbol.ValueString); ok {
-		v.pushU64(uint64(pos))
-		v.addOp(vm.SLOAD)
+	if variable, ok := s.GetStorageVariable(symbol.ValueString); ok {
+		if variable.Type.Kind != StorageValue {
+			panic(NewCompilationError(
+				symbol.Origin,
+				fmt.Sprintf("%s of type %s cannot be used as a value", symbol.ValueString, variable.Type.Name),
+			))
+		}
+		v.loadStorage(variable)
+		return
+	}
+
+	if immutable, ok := s.GetImmutable(symbol.ValueString); ok {
+		v.loadImmutable(immutable)
 		return
 	}
 
@@ -332,7 +601,7 @@ func (v *BytecodeVisitor) VisitSymbol(s *Scope, esp int, symbol Node) {
 		return
 	}
 
-	panic(fmt.Sprintf("%v: void variable %s", symbol.Origin, symbol.ValueString))
+	panic(NewCompilationError(symbol.Origin, fmt.Sprintf("void variable %s", symbol.ValueString)))
 }
 
 func (v *BytecodeVisitor) VisitFunction(s *Scope, esp int, call Node) {
@@ -340,6 +609,7 @@ func (v *BytecodeVisitor) VisitFunction(s *Scope, esp int, call Node) {
 		// Custom functions have precedence over
 		// native/builtin.
 		handleDefinedFunc,
+		handleInterfaceFunc,
 
 		handleNativeFunc,
 		handleVariadicFunc,
@@ -354,7 +624,7 @@ func (v *BytecodeVisitor) VisitFunction(s *Scope, esp int, call Node) {
 		}
 	}
 
-	panic(fmt.Sprintf("%v: void function: %s", call.Origin, call.FunctionName()))
+	panic(NewCompilationError(call.Origin, fmt.Sprintf("void function: %s", call.FunctionName())))
 }
 
 // +-------------------+
@@ -363,11 +633,47 @@ func (v *BytecodeVisitor) VisitFunction(s *Scope, esp int, call Node) {
 
 func (v *BytecodeVisitor) getSegments() []Segment {
 	n := len(v.main)
-	ans := make([]Segment, n, 2*n)
+	ans := make([]Segment, n, 2*n+len(v.data)+1)
 	copy(ans, v.main)
+
+	// Make sure execution never falls through to data.
+	if len(v.data) > 0 {
+		ans = append(ans, newSegmentOpCode(vm.STOP))
+		ans = append(ans, v.data...)
+	}
+
 	return ans
 }
 
 func (v *BytecodeVisitor) GetOptimizedSegments() []Segment {
 	return OptimizeBytecode(v.getSegments())
 }
+
+// +---------------+
+// | ABI functions |
+// +---------------+
+
+// addABIEntry registers an entry of the contract's ABI.  Entries with
+// the same type and signature are registered only once.
+func (v *BytecodeVisitor) addABIEntry(e ABIEntry) {
+	for i := range v.abi {
+		if v.abi[i].Type == e.Type && v.abi[i].Signature() == e.Signature() {
+			return
+		}
+	}
+	v.abi = append(v.abi, e)
+}
+
+// GetABI returns the entries of the contract's ABI, sorted by type and
+// name, just like solc does.
+func (v *BytecodeVisitor) GetABI() []ABIEntry {
+	ans := make([]ABIEntry, len(v.abi))
+	copy(ans, v.abi)
+	sort.SliceStable(ans, func(i, j int) bool {
+		if ans[i].Type != ans[j].Type {
+			return ans[i].Type < ans[j].Type
+		}
+		return ans[i].Name < ans[j].Name
+	})
+	return ans
+}
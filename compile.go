@@ -1,15 +1,87 @@
 package mist
 
+// Contract is the result of compiling a Mist program.
+type Contract struct {
+	Constructor   string        // Init code that deploys Code, hex encoded.
+	Code          string        // Runtime bytecode, hex encoded.
+	ABI           []ABIEntry    // Functions, events and errors.
+	StorageLayout StorageLayout // Where storage variables live.
+}
+
+// DispatchStrategy controls how (case) and (dispatch) look up keys
+// that are known at compile time, e.g. function selectors.
+type DispatchStrategy int
+
+const (
+	// DispatchAuto uses a binary search once there are at least
+	// BinarySearchThreshold keys and a linear search otherwise.
+	DispatchAuto DispatchStrategy = iota
+
+	// DispatchLinear compares the keys one by one, in order.
+	DispatchLinear
+
+	// DispatchBinary sorts the keys and uses a binary search.
+	DispatchBinary
+)
+
+// BinarySearchThreshold is the minimum number of keys for which
+// DispatchAuto uses a binary search.
+const BinarySearchThreshold = 8
+
+// Options control the compilation of a Mist program.
+type Options struct {
+	Init     bool             // Initialize the free memory pointer.
+	Offopt   uint32           // Optimizations to turn off, see OffoptArithmetic.
+	Checked  bool             // Panic on arithmetic overflow, as if in (checked).
+	Dispatch DispatchStrategy // How to look up function selectors.
+}
+
 func Compile(program, source string, init bool, offopt uint32) (string, error) {
-	tokens, err := Scan(program, source)
+	contract, err := CompileContract(program, source, Options{
+		Init:     init,
+		Offopt:   offopt,
+		Checked:  false,
+		Dispatch: DispatchAuto,
+	})
 	if err != nil {
 		return "", err
 	}
 
-	progn := Parse(&tokens)
-	ast := OptimizeAST(progn, offopt)
+	return contract.Code, nil
+}
 
-	visitor := NewBytecodeVisitor(init)
+func CompileContract(program, source string, options Options) (contract Contract, err error) {
+	// Compilation errors are raised as panics deep down the visitor,
+	// turn them into errors.  Any other panic is a bug.
+	defer func() {
+		if r := recover(); r != nil {
+			compilationError, ok := r.(CompilationError)
+			if !ok {
+				panic(r)
+			}
+			contract, err = Contract{}, compilationError
+		}
+	}()
+
+	tokens, err := Scan(program, source)
+	if err != nil {
+		return Contract{}, err
+	}
+
+	parsed, err := Parse(&tokens)
+	if err != nil {
+		return Contract{}, err
+	}
+	progn := parsed
+	if options.Checked {
+		checked := NewNodeApplication("checked", progn.Origin)
+		checked.AddChild(progn)
+		progn = checked
+	}
+	ast := OptimizeAST(progn, options.Offopt)
+
+	visitor := NewBytecodeVisitor(options.Init)
+	visitor.dispatch = options.Dispatch
 	global := NewGlobalScope()
 	ast.Accept(visitor, global, 0)
 
@@ -17,5 +89,13 @@ func Compile(program, source string, init bool, offopt uint32) (string, error) {
 	segments = SegmentsPopulatePointers(segments)
 	code := SegmentsToString(segments)
 
-	return code, nil
+	immutables := immutablePositions(segments, visitor.immutables)
+	constructor := compileConstructor(parsed, code, immutables, options)
+
+	return Contract{
+		Constructor:   constructor,
+		Code:          code,
+		ABI:           visitor.GetABI(),
+		StorageLayout: NewStorageLayout(global, source),
+	}, nil
 }
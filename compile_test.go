@@ -1,9 +1,12 @@
 package mist_test
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"testing"
 
+	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ydm/mist"
 
 	"github.com/google/go-cmp/cmp"
@@ -12,7 +15,13 @@ import (
 func compileAndCompare(t *testing.T, cases, want []string) {
 	t.Helper()
 
-	const offopt = mist.OffoptIf
+	compileAndCompareOffopt(t, mist.OffoptIf, cases, want)
+}
+
+// compileAndCompareOffopt is compileAndCompare with the given
+// optimizations turned off.
+func compileAndCompareOffopt(t *testing.T, offopt uint32, cases, want []string) {
+	t.Helper()
 
 	for i, c := range cases {
 		have, err := mist.Compile(c, fmt.Sprintf("case%d", i), false, offopt)
@@ -111,6 +120,74 @@ func TestCompileComplex(t *testing.T) {
 	compileAndCompare(t, cases, want)
 }
 
+func TestCompileContractABI(t *testing.T) {
+	t.Parallel()
+
+	const program = `
+(deferror InsufficientBalance (uint256 uint256))
+(deferror Unauthorized ())
+(defun name () 0)
+(defun transfer (to value)
+  (emit "Transfer(address,address,uint256)" :indexed (caller) to :data value)
+  (emit "Deposit(uint256,address)" :data value :indexed to)
+  t)
+(dispatch
+ ("name()"                     name     :view :returns "(string)")
+ ("transfer(address,uint256)"  transfer :returns "(bool)")
+ (:receive                     name))`
+
+	contract, err := mist.CompileContract(program, t.Name(), mist.Options{Init: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := json.Marshal(contract.ABI)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := abi.JSON(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have := len(parsed.Methods); have != 2 {
+		t.Errorf("methods: have %d, want 2", have)
+	}
+	if have := parsed.Methods["transfer"].Sig; have != "transfer(address,uint256)" {
+		t.Errorf("transfer: have %s", have)
+	}
+	if have := parsed.Methods["name"].Outputs; len(have) != 1 || have[0].Type.String() != "string" {
+		t.Errorf("name outputs: have %v", have)
+	}
+
+	if have := parsed.Methods["name"].StateMutability; have != "view" {
+		t.Errorf("name mutability: have %s, want view", have)
+	}
+	if have := parsed.Methods["transfer"].StateMutability; have != "nonpayable" {
+		t.Errorf("transfer mutability: have %s, want nonpayable", have)
+	}
+	if !parsed.HasReceive() || parsed.HasFallback() {
+		t.Errorf("receive: have %v, fallback: have %v", parsed.HasReceive(), parsed.HasFallback())
+	}
+
+	transfer := parsed.Events["Transfer"]
+	if !transfer.Inputs[0].Indexed || !transfer.Inputs[1].Indexed || transfer.Inputs[2].Indexed {
+		t.Errorf("transfer inputs: have %v", transfer.Inputs)
+	}
+	deposit := parsed.Events["Deposit"]
+	if deposit.Inputs[0].Indexed || !deposit.Inputs[1].Indexed {
+		t.Errorf("deposit inputs: have %v", deposit.Inputs)
+	}
+
+	if have := parsed.Errors["InsufficientBalance"].Sig; have != "InsufficientBalance(uint256,uint256)" {
+		t.Errorf("InsufficientBalance: have %s", have)
+	}
+	if have := parsed.Errors["Unauthorized"].Sig; have != "Unauthorized()" {
+		t.Errorf("Unauthorized: have %s", have)
+	}
+}
+
 func TestCompileDefconst(t *testing.T) {
 	t.Parallel()
 
@@ -169,6 +246,30 @@ func TestCompileDefun(t *testing.T) {
 	compileAndCompare(t, cases, want)
 }
 
+func TestCompileEmit(t *testing.T) {
+	t.Parallel()
+
+	cases := []string{
+		`(emit "Ping()")`,
+		`(emit "Transfer(address,address,uint256)" :indexed 1 2 :data 3)`,
+		`(emit "Data(uint256,uint256)" 1 2)`,
+		`(emit "A(uint256)" :anonymous :indexed 7)`,
+		`(emit3 "Transfer(address,address,uint256)" 1 2 3)`,
+		`(emit "E(uint256,address)" :data 1 :indexed 2)`,
+	}
+
+	want := []string{
+		"7fca6e822df923f741dfe968d15d80a18abd25bd1e748bcb9ad81fea5bbb7386af6000604051a16000",
+		"600260017fddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef60206003604051908152a36000",
+		"7fdeceb300b46c4bcd559f1a5206ed749c73f30312ec5a675a828ab0d7ec1bcb18604060026001604051908152908160200152a16000",
+		"60076000604051a16000",
+		"600260017fddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef60206003604051908152a36000",
+		"60027f2a3b6aa5d2ecab8307f0bb3fc871f86aa592b1148cced9620d182a88cdb26c2160206001604051908152a26000",
+	}
+
+	compileAndCompare(t, cases, want)
+}
+
 func TestCompileIf(t *testing.T) {
 	t.Parallel()
 
@@ -194,7 +295,8 @@ func TestCompileIf(t *testing.T) {
 		"600160046002600202040361001557600061001e565b60036002016001015b5000",
 	}
 
-	compileAndCompare(t, cases, want)
+	// The cases are made of constants, which would be folded.
+	compileAndCompareOffopt(t, mist.OffoptArithmetic|mist.OffoptIf, cases, want)
 }
 
 func TestCompileSelector(t *testing.T) {
@@ -213,6 +315,33 @@ func TestCompileSelector(t *testing.T) {
 	compileAndCompare(t, cases, want)
 }
 
+func TestCompileSigned(t *testing.T) {
+	t.Parallel()
+
+	cases := []string{
+		"(s/ 6 -2)",
+		"(smod -7 2)",
+		"(s< -1 0)",
+		"(s> 1 -1)",
+		"(sar -16 2)",
+		"(signextend 0 0xff)",
+		"(s<= 1 2)",
+	}
+
+	want := []string{
+		"7ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffe600605",
+		"60027ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff907",
+		"60007fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff12",
+		"7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff600113",
+		"7ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff060021d",
+		"60ff60000b",
+		"600260011315",
+	}
+
+	// The cases are made of constants, which would be folded.
+	compileAndCompareOffopt(t, mist.OffoptArithmetic|mist.OffoptIf, cases, want)
+}
+
 func TestCompileString(t *testing.T) {
 	t.Parallel()
 
@@ -260,5 +389,61 @@ func TestCompileVariadic(t *testing.T) {
 		"6007600317600117",
 	}
 
+	// The cases are made of constants, which would be folded.
+	compileAndCompareOffopt(t, mist.OffoptArithmetic|mist.OffoptIf, cases, want)
+}
+
+func TestCompileIntrospection(t *testing.T) {
+	t.Parallel()
+
+	cases := []string{
+		"(block-hash 1)",
+		"(extcode-size 0xdead)",
+		"(extcode-hash 0xdead)",
+		"(extcode-copy 0xdead 0 1 2)",
+		"(calldata-copy 0 4 0x20)",
+		"(code-copy 0 0 0x20)",
+		"(returndata-copy 0 0 (returndata-size))",
+		"(blob-hash 0)",
+		"(blob-base-fee)",
+	}
+
+	want := []string{
+		"600140",
+		"61dead3b",
+		"61dead3f",
+		"60026001600061dead3c6000",
+		"602060046000376000",
+		"602060006000396000",
+		"3d600060003e6000",
+		"600049",
+		"4a",
+	}
+
 	compileAndCompare(t, cases, want)
 }
+
+func TestCompileComments(t *testing.T) {
+	t.Parallel()
+
+	cases := []string{
+		"#| (+ 1 2) |# (caller)",
+		"#| outer #| inner |# still outer |# (caller)",
+		"#;(+ 1 2) (caller)",
+		"(+ 1 #;(* 2 3) 2)",
+		"(+ 1 #;#;3 4 2)",
+		"(+ 1 2) #;(caller)",
+	}
+
+	want := []string{
+		"33",
+		"33",
+		"33",
+		"6002600101",
+		"6002600101",
+		"6002600101",
+	}
+
+	// The cases are made of constants, which would be folded.
+	compileAndCompareOffopt(t, mist.OffoptArithmetic|mist.OffoptIf, cases, want)
+}
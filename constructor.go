@@ -0,0 +1,373 @@
+package mist
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// +-------------+
+// | Constructor |
+// +-------------+
+
+// The constructor is compiled as a separate program that consists of
+// all top-level declarations, followed by the (defconstructor).
+// Its init code is laid out as
+//
+//	[constructor] [runtime code] [ABI-encoded constructor arguments]
+//
+// and, once the body is done, it copies the runtime code to memory,
+// embeds the values of immutables into it and returns it.
+
+// constructorContext describes the runtime code deployed by the
+// constructor.
+type constructorContext struct {
+	runtime       int32            // Label at the end of the constructor, where runtime code starts.
+	runtimeLength int              // In bytes.
+	immutables    map[string][]int // Positions of placeholders within runtime code.
+}
+
+// declarations are the forms that compile to the same thing in the
+// constructor and in the runtime code.
+var declarations = map[string]bool{
+	"defconst":       true,
+	"defconstructor": true,
+	"deferror":       true,
+	"defimmutable":   true,
+	"definterface":   true,
+	"defstruct":      true,
+	"defun":          true,
+	"defvar":         true,
+}
+
+func isDeclaration(n Node) bool {
+	return n.IsList() && n.NumChildren() > 0 && n.Children[0].IsSymbol() && declarations[n.FunctionName()]
+}
+
+// compileConstructor compiles the init code that deploys the given
+// runtime code.  Without a (defconstructor), this is the same as
+// MakeConstructor.
+func compileConstructor(progn Node, runtime string, immutables map[string][]int, options Options) string {
+	// The body goes last, so that everything declared is in scope.
+	ctor := NewNodeProgn()
+	var body *Node
+	for i, form := range progn.Children[1:] {
+		switch {
+		case !isDeclaration(form):
+			continue
+		case form.FunctionName() == "defconstructor":
+			body = &progn.Children[1+i]
+		default:
+			ctor.AddChild(form)
+		}
+	}
+	if body == nil {
+		return MakeConstructor(runtime)
+	}
+	ctor.AddChild(*body)
+
+	numImmutables := 0
+	for _, form := range ctor.Children[1:] {
+		if form.FunctionName() == "defimmutable" {
+			numImmutables++
+		}
+	}
+
+	if options.Checked {
+		checked := NewNodeApplication("checked", ctor.Origin)
+		checked.AddChild(ctor)
+		ctor = checked
+	}
+	ast := OptimizeAST(ctor, options.Offopt)
+
+	label := newEmptySegment()
+
+	v := NewBytecodeVisitor(false)
+	v.dispatch = options.Dispatch
+	v.constructor = &constructorContext{
+		runtime:       label.id,
+		runtimeLength: len(runtime) / 2,
+		immutables:    immutables,
+	}
+
+	// Reserve memory for the values of immutables, then run the
+	// constructor.
+	v.pushU64(freeMemoryInitial + 0x20*uint64(numImmutables))
+	v.pushU64(freeMemoryPointer)
+	v.addOp(vm.MSTORE)
+
+	global := NewGlobalScope()
+	ast.Accept(v, global, 0)
+
+	v.deploy(global)
+
+	// The runtime code follows the data section, if any.
+	segments := v.GetOptimizedSegments()
+	segments = append(segments, label)
+	segments = SegmentsPopulatePointers(segments)
+	return SegmentsToString(segments)
+}
+
+// immutablePositions returns the byte positions of the placeholders
+// of each immutable within the given (final) segments.  Placeholders
+// optimized away are skipped.
+func immutablePositions(segments []Segment, placeholders map[string][]int32) map[string][]int {
+	names := make(map[int32]string)
+	for name, ids := range placeholders {
+		for _, id := range ids {
+			names[id] = name
+		}
+	}
+
+	positions := make(map[string][]int)
+	pos := 0
+	for i := range segments {
+		if name, ok := names[segments[i].id]; ok {
+			positions[name] = append(positions[name], pos)
+		}
+		pos += segments[i].len()
+	}
+
+	return positions
+}
+
+// deploy copies the runtime code to memory, embeds the values of
+// immutables into it and returns it.
+func (v *BytecodeVisitor) deploy(s *Scope) {
+	ctx := v.constructor
+
+	v.pushU64(freeMemoryPointer)
+	v.addOp(vm.MLOAD) // [PTR]
+	v.pushU64(uint64(ctx.runtimeLength))
+	v.addPointer(ctx.runtime)
+	v.addOp(vm.DUP3)     // [PTR CODE LEN PTR]
+	v.addOp(vm.CODECOPY) // [PTR]
+
+	names := make([]string, 0, len(ctx.immutables))
+	for name := range ctx.immutables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		immutable, ok := s.GetImmutable(name)
+		if !ok {
+			panic("broken invariant")
+		}
+		for _, pos := range ctx.immutables[name] {
+			v.pushU64(immutableAddress(immutable))
+			v.addOp(vm.MLOAD) // [VV PTR]
+			v.addOp(vm.DUP2)
+			v.pushU64(uint64(pos))
+			v.addOp(vm.ADD)    // [PTR+POS VV PTR]
+			v.addOp(vm.MSTORE) // [PTR]
+		}
+	}
+
+	v.pushU64(uint64(ctx.runtimeLength))
+	v.addOp(vm.SWAP1)  // [PTR LEN]
+	v.addOp(vm.RETURN) // []
+}
+
+// immutableAddress returns the memory address where the constructor
+// keeps the value of an immutable.
+func immutableAddress(immutable Immutable) uint64 {
+	return freeMemoryInitial + 0x20*uint64(immutable.Index)
+}
+
+// loadImmutable pushes the value of an immutable.  In runtime code,
+// this is a PUSH32 whose data is filled in by the constructor.
+func (v *BytecodeVisitor) loadImmutable(immutable Immutable) {
+	if v.constructor != nil {
+		v.pushU64(immutableAddress(immutable))
+		v.addOp(vm.MLOAD)
+		return
+	}
+
+	placeholder := newSegmentData(strings.Repeat("00", 32))
+	v.addOp(vm.PUSH32)
+	v.addSegment(placeholder)
+	v.immutables[immutable.Identifier] = append(v.immutables[immutable.Identifier], placeholder.id)
+}
+
+// storeImmutable expects [XX] on the stack and assigns XX to an
+// immutable, keeping it on the stack.  Immutables can be assigned
+// only by the constructor.
+func (v *BytecodeVisitor) storeImmutable(symbol Node, immutable Immutable) {
+	if v.constructor == nil {
+		panic(NewCompilationError(
+			symbol.Origin,
+			fmt.Sprintf("immutable %s can be assigned only in the constructor", immutable.Identifier),
+		))
+	}
+
+	v.addOp(vm.DUP1)
+	v.pushU64(immutableAddress(immutable))
+	v.addOp(vm.MSTORE) // [XX]
+}
+
+// +----------------+
+// | defconstructor |
+// +----------------+
+
+type constructorDefinition struct {
+	Origin  Origin
+	Args    []Node // Symbols.
+	Types   []abi.Type
+	Payable bool
+	Body    Node
+}
+
+// parseConstructor parses (defconstructor (args...) [:payable] body...),
+// where each argument is either a symbol, which stands for a uint256,
+// or a list like (owner address).
+func parseConstructor(call Node) constructorDefinition {
+	args := assertNargsGte("defconstructor", call, 1)
+
+	if !args[0].IsList() && !args[0].IsNil() {
+		panic(NewCompilationError(
+			args[0].Origin,
+			fmt.Sprintf("constructor arguments are not a list: %v", &args[0]),
+		))
+	}
+
+	ctor := constructorDefinition{
+		Origin:  call.Origin,
+		Args:    make([]Node, 0, args[0].NumChildren()),
+		Types:   make([]abi.Type, 0, args[0].NumChildren()),
+		Payable: false,
+		Body:    NewNodeNil(call.Origin),
+	}
+
+	for _, arg := range args[0].Children {
+		name, typ := arg, NewNodeSymbol("uint256", arg.Origin)
+		if arg.IsList() && arg.NumChildren() == 2 {
+			name, typ = arg.Children[0], arg.Children[1]
+		}
+		if !name.IsSymbol() || !typ.IsSymbol() {
+			panic(NewCompilationError(
+				arg.Origin,
+				fmt.Sprintf("invalid constructor argument: want symbol or (name type), have %v", &arg),
+			))
+		}
+
+		t, err := ParseType(typ.ValueString)
+		if err != nil {
+			panic(NewCompilationError(typ.Origin, err.Error()))
+		}
+		if _, ok := elementarySize(t); !ok {
+			panic(NewCompilationError(
+				typ.Origin,
+				fmt.Sprintf("unsupported constructor argument type: %s", typ.ValueString),
+			))
+		}
+
+		ctor.Args = append(ctor.Args, name)
+		ctor.Types = append(ctor.Types, t)
+	}
+
+	body := args[1:]
+	if len(body) > 0 && body[0].IsThisSymbol(":payable") {
+		ctor.Payable = true
+		body = body[1:]
+	}
+	if len(body) > 0 {
+		ctor.Body = NewNodeProgn()
+		ctor.Body.AddChildren(body)
+	}
+
+	return ctor
+}
+
+func (c *constructorDefinition) abiEntry() ABIEntry {
+	inputs := make([]ABIArgument, len(c.Args))
+	for i := range c.Args {
+		inputs[i] = ABIArgument{Name: c.Args[i].ValueString, Type: c.Types[i].String(), Indexed: false}
+	}
+
+	mutability := "nonpayable"
+	if c.Payable {
+		mutability = "payable"
+	}
+
+	return ABIEntry{
+		Type:            "constructor",
+		Name:            "",
+		Inputs:          inputs,
+		Outputs:         nil,
+		StateMutability: mutability,
+		Anonymous:       false,
+	}
+}
+
+// compileBody decodes the constructor arguments, binds them to stack
+// variables and runs the body.
+func (c *constructorDefinition) compileBody(v *BytecodeVisitor, s *Scope, esp int) {
+	ebp := esp
+
+	if !c.Payable {
+		v.addOp(vm.CALLVALUE)
+		v.addOp(vm.ISZERO)
+		v.revertUnless()
+	}
+
+	if n := len(c.Args); n > 0 {
+		v.addPointer(v.constructor.runtime)
+		v.pushU64(uint64(v.constructor.runtimeLength))
+		v.addOp(vm.ADD) // [AO], arguments offset
+
+		// Revert unless all arguments are there.
+		v.pushU64(uint64(0x20 * n))
+		v.addOp(vm.DUP2)
+		v.addOp(vm.ADD)      // [AO+N AO]
+		v.addOp(vm.CODESIZE) // [CS AO+N AO]
+		v.addOp(vm.LT)
+		v.addOp(vm.ISZERO)
+		v.revertUnless() // [AO]
+
+		for i, t := range c.Types {
+			v.pushU64(0x20)
+			v.addOp(vm.DUP2)
+			if i > 0 {
+				v.pushU64(uint64(0x20 * i))
+				v.addOp(vm.ADD)
+			}
+			v.pushU64(0)
+			v.addOp(vm.CODECOPY) // [AO ...], m[00]=ARGi
+			v.pushU64(0)
+			v.addOp(vm.MLOAD) // [ARGi AO ...]
+			v.validateWord(t)
+			v.addOp(vm.SWAP1) // [AO ARGi ...]
+		}
+
+		v.addOp(vm.POP) // [ARGn-1 ... ARG0]
+		esp += n
+	}
+
+	child := s.NewChildScope()
+	for i, arg := range c.Args {
+		child.SetStackVariable(arg.ValueString, StackVariable{
+			Origin:     arg.Origin,
+			Identifier: arg.ValueString,
+			Position:   ebp + i,
+		})
+	}
+
+	c.Body.Accept(v, child, esp) // [ANS ARGS...]
+	esp += 1
+
+	if n := len(c.Args); n > 0 {
+		v.addOp(vm.OpCode(vm.SWAP1 - 1 + n))
+		for range n {
+			v.addOp(vm.POP)
+		}
+		esp -= n
+	}
+
+	if esp != ebp+1 {
+		panic("broken invariant")
+	}
+}
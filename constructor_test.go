@@ -0,0 +1,155 @@
+package mist_test
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm/runtime"
+	"github.com/ydm/mist"
+)
+
+const constructorProgram = `
+(defimmutable owner)
+(defimmutable supply)
+(defvar *total* uint256)
+
+(defun double (x) (* x 2))
+
+(defconstructor ((initialOwner address) amount)
+  (setq owner initialOwner)
+  (setq supply (double amount))
+  (setq *total* (+ supply 1)))
+
+(return-abi "(address,uint256,uint256,uint256)" owner supply *total* (+ supply supply))`
+
+func TestConstructor(t *testing.T) {
+	t.Parallel()
+
+	args := pack(t, []string{"address", "uint256"}, common.HexToAddress("0xbeef"), big.NewInt(21))
+	config, address, err := deploy(t, constructorProgram, 0, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret, _, err := runtime.Call(address, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := pack(t,
+		[]string{"address", "uint256", "uint256", "uint256"},
+		common.HexToAddress("0xbeef"), big.NewInt(42), big.NewInt(43), big.NewInt(84),
+	)
+	if !bytes.Equal(ret, want) {
+		t.Errorf("have %x, want %x", ret, want)
+	}
+}
+
+func TestConstructorRejects(t *testing.T) {
+	t.Parallel()
+
+	valid := pack(t, []string{"address", "uint256"}, common.HexToAddress("0xbeef"), big.NewInt(21))
+	dirty := append(common.FromHex("01"), valid[1:]...) // Address with high bits set.
+
+	cases := []struct {
+		name  string
+		value int64
+		args  []byte
+	}{
+		{"missing arguments", 0, nil},
+		{"short arguments", 0, valid[:63]},
+		{"invalid address", 0, dirty},
+		{"value sent", 1, valid},
+	}
+
+	for _, c := range cases {
+		if _, _, err := deploy(t, constructorProgram, c.value, c.args); err == nil {
+			t.Errorf("%s: want error, have none", c.name)
+		}
+	}
+
+	// A :payable constructor accepts value.
+	const payable = `(defconstructor () :payable (setq *x* (call-value))) (defvar *x* uint256) *x*`
+	if _, _, err := deploy(t, payable, 1, nil); err != nil {
+		t.Errorf("payable: %v", err)
+	}
+}
+
+func TestConstructorABI(t *testing.T) {
+	t.Parallel()
+
+	contract, err := mist.CompileContract(constructorProgram, t.Name(), mist.Options{Init: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := mist.ABIEntry{
+		Type: "constructor",
+		Name: "",
+		Inputs: []mist.ABIArgument{
+			{Name: "initialOwner", Type: "address", Indexed: false},
+			{Name: "amount", Type: "uint256", Indexed: false},
+		},
+		Outputs:         nil,
+		StateMutability: "nonpayable",
+		Anonymous:       false,
+	}
+	if len(contract.ABI) != 1 || contract.ABI[0].Signature() != "(address,uint256)" ||
+		contract.ABI[0].StateMutability != want.StateMutability || contract.ABI[0].Type != want.Type {
+		t.Errorf("have %+v, want %+v", contract.ABI, want)
+	}
+}
+
+func TestConstructorImmutableErrors(t *testing.T) {
+	t.Parallel()
+
+	cases := []string{
+		"(defimmutable x) (setq x 1)",
+		"(defimmutable x) (defimmutable x)",
+		"(defimmutable x) (defvar x uint256)",
+		"(defconstructor ()) (defconstructor ())",
+		"(defconstructor ((x string)))",
+	}
+
+	compile := func(program string) error {
+		_, err := mist.CompileContract(program, t.Name(), mist.Options{Init: true})
+		return err
+	}
+
+	for i, c := range cases {
+		if err := compile(c); err == nil {
+			t.Errorf("case %d: want error, have none: %s", i, c)
+		}
+	}
+}
+
+func TestConstructorLongStrings(t *testing.T) {
+	t.Parallel()
+
+	const (
+		first  = "a string that is longer than thirty-two bytes"
+		second = "another string that is longer than thirty-two bytes"
+	)
+
+	const program = `
+(defvar *length* uint256)
+(defconstructor () (setq *length* (memory-load "` + first + `")))
+(let ((s "` + second + `")) (return-abi "(uint256,string)" *length* s))`
+
+	config, address, err := deploy(t, program, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret, _, err := runtime.Call(address, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := pack(t, []string{"uint256", "string"}, big.NewInt(int64(len(first))), second)
+	if !bytes.Equal(ret, want) {
+		t.Errorf("have %x, want %x", ret, want)
+	}
+}
@@ -31,14 +31,16 @@ func EncodeRLP(x any) string {
 	return s.String()
 }
 
+// EncodeString encodes the given string as hexadecimal characters,
+// right-padded with zeros to a whole number of 32-byte words.  An
+// empty string results in an empty encoding.
 func EncodeString(s string) string {
-	if len(s) > 32 {
-		panic("TODO")
-	}
-
 	var b strings.Builder
 	for i := range len(s) {
 		fmt.Fprintf(&b, "%02x", s[i])
 	}
-	return padRight32(b.String())
+	for b.Len()%64 != 0 {
+		b.WriteRune('0')
+	}
+	return b.String()
 }
@@ -29,6 +29,26 @@ func (e LexicalError) Error() string {
 	return fmt.Sprintf("%v: lexical error: %s%s", e.Origin, e.Message, end)
 }
 
+// +--------+
+// | Syntax |
+// +--------+
+
+type SyntaxError struct {
+	Origin  Origin
+	Message string
+}
+
+func NewSyntaxError(origin Origin, message string) error {
+	return SyntaxError{
+		origin,
+		message,
+	}
+}
+
+func (e SyntaxError) Error() string {
+	return fmt.Sprintf("%v: syntax error: %s", e.Origin, e.Message)
+}
+
 // +-------------+
 // | Compilation |
 // +-------------+
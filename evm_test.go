@@ -0,0 +1,157 @@
+package mist_test
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/tracing"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm/runtime"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/holiman/uint256"
+	"github.com/ydm/mist"
+)
+
+// execute compiles the given program and runs the resulting runtime
+// bytecode in an embedded EVM (Cancun) with the given calldata.
+func execute(t *testing.T, program string, calldata []byte) ([]byte, error) {
+	t.Helper()
+
+	return run(t, program, mist.Options{Init: true}, big.NewInt(0), calldata)
+}
+
+func executeWithOptions(t *testing.T, program string, options mist.Options, calldata []byte) ([]byte, error) {
+	t.Helper()
+
+	return run(t, program, options, big.NewInt(0), calldata)
+}
+
+func executeWithValue(t *testing.T, program string, value int64, calldata []byte) ([]byte, error) {
+	t.Helper()
+
+	return run(t, program, mist.Options{Init: true}, big.NewInt(value), calldata)
+}
+
+func run(t *testing.T, program string, options mist.Options, value *big.Int, calldata []byte) ([]byte, error) {
+	t.Helper()
+
+	ret, _, err := runWithState(t, program, options, value, calldata)
+	return ret, err
+}
+
+// executeWithState is like execute, but also returns the resulting
+// state, see contractAddress.
+func executeWithState(t *testing.T, program string, calldata []byte) ([]byte, *state.StateDB, error) {
+	t.Helper()
+
+	return runWithState(t, program, mist.Options{Init: true}, big.NewInt(0), calldata)
+}
+
+// contractAddress is the address of the contract being executed.
+var contractAddress = common.BytesToAddress([]byte("contract"))
+
+func runWithState(t *testing.T, program string, options mist.Options, value *big.Int, calldata []byte) ([]byte, *state.StateDB, error) {
+	t.Helper()
+
+	contract, err := mist.CompileContract(program, t.Name(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The sender (the zero address) needs the funds it sends.
+	db, err := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.AddBalance(common.Address{}, uint256.MustFromBig(value), tracing.BalanceChangeUnspecified)
+
+	ret, _, err := runtime.Execute(common.FromHex(contract.Code), calldata, &runtime.Config{
+		ChainConfig: params.MergedTestChainConfig,
+		Random:      &common.Hash{},
+		State:       db,
+		Value:       value,
+	})
+	return ret, db, err
+}
+
+// deploy compiles the given program and runs its init code, followed
+// by the given constructor arguments, sending the given value.  The
+// returned config can be used to call the deployed contract.
+func deploy(t *testing.T, program string, value int64, args []byte) (*runtime.Config, common.Address, error) {
+	t.Helper()
+
+	contract, err := mist.CompileContract(program, t.Name(), mist.Options{Init: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.AddBalance(common.Address{}, uint256.NewInt(uint64(value)), tracing.BalanceChangeUnspecified)
+
+	config := &runtime.Config{
+		ChainConfig: params.MergedTestChainConfig,
+		Random:      &common.Hash{},
+		State:       db,
+		Value:       big.NewInt(value),
+	}
+
+	initcode := append(common.FromHex(contract.Constructor+contract.Code), args...)
+	_, address, _, err := runtime.Create(initcode, config)
+
+	config.Value = big.NewInt(0)
+	return config, address, err
+}
+
+// measure runs the given runtime bytecode with the given calldata and
+// returns the amount of gas used by the call, excluding the intrinsic
+// cost of the transaction.
+func measure(tb testing.TB, code string, calldata []byte) uint64 {
+	tb.Helper()
+
+	db, err := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	const gas = 10_000_000
+	db.SetCode(contractAddress, common.FromHex(code))
+
+	_, left, err := runtime.Call(contractAddress, calldata, &runtime.Config{
+		ChainConfig: params.MergedTestChainConfig,
+		Random:      &common.Hash{},
+		State:       db,
+		GasLimit:    gas,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return gas - left
+}
+
+// encodeCall concatenates the selector of the given signature with
+// the given words.  Words are passed as uint256 hexadecimal strings,
+// so dirty (invalid) values can be encoded too.
+func encodeCall(signature string, words ...string) []byte {
+	h := mist.Keccak256Hash([]byte(signature))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%x", h[:4])
+	for _, word := range words {
+		b.WriteString(fmt.Sprintf("%064s", strings.TrimPrefix(word, "0x")))
+	}
+
+	return common.FromHex(b.String())
+}
+
+func word(ret []byte) *uint256.Int {
+	return new(uint256.Int).SetBytes(ret)
+}
@@ -0,0 +1,426 @@
+package mist
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// +----------------------+
+// | Concrete syntax tree |
+// +----------------------+
+
+const (
+	cstAtom = iota
+	cstList
+	cstComment
+)
+
+// cstNode is an element of the concrete syntax tree, which, unlike
+// Node, keeps comments and the source text of atoms.
+type cstNode struct {
+	kind     int
+	prefix   string     // Quotes and datum comments, e.g. ' or #;
+	text     string     // Source text of atoms and comments.
+	children []*cstNode // Elements of lists, comments included.
+
+	newline bool // Starts on a new line.
+	blank   bool // Preceded by a blank line.
+	spaces  int  // Spaces before, if not on a new line.
+}
+
+func (n *cstNode) isLineComment() bool {
+	return n.kind == cstComment && strings.HasPrefix(n.text, ";")
+}
+
+// cstReader builds the concrete syntax tree out of tokens.  Comments
+// are found in the source text between the tokens.
+type cstReader struct {
+	code   string
+	tokens []Token
+	index  int
+	lines  []int // Offsets of the beginnings of lines.
+	offset int   // Right after the last token read.
+}
+
+func newCSTReader(code string, tokens []Token) *cstReader {
+	lines := []int{0}
+	for i, c := range code {
+		if c == '\n' {
+			lines = append(lines, i+1)
+		}
+	}
+	return &cstReader{code: code, tokens: tokens, lines: lines}
+}
+
+// next returns the offset of the next token, or the end of the code.
+func (r *cstReader) next() int {
+	if r.index >= len(r.tokens) {
+		return len(r.code)
+	}
+	origin := r.tokens[r.index].Origin
+	return r.lines[origin.Line-1] + origin.Column
+}
+
+func (r *cstReader) consume() Token {
+	token := r.tokens[r.index]
+	r.offset = r.next() + len(token.Raw)
+	r.index++
+	return token
+}
+
+// gap reads the comments up to the next token.  The returned node
+// holds the whitespace that precedes the token.
+func (r *cstReader) gap() ([]*cstNode, *cstNode) {
+	var (
+		comments []*cstNode
+		space    = &cstNode{}
+		text     = r.code[r.offset:r.next()]
+	)
+
+	for len(text) > 0 {
+		switch {
+		case text[0] == '\n':
+			space.blank = space.newline
+			space.newline = true
+			space.spaces = 0
+			text = text[1:]
+		case strings.HasPrefix(text, ";"):
+			end := strings.IndexByte(text, '\n')
+			if end < 0 {
+				end = len(text)
+			}
+			space.kind, space.text = cstComment, strings.TrimRight(text[:end], " \t\r")
+			comments = append(comments, space)
+			space, text = &cstNode{}, text[end:]
+		case strings.HasPrefix(text, "#|"):
+			end := blockCommentEnd(text)
+			space.kind, space.text = cstComment, text[:end]
+			comments = append(comments, space)
+			space, text = &cstNode{}, text[end:]
+		default:
+			if text[0] != '\r' {
+				space.spaces++
+			}
+			text = text[1:]
+		}
+	}
+
+	return comments, space
+}
+
+// blockCommentEnd returns the length of the nested block comment at
+// the beginning of text.
+func blockCommentEnd(text string) int {
+	depth := 0
+	for i := 0; i+1 < len(text); i++ {
+		switch text[i : i+2] {
+		case "#|":
+			depth++
+			i++
+		case "|#":
+			depth--
+			i++
+			if depth <= 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(text)
+}
+
+// readSequence reads elements up to the end of the enclosing list or
+// the end of the code.
+func (r *cstReader) readSequence() []*cstNode {
+	var items []*cstNode
+	for {
+		comments, space := r.gap()
+		items = append(items, comments...)
+		if r.index >= len(r.tokens) || r.tokens[r.index].Type == TokenRightParen {
+			return items
+		}
+
+		lead, node := r.readExpr()
+		items = append(items, lead...)
+		node.newline, node.blank, node.spaces = space.newline, space.blank, space.spaces
+		items = append(items, node)
+	}
+}
+
+// readExpr reads the next expression.  Comments between a prefix and
+// the expression it applies to are moved before the expression.
+func (r *cstReader) readExpr() ([]*cstNode, *cstNode) {
+	token := r.consume()
+	switch token.Type {
+	case TokenQuote, TokenDatumComment:
+		lead, _ := r.gap()
+		more, node := r.readExpr()
+		node.prefix = token.Raw + node.prefix
+		return append(lead, more...), node
+	case TokenLeftParen:
+		node := &cstNode{kind: cstList, children: r.readSequence()}
+		r.consume() // Closing paren.
+		return nil, node
+	default:
+		return nil, &cstNode{kind: cstAtom, text: token.Raw}
+	}
+}
+
+// +---------+
+// | Printer |
+// +---------+
+
+// Number of distinguished arguments of forms that have a body.  As
+// in Emacs, distinguished arguments on a new line are indented by 4,
+// the body by 2.
+var formatBodies = map[string]int{
+	"asm":            1,
+	"case":           1,
+	"checked":        0,
+	"defconstructor": 1,
+	"definterface":   1,
+	"defstruct":      1,
+	"defun":          2,
+	"if":             2,
+	"let":            1,
+	"progn":          0,
+	"unchecked":      0,
+	"unless":         1,
+	"when":           1,
+}
+
+type cstPrinter struct {
+	out    strings.Builder
+	column int
+
+	// Dispatch clauses are printed with their columns aligned.
+	aligned map[*cstNode]string
+}
+
+func (p *cstPrinter) write(s string) {
+	p.out.WriteString(s)
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		p.column = utf8.RuneCountInString(s[i+1:])
+	} else {
+		p.column += utf8.RuneCountInString(s)
+	}
+}
+
+func (p *cstPrinter) newline(indent int, blank bool) {
+	if blank {
+		p.out.WriteString("\n")
+	}
+	p.out.WriteString("\n")
+	p.column = 0
+	p.write(strings.Repeat(" ", indent))
+}
+
+func (p *cstPrinter) printNode(n *cstNode) {
+	p.write(n.prefix)
+	switch n.kind {
+	case cstList:
+		if text, ok := p.aligned[n]; ok {
+			p.write(text)
+		} else {
+			p.printList(n)
+		}
+	default:
+		p.write(n.text)
+	}
+}
+
+func (p *cstPrinter) printList(n *cstNode) {
+	open := p.column
+	p.write("(")
+
+	// The head of the list decides how the rest is indented.
+	var head *cstNode
+	for _, child := range n.children {
+		if child.kind != cstComment {
+			head = child
+			break
+		}
+	}
+	body, special := -1, false
+	if head != nil && head.kind == cstAtom && head.prefix == "" {
+		body, special = formatBodies[head.text]
+		if head.text == "dispatch" {
+			p.alignDispatch(n)
+		}
+	}
+	call := head != nil && head.kind == cstAtom && head.prefix == "" && isFormatSymbol(head.text)
+
+	indent := func(arg, firstArg int) int {
+		switch {
+		case arg == 0 || !call:
+			return open + 1
+		case special && arg <= body:
+			return open + 4
+		case special:
+			return open + 2
+		case firstArg >= 0:
+			return firstArg
+		default:
+			return open + 1
+		}
+	}
+
+	arg, firstArg := 0, -1
+	for i, child := range n.children {
+		if child.kind == cstComment && child.newline {
+			p.newline(indent(arg, firstArg), child.blank)
+		} else if child.newline && i > 0 {
+			p.newline(indent(arg, firstArg), child.blank)
+		} else if i > 0 || child.kind == cstComment {
+			p.write(strings.Repeat(" ", max(child.spaces, 1)))
+		}
+
+		if child.kind != cstComment {
+			if arg == 1 && !child.newline {
+				firstArg = p.column
+			}
+			arg++
+		}
+		p.printNode(child)
+	}
+
+	if last := len(n.children) - 1; last >= 0 && n.children[last].isLineComment() {
+		p.newline(indent(arg, firstArg), false)
+	}
+	p.write(")")
+}
+
+// alignDispatch aligns the columns of consecutive (dispatch) clauses
+// like ("transfer(address,uint256)" transfer): signatures are aligned
+// to the left, handlers to the right and options to the left again.
+// Comments and blank lines start a new group of clauses.
+func (p *cstPrinter) alignDispatch(n *cstNode) {
+	var group [][]string
+	flush := func(clauses []*cstNode) {
+		width, options := 0, []int{}
+		for _, columns := range group {
+			width = max(width, len(columns[0])+1+len(columns[1]))
+			for j, option := range columns[2:] {
+				if j >= len(options) {
+					options = append(options, 0)
+				}
+				options[j] = max(options[j], len(option))
+			}
+		}
+		for i, columns := range group {
+			var b strings.Builder
+			b.WriteString("(" + columns[0])
+			b.WriteString(strings.Repeat(" ", width-len(columns[0])-len(columns[1])))
+			b.WriteString(columns[1])
+			for j, w := range options {
+				option := ""
+				if j+2 < len(columns) {
+					option = columns[j+2]
+				}
+				b.WriteString(" " + option + strings.Repeat(" ", w-len(option)))
+			}
+			b.WriteString(")")
+			p.aligned[clauses[i]] = b.String()
+		}
+		group = group[:0]
+	}
+
+	var clauses []*cstNode
+	for _, child := range n.children {
+		if child.kind == cstComment && !child.newline {
+			// Trailing comments don't interrupt the group.
+			continue
+		}
+		columns, ok := dispatchColumns(child)
+		if !ok || child.blank {
+			flush(clauses)
+			clauses = clauses[:0]
+		}
+		if ok {
+			group = append(group, columns)
+			clauses = append(clauses, child)
+		}
+	}
+	flush(clauses)
+}
+
+// dispatchColumns returns the elements of a (dispatch) clause that
+// fits on a single line of its own.
+func dispatchColumns(n *cstNode) ([]string, bool) {
+	if n.kind != cstList || n.prefix != "" || !n.newline || len(n.children) < 2 {
+		return nil, false
+	}
+	columns := make([]string, len(n.children))
+	for i, child := range n.children {
+		if child.kind != cstAtom || child.prefix != "" || (i > 0 && child.newline) || strings.Contains(child.text, "\n") {
+			return nil, false
+		}
+		columns[i] = child.text
+	}
+	if !strings.HasPrefix(columns[0], `"`) {
+		return nil, false
+	}
+	return columns, true
+}
+
+// isFormatSymbol tells whether an atom is a symbol that can name a
+// function, as opposed to numbers, strings and keywords.
+func isFormatSymbol(text string) bool {
+	if text == "" || strings.HasPrefix(text, `"`) || strings.HasPrefix(text, ":") || strings.HasPrefix(text, "#") {
+		return false
+	}
+	digits := strings.TrimPrefix(text, "-")
+	return digits == "" || digits[0] < '0' || digits[0] > '9'
+}
+
+// Format pretty-prints a Mist program.  Line breaks are kept as they
+// are, except that closing parentheses never start a line of their
+// own, while lines are indented the way Emacs does it.  Comments are
+// kept, top-level ones right below a form in their original column,
+// and the columns of (dispatch) clauses are aligned.
+func Format(code, filename string) (string, error) {
+	tokens, err := Scan(code, filename)
+	if err != nil {
+		return "", err
+	}
+	all := tokens.tokens
+	if _, err := Parse(&tokens); err != nil {
+		return "", err
+	}
+
+	reader := newCSTReader(code, all)
+	items := reader.readSequence()
+
+	p := &cstPrinter{aligned: make(map[*cstNode]string)}
+	// Tells whether the item before items[i], ignoring trailing
+	// comments, is a form.
+	belowForm := func(i int) bool {
+		for j := i - 1; j >= 0; j-- {
+			if items[j].kind != cstComment {
+				return true
+			}
+			if items[j].newline {
+				return false
+			}
+		}
+		return false
+	}
+
+	for i, item := range items {
+		if i > 0 && item.isLineComment() && item.newline && !item.blank && belowForm(i) {
+			// Comments right below a form may belong to it, so they
+			// stay where they are.
+			p.newline(item.spaces, false)
+		} else if i > 0 && (item.newline || item.kind != cstComment) {
+			// Top-level forms start on a new line.
+			p.newline(0, item.blank)
+		} else if i > 0 {
+			p.write(strings.Repeat(" ", max(item.spaces, 1)))
+		}
+		p.printNode(item)
+	}
+	if len(items) > 0 {
+		p.write("\n")
+	}
+
+	return p.out.String(), nil
+}
@@ -0,0 +1,129 @@
+package mist_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/ydm/mist"
+)
+
+// parseString parses a program and prints it back without comments
+// and formatting.
+func parseString(t *testing.T, program string) string {
+	t.Helper()
+
+	tokens, err := mist.Scan(program, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	progn, err := mist.Parse(&tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return progn.String()
+}
+
+func TestFormat(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		program string
+		want    string
+	}{
+		{
+			"",
+			"",
+		},
+		{
+			"\n\n  (f   1 2)  \n\n\n\n(g)\n\n",
+			"(f   1 2)\n\n(g)\n",
+		},
+		{
+			"(defun f (x)\n(if x\n(let ((a 1)\n(b 2))\n(+ a b))\n(g 1\n2)))",
+			"(defun f (x)\n  (if x\n      (let ((a 1)\n            (b 2))\n        (+ a b))\n    (g 1\n       2)))\n",
+		},
+		{
+			"(defun f\n(x)\n1\n)",
+			"(defun f\n    (x)\n  1)\n",
+		},
+		{
+			"(f\n1\n2)",
+			"(f\n 1\n 2)\n",
+		},
+		{
+			"(when x ; why\n  )",
+			"(when x ; why\n  )\n",
+		},
+		{
+			";; a\n(progn\n;; b\n1 #| c\n |# 2)  ; d\n;; e",
+			";; a\n(progn\n  ;; b\n  1 #| c\n |# 2)  ; d\n;; e\n",
+		},
+		{
+			"(f\n 1) ;\n  ;; g\n ;; h\n\n  ;; i\n(g)",
+			"(f\n 1) ;\n  ;; g\n;; h\n\n;; i\n(g)\n",
+		},
+		{
+			"'(a\nb) #;(c\nd) \"x\ny\"",
+			"'(a\n  b)\n#;(c\n   d)\n\"x\ny\"\n",
+		},
+		{
+			"(dispatch\n(\"f(uint256)\" f :view) ; one\n(\"transferFrom(address,address,uint256)\" transferFrom)\n\n(\"g()\" g) (\"h()\"\nh))",
+			"(dispatch\n" +
+				" (\"f(uint256)\"                                       f :view) ; one\n" +
+				" (\"transferFrom(address,address,uint256)\" transferFrom      )\n" +
+				"\n" +
+				" (\"g()\" g) (\"h()\"\n" +
+				"            h))\n",
+		},
+	}
+
+	for i, c := range cases {
+		have, err := mist.Format(c.program, "test")
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if diff := cmp.Diff(c.want, have); diff != "" {
+			t.Errorf("case %d: %s", i, diff)
+		}
+
+		// Formatting doesn't change the meaning of the program and
+		// formatted programs stay the same.
+		if parseString(t, have) != parseString(t, c.program) {
+			t.Errorf("case %d: have %s, want %s", i, parseString(t, have), parseString(t, c.program))
+		}
+		if again, _ := mist.Format(have, "test"); again != have {
+			t.Errorf("case %d: not idempotent:\n%s", i, again)
+		}
+	}
+
+	for _, invalid := range []string{"(f", "(f))", `"f`} {
+		if _, err := mist.Format(invalid, "test"); err == nil {
+			t.Errorf("%s: want error, have none", invalid)
+		}
+	}
+}
+
+func TestFormatExamples(t *testing.T) {
+	t.Parallel()
+
+	paths, err := filepath.Glob(filepath.Join("examples", "*.mist"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range paths {
+		program, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		have, err := mist.Format(string(program), path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(string(program), have); diff != "" {
+			t.Errorf("%s is not formatted: %s", path, diff)
+		}
+	}
+}
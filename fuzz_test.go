@@ -0,0 +1,147 @@
+package mist_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/core/vm/runtime"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ydm/mist"
+)
+
+// addExamples seeds the corpus with the example programs.
+func addExamples(f *testing.F) {
+	f.Helper()
+
+	paths, err := filepath.Glob(filepath.Join("examples", "*.mist"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, path := range paths {
+		program, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(program))
+	}
+}
+
+// invalidPrograms used to crash the compiler instead of failing with
+// a compilation error.
+var invalidPrograms = []string{
+	"(ether 1)",
+	"(setq 1 2)",
+	"(let (1) 1)",
+	"(let ((1 2)) 1)",
+	"(selector 5)",
+	"(hash 5)",
+	"(case 1 2)",
+	"(if)",
+	"(let)",
+	"(apply 'f)",
+	"(case 1 (otherwise 2) (3 4))",
+	`(emit "Foo" 1)`,
+	`(emit "Foo(uint256" 1)`,
+	`(emit "")`,
+}
+
+func TestCompileInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, program := range invalidPrograms {
+		_, err := mist.CompileContract(program, t.Name(), mist.Options{Init: true})
+		var want mist.CompilationError
+		if !errors.As(err, &want) {
+			t.Errorf("%s: want compilation error, have %v", program, err)
+		}
+	}
+}
+
+func FuzzScan(f *testing.F) {
+	addExamples(f)
+
+	f.Fuzz(func(t *testing.T, program string) {
+		tokens, err := mist.Scan(program, "fuzz")
+		if err != nil {
+			return
+		}
+		for tokens.HasNext() {
+			_ = tokens.Next().String()
+		}
+	})
+}
+
+func FuzzParse(f *testing.F) {
+	addExamples(f)
+
+	f.Fuzz(func(t *testing.T, program string) {
+		tokens, err := mist.Scan(program, "fuzz")
+		if err != nil {
+			return
+		}
+		progn, err := mist.Parse(&tokens)
+		if err != nil {
+			return
+		}
+		_ = progn.String()
+	})
+}
+
+func FuzzCompile(f *testing.F) {
+	addExamples(f)
+	for _, program := range invalidPrograms {
+		f.Add(program)
+	}
+
+	f.Fuzz(func(t *testing.T, program string) {
+		contract, err := mist.CompileContract(program, "fuzz", mist.Options{Init: true})
+		if err != nil {
+			return
+		}
+
+		_ = mist.Decompile(contract.Constructor)
+		_ = mist.Decompile(contract.Code)
+
+		// Call every function with zeroed arguments, as well as the
+		// fallback.
+		calls := [][]byte{{}}
+		for _, entry := range contract.ABI {
+			if entry.Type != "function" {
+				continue
+			}
+			inputs := make([]string, len(entry.Inputs))
+			for i, input := range entry.Inputs {
+				inputs[i] = input.Type
+			}
+			signature := entry.Name + "(" + strings.Join(inputs, ",") + ")"
+			calldata := append(crypto.Keccak256([]byte(signature))[:4], make([]byte, 32*len(inputs))...)
+			calls = append(calls, calldata)
+		}
+
+		for _, calldata := range calls {
+			db, err := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, err = runtime.Execute(common.FromHex(contract.Code), calldata, &runtime.Config{
+				ChainConfig: params.MergedTestChainConfig,
+				Random:      &common.Hash{},
+				State:       db,
+				GasLimit:    10_000_000,
+			})
+			if errors.Is(err, vm.ErrInvalidJump) {
+				t.Fatalf("calldata %x: %v\n%s", calldata, err, program)
+			}
+		}
+	})
+}
@@ -0,0 +1,349 @@
+package mist
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/holiman/uint256"
+)
+
+// +------------+
+// | Interfaces |
+// +------------+
+
+// Interface is a set of external functions declared with
+// (definterface) and called like (IERC20.transfer token to amount).
+type Interface struct {
+	Origin  Origin
+	Name    string
+	Methods map[string]InterfaceMethod
+}
+
+// InterfaceMethod is an external function of an Interface.
+type InterfaceMethod struct {
+	Origin    Origin
+	Name      string
+	Signature string // Canonical, e.g. "transfer(address,uint256)".
+	Inputs    []abi.Type
+	Output    *abi.Type // Nil if the function returns nothing.
+	View      bool
+	Payable   bool
+}
+
+// NewInterface parses the methods of (definterface name methods...),
+// where each method looks like ("balanceOf(address)" -> uint256 :view).
+// Both the return type and the flags are optional.
+func NewInterface(origin Origin, name string, methods []Node) Interface {
+	iface := Interface{
+		Origin:  origin,
+		Name:    name,
+		Methods: make(map[string]InterfaceMethod, len(methods)),
+	}
+
+	for _, method := range methods {
+		m := parseInterfaceMethod(method)
+		if _, ok := iface.Methods[m.Name]; ok {
+			panic(NewCompilationError(
+				method.Origin,
+				fmt.Sprintf("method %s.%s is already defined", name, m.Name),
+			))
+		}
+		iface.Methods[m.Name] = m
+	}
+
+	return iface
+}
+
+func parseInterfaceMethod(method Node) InterfaceMethod {
+	if !method.IsList() || method.NumChildren() < 1 || !method.Children[0].IsString() {
+		panic(NewCompilationError(
+			method.Origin,
+			fmt.Sprintf("invalid method: want (signature [-> type] [:view] [:payable]), have %v", &method),
+		))
+	}
+
+	signature := method.Children[0]
+	name, names, err := SplitSignature(signature.ValueString)
+	if err != nil {
+		panic(NewCompilationError(signature.Origin, err.Error()))
+	}
+	if name == "" {
+		panic(NewCompilationError(signature.Origin, "invalid signature: missing name: "+signature.ValueString))
+	}
+
+	m := InterfaceMethod{
+		Origin:    method.Origin,
+		Name:      name,
+		Signature: "",
+		Inputs:    make([]abi.Type, len(names)),
+		Output:    nil,
+		View:      false,
+		Payable:   false,
+	}
+
+	canonical := make([]string, len(names))
+	for i := range names {
+		t, err := ParseType(names[i])
+		if err != nil {
+			panic(NewCompilationError(signature.Origin, err.Error()))
+		}
+		if !IsSupportedType(t) {
+			panic(NewCompilationError(signature.Origin, "unsupported type: "+t.String()))
+		}
+		m.Inputs[i] = t
+		canonical[i] = t.String()
+	}
+	m.Signature = fmt.Sprintf("%s(%s)", name, strings.Join(canonical, ","))
+
+	rest := method.Children[1:]
+	if len(rest) > 0 && rest[0].IsThisSymbol("->") {
+		if len(rest) < 2 || !rest[1].IsSymbol() {
+			panic(NewCompilationError(rest[0].Origin, "missing return type after ->"))
+		}
+		t, err := ParseType(rest[1].ValueString)
+		if err != nil {
+			panic(NewCompilationError(rest[1].Origin, err.Error()))
+		}
+		if _, ok := elementarySize(t); !ok {
+			panic(NewCompilationError(
+				rest[1].Origin,
+				fmt.Sprintf("unsupported return type: %s", rest[1].ValueString),
+			))
+		}
+		m.Output = &t
+		rest = rest[2:]
+	}
+
+	for _, flag := range rest {
+		switch {
+		case flag.IsThisSymbol(":view"):
+			m.View = true
+		case flag.IsThisSymbol(":payable"):
+			m.Payable = true
+		default:
+			panic(NewCompilationError(flag.Origin, fmt.Sprintf("invalid method flag: %v", &flag)))
+		}
+	}
+	if m.View && m.Payable {
+		panic(NewCompilationError(method.Origin, "method can't be both :view and :payable"))
+	}
+
+	return m
+}
+
+// splitMethodName splits a name like "IERC20.transfer" into the name
+// of the interface and the name of the method.
+func splitMethodName(fn string) (string, string, bool) {
+	i := strings.IndexByte(fn, '.')
+	if i <= 0 || i == len(fn)-1 {
+		return "", "", false
+	}
+	return fn[:i], fn[i+1:], true
+}
+
+// handleInterfaceFunc compiles (IFACE.method address [:value value]
+// args...) into an external call.
+func handleInterfaceFunc(v *BytecodeVisitor, s *Scope, esp int, call Node) bool {
+	ifaceName, methodName, ok := splitMethodName(call.FunctionName())
+	if !ok {
+		return false
+	}
+
+	iface, ok := s.GetInterface(ifaceName)
+	if !ok {
+		return false
+	}
+
+	method, ok := iface.Methods[methodName]
+	if !ok {
+		panic(NewCompilationError(call.Origin, fmt.Sprintf("void method: %s.%s", ifaceName, methodName)))
+	}
+
+	v.callMethod(s, esp, call, method)
+	return true
+}
+
+// callMethod calls an external function and leaves its decoded result
+// on the stack.  Functions that return nothing result in t.  If the
+// call fails, its revert data is bubbled up.
+func (v *BytecodeVisitor) callMethod(s *Scope, esp int, call Node, m InterfaceMethod) {
+	ebp := esp
+
+	args := assertNargsGte(call.FunctionName(), call, 1)
+	address, args := args[0], args[1:]
+
+	var value *Node
+	if len(args) > 0 && args[0].IsThisSymbol(":value") {
+		if !m.Payable {
+			panic(NewCompilationError(args[0].Origin, fmt.Sprintf("method %s is not payable", m.Signature)))
+		}
+		if len(args) < 2 {
+			panic(NewCompilationError(args[0].Origin, "missing value after :value"))
+		}
+		value, args = &args[1], args[2:]
+	}
+
+	if want, have := len(m.Inputs), len(args); want != have {
+		panic(NewCompilationError(
+			call.Origin,
+			fmt.Sprintf("%s: have %d arguments, want %d", m.Signature, have, want),
+		))
+	}
+	for i := range args {
+		checkLiteral(args[i], m.Inputs[i])
+	}
+
+	address.Accept(v, s, esp) // [AA]
+	esp += 1                  //
+	v.validateWord(abi.Type{T: abi.AddressTy, Size: 20})
+
+	if value != nil {
+		value.Accept(v, s, esp) // [VV AA]
+		esp += 1
+	}
+
+	// Calls that return nothing can't tell an account without code
+	// from a successful call, so check for code first.
+	if m.Output == nil {
+		v.addOp(vm.OpCode(vm.DUP1 - 1 + esp - ebp)) // [AA ...]
+		v.addOp(vm.EXTCODESIZE)                     // [CS ...]
+		v.revertUnless()
+	}
+
+	selector := keccak256Hex(m.Signature)[:8]
+	v.encodeABI(s, esp, m.Inputs, args, selector, call.Origin) // [PP SZ ...]
+	esp += 2
+
+	// The return value is written over the call data.
+	outSize := uint64(0)
+	if m.Output != nil {
+		outSize = 0x20
+	}
+	v.pushU64(outSize) // [OS PP SZ ...]
+	v.addOp(vm.DUP2)   // [PP OS PP SZ ...]
+	v.addOp(vm.DUP4)   // [SZ PP OS PP SZ ...]
+	v.addOp(vm.DUP4)   // [PP SZ PP OS PP SZ ...]
+	esp += 4
+
+	switch {
+	case m.View:
+		// No value.
+	case value != nil:
+		v.addOp(vm.OpCode(vm.DUP1 - 1 + esp - ebp - 1)) // [VV PP SZ PP OS PP SZ VV AA]
+		esp += 1
+	default:
+		v.pushU64(0) // [00 PP SZ PP OS PP SZ AA]
+		esp += 1
+	}
+
+	v.addOp(vm.OpCode(vm.DUP1 - 1 + esp - ebp)) // [AA ...]
+	v.addOp(vm.GAS)                             // [GG AA ...]
+	esp += 2
+	if m.View {
+		v.addOp(vm.STATICCALL)
+		esp -= 5
+	} else {
+		v.addOp(vm.CALL)
+		esp -= 6
+	} // [OK PP SZ VV? AA]
+
+	// Bubble up the revert data on failure.
+	ok := newSegmentJumpdest()
+	v.addPointer(ok.id)
+	v.addOp(vm.JUMPI) // [PP SZ VV? AA]
+	esp -= 1
+	v.addOp(vm.RETURNDATASIZE)
+	v.pushU64(0)
+	v.addOp(vm.DUP1)
+	v.addOp(vm.RETURNDATACOPY)
+	v.addOp(vm.RETURNDATASIZE)
+	v.pushU64(0)
+	v.addOp(vm.REVERT)
+	v.addSegment(ok)
+
+	if m.Output != nil {
+		v.pushU64(0x20)
+		v.addOp(vm.RETURNDATASIZE)
+		v.addOp(vm.LT)
+		v.addOp(vm.ISZERO)
+		v.revertUnless()  // [PP SZ VV? AA]
+		v.addOp(vm.DUP1)  // [PP PP SZ VV? AA]
+		v.addOp(vm.MLOAD) // [RR PP SZ VV? AA]
+		v.validateWord(*m.Output)
+	} else {
+		v.pushU64(1) // [01 PP SZ VV? AA]
+	}
+	esp += 1
+
+	// Drop everything below the result.
+	n := esp - ebp - 1
+	v.addOp(vm.OpCode(vm.SWAP1 - 1 + n))
+	for range n {
+		v.addOp(vm.POP)
+	}
+	esp -= n
+
+	if esp != ebp+1 {
+		panic("broken invariant")
+	}
+}
+
+// checkLiteral makes sure a literal argument fits the type of the
+// corresponding input.  Values known only at run time are not
+// checked.
+func checkLiteral(arg Node, t abi.Type) {
+	mismatch := func() {
+		panic(NewCompilationError(arg.Origin, fmt.Sprintf("invalid argument: %v is not a valid %s", &arg, t.String())))
+	}
+
+	switch {
+	case arg.IsString():
+		switch t.T {
+		case abi.StringTy, abi.BytesTy:
+		case abi.FixedBytesTy:
+			if len(arg.ValueString) > t.Size {
+				mismatch()
+			}
+		default:
+			mismatch()
+		}
+	case arg.Type == NodeNumber:
+		x := arg.ValueNumber
+		switch t.T {
+		case abi.UintTy, abi.AddressTy:
+			bits := t.Size
+			if t.T == abi.AddressTy {
+				bits = 160
+			}
+			if x.BitLen() > bits {
+				mismatch()
+			}
+		case abi.IntTy:
+			extended := new(uint256.Int).ExtendSign(x, uint256.NewInt(uint64(t.Size/8-1)))
+			if !extended.Eq(x) {
+				mismatch()
+			}
+		case abi.BoolTy:
+			if !x.LtUint64(2) {
+				mismatch()
+			}
+		case abi.FixedBytesTy:
+			// Numbers are right-aligned, unlike bytesN values.
+			if t.Size < 32 {
+				mismatch()
+			}
+		default:
+			mismatch()
+		}
+	case arg.IsT():
+		if t.T != abi.BoolTy {
+			mismatch()
+		}
+	case arg.IsNil():
+		if IsDynamicType(t) {
+			mismatch()
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package mist_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/tracing"
+	"github.com/ethereum/go-ethereum/core/vm/runtime"
+	"github.com/holiman/uint256"
+	"github.com/ydm/mist"
+)
+
+const interfaceToken = `
+(defvar *balances* (mapping address uint256))
+
+(defun balanceOf (who) (gethash *balances* who))
+(defun transfer (to amount)
+  (puthash *balances* (+ (gethash *balances* to) amount) to)
+  t)
+(defun deposit () (self-balance))
+(defun fail () (revert "nope"))
+
+(dispatch
+ ("balanceOf(address)"        balanceOf :view)
+ ("transfer(address,uint256)" transfer)
+ ("deposit()"                 deposit :payable)
+ ("fail()"                    fail))`
+
+const interfaceCaller = `
+(definterface IToken
+  ("balanceOf(address)" -> uint256 :view)
+  ("transfer(address,uint256)" -> bool)
+  ("deposit()" :payable)
+  ("fail()"))
+
+(defconst token 0x70c3e7)
+
+(defun send (to amount) (IToken.transfer token to amount))
+(defun balance (who) (IToken.balanceOf token who))
+(defun deposit (amount) (IToken.deposit token :value amount))
+(defun fail () (IToken.fail token))
+(defun missing () (IToken.fail 0xdead))
+
+(dispatch
+ ("send(address,uint256)" send)
+ ("balance(address)"      balance)
+ ("deposit(uint256)"      deposit)
+ ("fail()"                fail)
+ ("missing()"             missing))`
+
+func TestInterface(t *testing.T) {
+	t.Parallel()
+
+	config, caller, err := deploy(t, interfaceCaller, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := mist.CompileContract(interfaceToken, t.Name(), mist.Options{Init: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.State.SetCode(common.HexToAddress("0x70c3e7"), common.FromHex(token.Code))
+	config.State.AddBalance(caller, uint256.NewInt(100), tracing.BalanceChangeUnspecified)
+
+	calls := []struct {
+		calldata []byte
+		want     uint64
+	}{
+		{encodeCall("send(address,uint256)", "beef", "2a"), 1},
+		{encodeCall("send(address,uint256)", "beef", "01"), 1},
+		{encodeCall("balance(address)", "beef"), 43},
+		{encodeCall("balance(address)", "dead"), 0},
+		{encodeCall("deposit(uint256)", "07"), 1},
+	}
+
+	for i, c := range calls {
+		ret, _, err := runtime.Call(caller, c.calldata, config)
+		if err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+		if have := word(ret); !have.Eq(uint256.NewInt(c.want)) {
+			t.Errorf("call %d: have %v, want %d", i, have, c.want)
+		}
+	}
+
+	if have := config.State.GetBalance(common.HexToAddress("0x70c3e7")); !have.Eq(uint256.NewInt(7)) {
+		t.Errorf("token balance: have %v, want 7", have)
+	}
+
+	// Reverts are bubbled up.
+	ret, _, err := runtime.Call(caller, encodeCall("fail()"), config)
+	if err == nil {
+		t.Fatal("fail: want error, have none")
+	}
+	if want := common.FromHex(mist.EncodeWithSignature("Error(string)", "nope")); !bytes.Equal(ret, want) {
+		t.Errorf("fail: have %x, want %x", ret, want)
+	}
+
+	// Calls to accounts without code revert.
+	if _, _, err := runtime.Call(caller, encodeCall("missing()"), config); err == nil {
+		t.Error("missing: want error, have none")
+	}
+}
+
+func TestInterfaceErrors(t *testing.T) {
+	t.Parallel()
+
+	const iface = `(definterface I ("f(uint8,address)" -> bool) ("g()" :payable) ("h(string)" :view)) `
+
+	cases := []string{
+		iface + "(I.f 0xdead 1)",
+		iface + "(I.f 0xdead 1 2 3)",
+		iface + "(I.f 0xdead 256 2)",
+		iface + `(I.f 0xdead 1 "address")`,
+		iface + "(I.f 0xdead :value 1 1 2)",
+		iface + "(I.h 0xdead 1)",
+		iface + "(I.g 0xdead :value)",
+		iface + "(I.x 0xdead)",
+		iface + "(definterface I)",
+		`(definterface I ("f()") ("f(uint256)"))`,
+		`(definterface I ("f()" -> string))`,
+		`(definterface I ("f()" :view :payable))`,
+		`(definterface I ("f(uint256"))`,
+		`(defun f () (definterface I)) (f)`,
+	}
+
+	compile := func(program string) error {
+		_, err := mist.CompileContract(program, t.Name(), mist.Options{Init: true})
+		return err
+	}
+
+	for i, c := range cases {
+		if err := compile(c); err == nil {
+			t.Errorf("case %d: want error, have none: %s", i, c)
+		}
+	}
+}
@@ -3,7 +3,9 @@
 package mist
 
 import (
+	"fmt"
 	"hash"
+	"strings"
 
 	"golang.org/x/crypto/sha3"
 )
@@ -34,3 +36,16 @@ func Keccak256Hash(data ...[]byte) Hash {
 	d.Read(h[:])
 	return h
 }
+
+// keccak256Hex returns the hash of the given string as 64 hexadecimal
+// characters, without the 0x prefix.
+func keccak256Hex(s string) string {
+	var (
+		h Hash = Keccak256Hash([]byte(s))
+		b strings.Builder
+	)
+	for i := range len(h) {
+		fmt.Fprintf(&b, "%02x", h[i])
+	}
+	return b.String()
+}
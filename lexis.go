@@ -1,9 +1,15 @@
 package mist
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/holiman/uint256"
 )
@@ -14,31 +20,31 @@ const (
 	lexerStateCode = iota
 	lexerStateComment
 	lexerStateString
+	lexerStateBlockComment
 )
 
 type lexerState struct {
 	state  int
 	lines  int
 	offset int
+	depth  int // Nesting of block comments.
 }
 
 func newLexerState() lexerState {
-	return lexerState{lexerStateCode, 1, 0}
+	return lexerState{lexerStateCode, 1, 0, 0}
 }
 
 func (s *lexerState) transitionTo(state int) bool {
 	// Allowed transitions:
 	//
-	// code           -> comment|string
-	// comment|string -> code
+	// code                         -> comment|string|block comment
+	// comment|string|block comment -> code
 	switch s.state {
 	case lexerStateCode:
-		if state == lexerStateComment || state == lexerStateString {
+		if state == lexerStateComment || state == lexerStateString || state == lexerStateBlockComment {
 			goto allowed
 		}
-	case lexerStateComment:
-		fallthrough
-	case lexerStateString:
+	case lexerStateComment, lexerStateString, lexerStateBlockComment:
 		if state == lexerStateCode {
 			goto allowed
 		}
@@ -67,6 +73,10 @@ func (s *lexerState) inString() bool {
 	return s.state == lexerStateString
 }
 
+func (s *lexerState) inBlockComment() bool {
+	return s.state == lexerStateBlockComment
+}
+
 func (s *lexerState) getLine() int            { return s.lines }
 func (s *lexerState) getColumn(index int) int { return index - s.offset }
 
@@ -81,12 +91,14 @@ const (
 	TokenNumber
 	TokenString
 	TokenSymbol
+	TokenDatumComment // #;
 )
 
 type Token struct {
 	Type        int
 	ValueString string       // Symbolic or string value.
 	ValueNumber *uint256.Int // Numeric value.
+	Raw         string       // Source text, e.g. "a\tb" with the quotes.
 	Origin      Origin
 }
 
@@ -104,6 +116,8 @@ func (t Token) Short() string {
 		return fmt.Sprintf(`string("%s")`, t.ValueString)
 	case TokenSymbol:
 		return fmt.Sprintf("symbol(%s)", t.ValueString)
+	case TokenDatumComment:
+		return "#;"
 	default:
 		panic("TODO")
 	}
@@ -147,6 +161,176 @@ func (i *TokenIterator) push(token Token) {
 	i.tokens = append(i.tokens, token)
 }
 
+// Negative literals are encoded as two's complement, e.g. -1 becomes
+// 2^256-1.
+func negate(built string, x *uint256.Int) *uint256.Int {
+	if strings.HasPrefix(built, "-") {
+		return x.Neg(x)
+	}
+	return x
+}
+
+// Units that may follow decimal literals, e.g. 1ether or 2days.
+var numberUnits = map[string]*big.Int{
+	"wei":     big.NewInt(1),
+	"gwei":    big.NewInt(1_000_000_000),
+	"ether":   new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil),
+	"seconds": big.NewInt(1),
+	"minutes": big.NewInt(60),
+	"hours":   big.NewInt(60 * 60),
+	"days":    big.NewInt(24 * 60 * 60),
+	"weeks":   big.NewInt(7 * 24 * 60 * 60),
+}
+
+// Decimal literals consist of an integer part, an optional fraction,
+// an optional exponent and an optional unit, e.g. 1.5e3gwei.
+var decimalLiteral = regexp.MustCompile(`^([0-9_]+)(?:\.([0-9_]+))?(?:e([0-9_]+))?([a-z]*)$`)
+
+// parseNumber parses an unsigned numeric literal: binary (0b101),
+// octal (0o17), hexadecimal (0xff) or decimal (1_000, 5e18, 1.5ether).
+// Decimal literals have to result in an integer.
+func parseNumber(literal string) (*uint256.Int, error) {
+	var ans *big.Int
+
+	bases := map[string]int{"0b": 2, "0o": 8, "0x": 16}
+	if base, ok := bases[literal[:min(2, len(literal))]]; ok {
+		digits, err := stripSeparators(literal[2:])
+		if err != nil {
+			return nil, err
+		}
+		// SetString would also accept a sign.
+		if strings.ContainsAny(digits, "+-") {
+			return nil, errors.New("invalid number literal")
+		}
+		if ans, ok = new(big.Int).SetString(digits, base); !ok {
+			return nil, errors.New("invalid number literal")
+		}
+	} else {
+		match := decimalLiteral.FindStringSubmatch(literal)
+		if match == nil {
+			return nil, errors.New("invalid number literal")
+		}
+
+		whole, err := stripSeparators(match[1])
+		if err != nil {
+			return nil, err
+		}
+		fraction := ""
+		if match[2] != "" {
+			if fraction, err = stripSeparators(match[2]); err != nil {
+				return nil, err
+			}
+		}
+		exponent := 0
+		if match[3] != "" {
+			digits, err := stripSeparators(match[3])
+			if err != nil {
+				return nil, err
+			}
+			// Bigger exponents overflow, unless the literal is
+			// zero, which needs no exponent anyway.
+			if exponent, err = strconv.Atoi(digits); err != nil || exponent > 1000 {
+				return nil, errors.New("number literal overflows 256 bits")
+			}
+		}
+		unit := big.NewInt(1)
+		if match[4] != "" {
+			if unit = numberUnits[match[4]]; unit == nil {
+				return nil, errors.New("unknown unit: " + match[4])
+			}
+		}
+
+		// whole.fraction * 10^exponent * unit
+		ans, _ = new(big.Int).SetString(whole+fraction, 10)
+		ans.Mul(ans, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exponent)), nil))
+		ans.Mul(ans, unit)
+
+		scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(len(fraction))), nil)
+		if _, rem := ans.QuoRem(ans, scale, new(big.Int)); rem.Sign() != 0 {
+			return nil, errors.New("number literal is not an integer")
+		}
+	}
+
+	if ans.BitLen() > 256 {
+		return nil, errors.New("number literal overflows 256 bits")
+	}
+
+	return uint256.MustFromBig(ans), nil
+}
+
+// stripSeparators removes the underscores separating digits, as in
+// 1_000_000.  Underscores are only allowed between digits.
+func stripSeparators(digits string) (string, error) {
+	if digits == "" {
+		return "", errors.New("invalid number literal")
+	}
+	if strings.HasPrefix(digits, "_") || strings.HasSuffix(digits, "_") || strings.Contains(digits, "__") {
+		return "", errors.New("misplaced digit separator")
+	}
+	return strings.ReplaceAll(digits, "_", ""), nil
+}
+
+// unescape interprets the escape sequences of a string literal:
+//
+//	\" \\ \n \t \r \xNN \u{N...}
+//
+// where \xNN is a single byte and \u{N...} is a Unicode code point
+// encoded as UTF-8.
+func unescape(raw string) (string, error) {
+	var b strings.Builder
+
+	for i := 0; i < len(raw); i++ {
+		if raw[i] != '\\' {
+			b.WriteByte(raw[i])
+			continue
+		}
+
+		i++
+		if i >= len(raw) {
+			return "", errors.New("unterminated escape sequence")
+		}
+
+		switch raw[i] {
+		case '"':
+			b.WriteByte('"')
+		case '\\':
+			b.WriteByte('\\')
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'x':
+			if i+3 > len(raw) {
+				return "", errors.New(`invalid escape sequence: \x`)
+			}
+			decoded, err := hex.DecodeString(raw[i+1 : i+3])
+			if err != nil {
+				return "", fmt.Errorf(`invalid escape sequence: \x%s`, raw[i+1:i+3])
+			}
+			b.Write(decoded)
+			i += 2
+		case 'u':
+			end := strings.IndexByte(raw[i:], '}')
+			if !strings.HasPrefix(raw[i:], "u{") || end < 0 {
+				return "", errors.New(`invalid escape sequence: \u`)
+			}
+			digits := raw[i+2 : i+end]
+			code, err := strconv.ParseUint(digits, 16, 32)
+			if err != nil || len(digits) > 6 || !utf8.ValidRune(rune(code)) {
+				return "", fmt.Errorf(`invalid escape sequence: \u{%s}`, digits)
+			}
+			b.WriteRune(rune(code))
+			i += end
+		default:
+			return "", fmt.Errorf(`invalid escape sequence: \%c`, raw[i])
+		}
+	}
+
+	return b.String(), nil
+}
+
 func Scan(code string, filename string) (TokenIterator, error) {
 	var (
 		// Multi-character tokens are built character by character.
@@ -155,9 +339,21 @@ func Scan(code string, filename string) (TokenIterator, error) {
 		builderLine   int
 		builderColumn int
 
+		// String literals are collected separately, escape
+		// sequences are interpreted once the literal is complete.
+		literal       strings.Builder
+		literalLine   int
+		literalColumn int
+		literalBytes  bool // Byte literal like #x"deadbeef".
+		escaped       bool
+
 		tokens = NewTokenIterator()
 		state  = newLexerState()
-		// prev   = rune(0) // TODO
+		prev   = rune(0) // Previous character inside a block comment.
+
+		// Origin of the outermost block comment.
+		commentLine   int
+		commentColumn int
 
 		pushRune = func(i int, r rune) {
 			// If this is the first character from a new token,
@@ -169,9 +365,10 @@ func Scan(code string, filename string) (TokenIterator, error) {
 			builder.WriteRune(r)
 		}
 
-		pushToken = func(tokenType int, s string, n *uint256.Int, line, col int) {
+		pushToken = func(tokenType int, raw, s string, n *uint256.Int, line, col int) {
 			tokens.push(Token{
 				Type:        tokenType,
+				Raw:         raw,
 				ValueString: s,
 				ValueNumber: n,
 				Origin:      NewOrigin(filename, line, col),
@@ -194,86 +391,179 @@ func Scan(code string, filename string) (TokenIterator, error) {
 				return NewLexicalError(filename, builderLine, builderColumn, msg, built)
 			}
 
-			if strings.HasPrefix(built, `"`) && strings.HasSuffix(built, `"`) {
-				end := len(built) - 1
-				stripped := built[1:end]
-				pushToken(TokenString, stripped, nil, builderLine, builderColumn)
-			} else if strings.HasPrefix(built, "0x") {
-				// Token starts with a 0x prefix, treat it as number.
-				if parsed, err := uint256.FromHex(built); err == nil {
-					pushToken(TokenNumber, "", parsed, builderLine, builderColumn)
-				} else {
-					return e("invalid hex literal")
+			if digits := strings.TrimPrefix(built, "-"); digits != "" && unicode.IsDigit(rune(digits[0])) {
+				// Tokens starting with a digit are numbers.
+				parsed, err := parseNumber(digits)
+				if err != nil {
+					return e(err.Error())
 				}
-			} else if parsed, err := uint256.FromDecimal(built); err == nil {
-				// If token can be parsed into a number, treat it as such.
-				pushToken(TokenNumber, "", parsed, builderLine, builderColumn)
+				pushToken(TokenNumber, built, "", negate(built, parsed), builderLine, builderColumn)
 			} else {
 				// TODO: Check if that's a proper symbol, contains no
 				// forbidden characters like quotes, etc.
-				pushToken(TokenSymbol, built, nil, builderLine, builderColumn)
+				pushToken(TokenSymbol, built, built, nil, builderLine, builderColumn)
 			}
 
 			builder.Reset()
 			return nil
 		}
+
+		buildLiteral = func() error {
+			raw := literal.String()
+			literal.Reset()
+
+			e := func(msg string) error {
+				return NewLexicalError(filename, literalLine, literalColumn, msg, raw)
+			}
+
+			if literalBytes {
+				decoded, err := hex.DecodeString(raw)
+				if err != nil {
+					return e("invalid byte literal")
+				}
+				pushToken(TokenString, `#x"`+raw+`"`, string(decoded), nil, literalLine, literalColumn)
+				return nil
+			}
+
+			unescaped, err := unescape(raw)
+			if err != nil {
+				return e(err.Error())
+			}
+			pushToken(TokenString, `"`+raw+`"`, unescaped, nil, literalLine, literalColumn)
+			return nil
+		}
 	)
 
 	for i, r := range code {
-		if r == '"' && state.transitionTo(lexerStateString) {
-			// Beginning of a string.
-			pushRune(i, r)
+		if state.inString() {
+			switch {
+			case escaped:
+				escaped = false
+			case r == '\\' && !literalBytes:
+				escaped = true
+			case r == '"':
+				// End of the string.
+				state.transitionTo(lexerStateCode)
+				if err := buildLiteral(); err != nil {
+					return tokens, err
+				}
+				continue
+			}
+			if r == '\n' {
+				// Strings can span multiple lines.
+				state.newLine(i)
+			}
+			literal.WriteRune(r)
 			continue
-		} else if r == ';' && state.transitionTo(lexerStateComment) {
-			// Beginning of a comment.
+		}
+
+		if state.inBlockComment() {
+			// Block comments #| ... |# can be nested.
+			switch {
+			case prev == '#' && r == '|':
+				state.depth++
+				r = 0
+			case prev == '|' && r == '#':
+				state.depth--
+				r = 0
+			case r == '\n':
+				state.newLine(i)
+			}
+			if state.depth <= 0 {
+				state.transitionTo(lexerStateCode)
+			}
+			prev = r
 			continue
-		} else if r == '\n' && state.transitionTo(lexerStateCode) {
-			// Beginning of a new line.  We do not support multi-line
-			// comments or strings, so it's always code.
+		}
+
+		if r == '\n' {
 			state.newLine(i)
-			continue
+			if state.inComment() {
+				// Comments end at the end of the line.
+				state.transitionTo(lexerStateCode)
+				continue
+			}
 		}
 
 		if state.inComment() {
 			// Inside a comment, ignore character.
-		} else if state.inString() {
-			pushRune(i, r)
-			if r == '"' {
+			continue
+		}
+
+		switch r {
+		case '"':
+			// Beginning of a string.
+			if builder.String() == "#x" {
+				literalBytes = true
+				literalLine, literalColumn = builderLine, builderColumn
+				builder.Reset()
+			} else {
 				if err := maybeBuild(); err != nil {
-					// Error while completing the string.
 					return tokens, err
 				}
-				state.transitionTo(lexerStateCode)
+				literalBytes = false
+				literalLine, literalColumn = state.getLine(), state.getColumn(i)
+			}
+			state.transitionTo(lexerStateString)
+			continue
+		case ';':
+			if builder.String() == "#" {
+				// Datum comment, the parser skips the next
+				// expression.
+				pushToken(TokenDatumComment, "#;", "", nil, builderLine, builderColumn)
+				builder.Reset()
+				continue
 			}
-		} else if state.inCode() {
-			tokenType := -1
-			switch r {
-			case '(':
-				tokenType = TokenLeftParen
-			case ')':
-				tokenType = TokenRightParen
-			case '\'':
-				tokenType = TokenQuote
+			// Beginning of a comment.
+			if err := maybeBuild(); err != nil {
+				return tokens, err
 			}
-			if tokenType != -1 {
-				if err := maybeBuild(); err != nil {
-					return tokens, err
-				}
-				pushToken(tokenType, "", nil, state.getLine(), state.getColumn(i))
+			state.transitionTo(lexerStateComment)
+			continue
+		case '|':
+			if builder.String() == "#" {
+				// Beginning of a block comment.
+				commentLine, commentColumn = builderLine, builderColumn
+				builder.Reset()
+				state.depth = 1
+				prev = 0
+				state.transitionTo(lexerStateBlockComment)
 				continue
 			}
+		}
 
-			if unicode.IsSpace(r) {
-				if err := maybeBuild(); err != nil {
-					return tokens, err
-				}
-				continue
+		tokenType := -1
+		switch r {
+		case '(':
+			tokenType = TokenLeftParen
+		case ')':
+			tokenType = TokenRightParen
+		case '\'':
+			tokenType = TokenQuote
+		}
+		if tokenType != -1 {
+			if err := maybeBuild(); err != nil {
+				return tokens, err
 			}
+			pushToken(tokenType, string(r), "", nil, state.getLine(), state.getColumn(i))
+			continue
+		}
 
-			pushRune(i, r)
-		} else {
-			panic("broken invariant")
+		if unicode.IsSpace(r) {
+			if err := maybeBuild(); err != nil {
+				return tokens, err
+			}
+			continue
 		}
+
+		pushRune(i, r)
+	}
+
+	if state.inString() {
+		return tokens, NewLexicalError(filename, literalLine, literalColumn, "unterminated string", "")
+	}
+	if state.inBlockComment() {
+		return tokens, NewLexicalError(filename, commentLine, commentColumn, "unterminated comment", "")
 	}
 
 	err := maybeBuild()
@@ -3,6 +3,7 @@ package mist_test
 import (
 	"testing"
 
+	"github.com/holiman/uint256"
 	"github.com/ydm/mist"
 )
 
@@ -83,3 +84,233 @@ func TestScan(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestScanNegative(t *testing.T) {
+	t.Parallel()
+
+	tokens, err := mist.Scan("(- -1 -0x10 -)", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectToken(t, tokens.Next(), mist.TokenLeftParen, "")
+	expectToken(t, tokens.Next(), mist.TokenSymbol, "-")
+
+	minusOne := tokens.Next()
+	expectToken(t, minusOne, mist.TokenNumber, "")
+	if want := new(uint256.Int).SetAllOne(); !minusOne.ValueNumber.Eq(want) {
+		t.Errorf("have %v, want %v", minusOne.ValueNumber, want)
+	}
+
+	minusSixteen := tokens.Next()
+	expectToken(t, minusSixteen, mist.TokenNumber, "")
+	if want := new(uint256.Int).Neg(uint256.NewInt(16)); !minusSixteen.ValueNumber.Eq(want) {
+		t.Errorf("have %v, want %v", minusSixteen.ValueNumber, want)
+	}
+
+	expectToken(t, tokens.Next(), mist.TokenSymbol, "-")
+	expectToken(t, tokens.Next(), mist.TokenRightParen, "")
+	for tokens.HasNext() {
+		t.Fail()
+	}
+}
+
+func TestScanBytes(t *testing.T) {
+	t.Parallel()
+
+	tokens, err := mist.Scan(`(f #x"dead00ff" #x"")`, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectToken(t, tokens.Next(), mist.TokenLeftParen, "")
+	expectToken(t, tokens.Next(), mist.TokenSymbol, "f")
+	expectToken(t, tokens.Next(), mist.TokenString, "\xde\xad\x00\xff")
+	expectToken(t, tokens.Next(), mist.TokenString, "")
+	expectToken(t, tokens.Next(), mist.TokenRightParen, "")
+	for tokens.HasNext() {
+		t.Fail()
+	}
+
+	for _, invalid := range []string{`#x"abc"`, `#x"zz"`} {
+		if _, err := mist.Scan(invalid, "test"); err == nil {
+			t.Errorf("%s: want error, have none", invalid)
+		}
+	}
+}
+
+func TestScanEscapes(t *testing.T) {
+	t.Parallel()
+
+	tokens, err := mist.Scan(`(f "a \"quoted\" word" "\\ \n\t\r" "\x00\xff" "\u{48}\u{20ac}")`, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectToken(t, tokens.Next(), mist.TokenLeftParen, "")
+	expectToken(t, tokens.Next(), mist.TokenSymbol, "f")
+	expectToken(t, tokens.Next(), mist.TokenString, `a "quoted" word`)
+	expectToken(t, tokens.Next(), mist.TokenString, "\\ \n\t\r")
+	expectToken(t, tokens.Next(), mist.TokenString, "\x00\xff")
+	expectToken(t, tokens.Next(), mist.TokenString, "H€")
+	expectToken(t, tokens.Next(), mist.TokenRightParen, "")
+	for tokens.HasNext() {
+		t.Fail()
+	}
+
+	invalid := []string{
+		`"\q"`,
+		`"\x1"`,
+		`"\xzz"`,
+		`"\u{}"`,
+		`"\u{110000}"`,
+		`"\u{d800}"`,
+	}
+	for _, c := range invalid {
+		if _, err := mist.Scan(c, "test"); err == nil {
+			t.Errorf("%s: want error, have none", c)
+		}
+	}
+}
+
+func TestScanMultiline(t *testing.T) {
+	t.Parallel()
+
+	tokens, err := mist.Scan("(a ; comment\n  b \"x\ny\" c\n d)", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		tokType int
+		value   string
+		line    int
+		column  int
+	}{
+		{mist.TokenLeftParen, "", 1, 0},
+		{mist.TokenSymbol, "a", 1, 1},
+		{mist.TokenSymbol, "b", 2, 2},
+		{mist.TokenString, "x\ny", 2, 4},
+		{mist.TokenSymbol, "c", 3, 3},
+		{mist.TokenSymbol, "d", 4, 1},
+		{mist.TokenRightParen, "", 4, 2},
+	}
+
+	for _, w := range want {
+		tok := tokens.Next()
+		expectToken(t, tok, w.tokType, w.value)
+		if tok.Origin.Line != w.line || tok.Origin.Column != w.column {
+			t.Errorf("%s: have %d:%d, want %d:%d", tok.Short(), tok.Origin.Line, tok.Origin.Column, w.line, w.column)
+		}
+	}
+	for tokens.HasNext() {
+		t.Fail()
+	}
+}
+
+func TestScanUnterminated(t *testing.T) {
+	t.Parallel()
+
+	for _, c := range []string{`(f "abc)`, "(f \"abc\n)", `(f "abc\")`, `#x"dead`} {
+		if _, err := mist.Scan(c, "test"); err == nil {
+			t.Errorf("%q: want error, have none", c)
+		}
+	}
+}
+
+func TestScanNumbers(t *testing.T) {
+	t.Parallel()
+
+	ether := new(uint256.Int).Exp(uint256.NewInt(10), uint256.NewInt(18))
+
+	cases := []struct {
+		literal string
+		want    *uint256.Int
+	}{
+		{"0b101", uint256.NewInt(5)},
+		{"0o17", uint256.NewInt(15)},
+		{"0x01", uint256.NewInt(1)},
+		{"0xdead_beef", uint256.NewInt(0xdeadbeef)},
+		{"1_000_000", uint256.NewInt(1_000_000)},
+		{"5e18", new(uint256.Int).Mul(uint256.NewInt(5), ether)},
+		{"1.5e3", uint256.NewInt(1500)},
+		{"1ether", ether},
+		{"1.5ether", new(uint256.Int).Div(new(uint256.Int).Mul(uint256.NewInt(3), ether), uint256.NewInt(2))},
+		{"3gwei", uint256.NewInt(3_000_000_000)},
+		{"7wei", uint256.NewInt(7)},
+		{"2days", uint256.NewInt(2 * 24 * 60 * 60)},
+		{"1weeks", uint256.NewInt(7 * 24 * 60 * 60)},
+		{"90minutes", uint256.NewInt(90 * 60)},
+		{"-1e3", new(uint256.Int).Neg(uint256.NewInt(1000))},
+		{
+			"115792089237316195423570985008687907853269984665640564039457584007913129639935",
+			new(uint256.Int).SetAllOne(),
+		},
+	}
+
+	for _, c := range cases {
+		tokens, err := mist.Scan(c.literal, "test")
+		if err != nil {
+			t.Errorf("%s: %v", c.literal, err)
+			continue
+		}
+		tok := tokens.Next()
+		expectToken(t, tok, mist.TokenNumber, "")
+		if tok.ValueNumber == nil || !tok.ValueNumber.Eq(c.want) {
+			t.Errorf("%s: have %v, want %v", c.literal, tok.ValueNumber, c.want)
+		}
+	}
+
+	invalid := []string{
+		"0b102",
+		"0o8",
+		"0xg",
+		"0x",
+		"0x-1",
+		"1__000",
+		"1000_",
+		"0x_ff",
+		"1.5",
+		"1e",
+		"1.0000000000000000001ether",
+		"3foo",
+		"1e78",
+		"0x1_0000000000000000000000000000000000000000000000000000000000000000",
+		"115792089237316195423570985008687907853269984665640564039457584007913129639936",
+	}
+	for _, c := range invalid {
+		if _, err := mist.Scan(c, "test"); err == nil {
+			t.Errorf("%s: want error, have none", c)
+		}
+	}
+}
+
+func TestScanComments(t *testing.T) {
+	t.Parallel()
+
+	tokens, err := mist.Scan("(a #| one\n #| two |# |#\n b #;c a#|b)", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectToken(t, tokens.Next(), mist.TokenLeftParen, "")
+	expectToken(t, tokens.Next(), mist.TokenSymbol, "a")
+	b := tokens.Next()
+	expectToken(t, b, mist.TokenSymbol, "b")
+	if b.Origin.Line != 3 || b.Origin.Column != 1 {
+		t.Errorf("have %d:%d, want 3:1", b.Origin.Line, b.Origin.Column)
+	}
+	expectToken(t, tokens.Next(), mist.TokenDatumComment, "")
+	expectToken(t, tokens.Next(), mist.TokenSymbol, "c")
+	expectToken(t, tokens.Next(), mist.TokenSymbol, "a#|b")
+	expectToken(t, tokens.Next(), mist.TokenRightParen, "")
+	for tokens.HasNext() {
+		t.Fail()
+	}
+
+	for _, c := range []string{"#| a", "#| a #| b |#", "#|#"} {
+		if _, err := mist.Scan(c, "test"); err == nil {
+			t.Errorf("%q: want error, have none", c)
+		}
+	}
+}
@@ -19,12 +19,24 @@ func handleMacroFunc(v *BytecodeVisitor, s *Scope, esp int, call Node) bool {
 		fnLTE(v, s, esp, call)
 	case ">=":
 		fnGTE(v, s, esp, call)
+	case "s<=":
+		fnSLTE(v, s, esp, call)
+	case "s>=":
+		fnSGTE(v, s, esp, call)
 	case "apply":
 		fnApply(v, s, esp, call)
+	case "checked":
+		fnChecked(v, s, esp, call)
 	case "dispatch":
 		fnDispatch(v, s, esp, call)
+	case "emit3":
+		fnEmit3(v, s, esp, call)
+	case "is-contract":
+		fnIsContract(v, s, esp, call)
 	case "let":
 		fnLet(v, s, esp, call)
+	case "unchecked":
+		fnUnchecked(v, s, esp, call)
 	case "unless":
 		fnUnless(v, s, esp, call)
 	case "when":
@@ -62,9 +74,35 @@ func fnGTE(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 	not.Accept(v, s, esp)
 }
 
+// fnSLTE translates (s<= x y) to (not (s> x y))
+func fnSLTE(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+	args := assertNargsEq("s<=", call, 2)
+
+	inv := NewNodeApplication("s>", call.Origin)
+	inv.AddChildren(args)
+
+	not := NewNodeApplication("not", call.Origin)
+	not.AddChild(inv)
+
+	not.Accept(v, s, esp)
+}
+
+// fnSGTE translates (s>= x y) to (not (s< x y))
+func fnSGTE(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+	args := assertNargsEq("s>=", call, 2)
+
+	inv := NewNodeApplication("s<", call.Origin)
+	inv.AddChildren(args)
+
+	not := NewNodeApplication("not", call.Origin)
+	not.AddChild(inv)
+
+	not.Accept(v, s, esp)
+}
+
 // Translate (apply 'fn args) to (fn args...).
 func fnApply(v *BytecodeVisitor, s *Scope, esp int, call Node) {
-	args := assertNargsGte("apply", call, 1)
+	args := assertNargsGte("apply", call, 2)
 
 	fst := args[0]
 	snd := args[1]
@@ -74,10 +112,9 @@ func fnApply(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 		!fst.Children[0].IsQuote() ||
 		!fst.Children[1].IsSymbol() {
 		//
-		panic(fmt.Sprintf(
-			"%v: invalid function: want symbol, have %v",
+		panic(NewCompilationError(
 			call.Origin,
-			&fst,
+			fmt.Sprintf("invalid function: want symbol, have %v", &fst),
 		))
 	}
 
@@ -89,19 +126,17 @@ func fnApply(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 			snd.NumChildren() < 1 ||
 			!snd.Children[0].IsQuote() {
 			//
-			panic(fmt.Sprintf(
-				"%v: wrong argument type: want quoted list, have %v",
+			panic(NewCompilationError(
 				call.Origin,
-				&snd,
+				fmt.Sprintf("wrong argument type: want quoted list, have %v", &snd),
 			))
 		}
 
 		if snd.NumChildren() == 2 {
 			if !snd.Children[1].IsList() {
-				panic(fmt.Sprintf(
-					"%v: wrong argument type: want list, have %v",
+				panic(NewCompilationError(
 					call.Origin,
-					&snd.Children[1],
+					fmt.Sprintf("wrong argument type: want list, have %v", &snd.Children[1]),
 				))
 			}
 			ans.AddChildren(snd.Children[1].Children)
@@ -111,26 +146,282 @@ func fnApply(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 	ans.Accept(v, s, esp)
 }
 
+// checkedFunctions maps arithmetic operations to their checked
+// counterparts.  Their names contain a space, so that they can't be
+// read from source code and (checked) is the only way to use them.
+var checkedFunctions = map[string]string{
+	"+":    "checked +",
+	"-":    "checked -",
+	"*":    "checked *",
+	"**":   "checked **",
+	"expt": "checked **",
+	"/":    "checked /",
+	"%":    "checked %",
+}
+
+// checkArithmetic replaces each arithmetic operation in node with its
+// checked counterpart.  Quoted expressions and (unchecked) bodies are
+// left intact.
+func checkArithmetic(node Node) Node {
+	if !node.IsList() || node.NumChildren() < 1 {
+		return node
+	}
+
+	head := node.Children[0]
+	if head.IsQuote() || head.IsThisSymbol("unchecked") {
+		return node
+	}
+
+	ans := NewNodeList(node.Origin)
+	for i := range node.Children {
+		ans.AddChild(checkArithmetic(node.Children[i]))
+	}
+
+	if name, ok := checkedFunctions[head.ValueString]; ok && head.IsSymbol() {
+		ans.Children[0] = NewNodeSymbol(name, head.Origin)
+	}
+
+	return ans
+}
+
+// fnChecked translates (checked body...) to (progn body...), where
+// (+ - * ** / %) revert with Panic(0x11) on overflow and Panic(0x12) on
+// division by zero, just like in Solidity.
+func fnChecked(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+	args := assertNargsGte("checked", call, 0)
+
+	progn := NewNodeProgn()
+	for i := range args {
+		progn.AddChild(checkArithmetic(args[i]))
+	}
+
+	progn.Accept(v, s, esp)
+}
+
+type dispatchClause struct {
+	Origin     Origin
+	Kind       string // "function", "fallback" or "receive".
+	Signature  Node   // Valid only for functions.
+	Types      []string
+	Handler    Node
+	Returns    *Node  // List of return types, e.g. "(uint256,bool)".
+	Mutability string // "payable", "nonpayable" or "view".
+}
+
+// parseDispatchClause parses (signature handler options...),
+// (:fallback handler options...) or (:receive handler options...).
+func parseDispatchClause(inp Node) dispatchClause {
+	if !inp.IsList() || inp.NumChildren() < 2 {
+		panic(NewCompilationError(
+			inp.Origin,
+			fmt.Sprintf("invalid dispatch clause: want (signature handler options...), have %v", &inp),
+		))
+	}
+
+	clause := dispatchClause{
+		Origin:     inp.Origin,
+		Kind:       "function",
+		Signature:  inp.Children[0],
+		Types:      []string{},
+		Handler:    inp.Children[1],
+		Returns:    nil,
+		Mutability: "nonpayable",
+	}
+
+	// Extract signature.
+	signature := inp.Children[0]
+	switch {
+	case signature.IsThisSymbol(":fallback"):
+		clause.Kind = "fallback"
+	case signature.IsThisSymbol(":receive"):
+		clause.Kind = "receive"
+		clause.Mutability = "payable"
+	case signature.IsString():
+		_, types, err := SplitSignature(signature.ValueString)
+		if err != nil {
+			panic(NewCompilationError(signature.Origin, err.Error()))
+		}
+		clause.Types = types
+	default:
+		panic(NewCompilationError(
+			signature.Origin,
+			fmt.Sprintf("invalid signature: want string, :fallback or :receive, have %v", &signature),
+		))
+	}
+
+	// Extract handler.
+	handler := inp.Children[1]
+	if !handler.IsSymbol() {
+		panic(NewCompilationError(
+			handler.Origin,
+			fmt.Sprintf("invalid handler: want symbol, have %v", &handler),
+		))
+	}
+
+	// Extract options.
+	options := inp.Children[2:]
+	for i := 0; i < len(options); i++ {
+		option := options[i]
+		switch {
+		case option.IsThisSymbol(":returns") && i+1 < len(options) && options[i+1].IsString() && clause.Kind == "function":
+			i++
+			clause.Returns = &options[i]
+			types, err := ParseTypeList(clause.Returns.ValueString)
+			if err != nil {
+				panic(NewCompilationError(clause.Returns.Origin, err.Error()))
+			}
+			if len(types) != 1 {
+				// Handlers result in a single value.
+				panic(NewCompilationError(
+					clause.Returns.Origin,
+					fmt.Sprintf("want a single return type, have %d, use (return-abi) in the handler instead", len(types)),
+				))
+			}
+		case option.IsThisSymbol(":payable"):
+			clause.Mutability = "payable"
+		case option.IsThisSymbol(":nonpayable") && clause.Kind != "receive":
+			clause.Mutability = "nonpayable"
+		case option.IsThisSymbol(":view") && clause.Kind == "function":
+			clause.Mutability = "view"
+		default:
+			panic(NewCompilationError(
+				option.Origin,
+				fmt.Sprintf("invalid %s option: %v", clause.Kind, &option),
+			))
+		}
+	}
+
+	return clause
+}
+
+// abiEntry returns the ABI description of the clause.
+func (c *dispatchClause) abiEntry() ABIEntry {
+	if c.Kind != "function" {
+		return ABIEntry{
+			Type:            c.Kind,
+			Name:            "",
+			Inputs:          []ABIArgument{},
+			Outputs:         nil,
+			StateMutability: c.Mutability,
+			Anonymous:       false,
+		}
+	}
+
+	entry, err := NewABIEntry("function", c.Signature.ValueString)
+	if err != nil {
+		panic(NewCompilationError(c.Signature.Origin, err.Error()))
+	}
+	if c.Returns != nil {
+		outputs, _ := ParseTypeList(c.Returns.ValueString)
+		for _, t := range outputs {
+			entry.Outputs = append(entry.Outputs, ABIArgument{Name: "", Type: t.String(), Indexed: false})
+		}
+	}
+	entry.StateMutability = c.Mutability
+
+	return entry
+}
+
+// body returns the code that runs when the clause is selected.
+func (c *dispatchClause) body() Node {
+	symbol := c.Handler
+
+	// Create (handler args...)
+	handler := NewNodeApplication(symbol.ValueString, symbol.Origin)
+	for i, t := range c.Types {
+		offset := uint64(0x04 + 0x20*i)
+		arg := NewNodeApplication("calldata-decode", symbol.Origin)
+		arg.AddChild(NewNodeString(t, c.Signature.Origin))
+		arg.AddChild(NewNodeU64(offset, symbol.Origin))
+		handler.AddChild(arg)
+	}
+
+	// Create (return (handler args...)) or its ABI-encoding
+	// counterpart.  Fallback and receive functions return nothing.
+	var returnAppl Node
+	if c.Kind != "function" {
+		returnAppl = NewNodeProgn()
+		returnAppl.AddChild(handler)
+		returnAppl.AddChild(NewNodeApplication("stop", symbol.Origin))
+	} else if c.Returns == nil {
+		returnAppl = NewNodeApplication("return", symbol.Origin)
+		returnAppl.AddChild(handler)
+	} else {
+		returnAppl = NewNodeApplication("return-abi", symbol.Origin)
+		returnAppl.AddChild(*c.Returns)
+		returnAppl.AddChild(handler)
+	}
+
+	body := NewNodeProgn()
+
+	// Reject ether sent to non-payable functions:
+	// (when (call-value) (revert))
+	if c.Mutability != "payable" {
+		when := NewNodeApplication("when", c.Origin)
+		when.AddChild(NewNodeApplication("call-value", c.Origin))
+		when.AddChild(NewNodeApplication("revert", c.Origin))
+		body.AddChild(when)
+	}
+
+	// Reject calldata that is too short to hold all heads:
+	// (when (< (calldata-size) size) (revert))
+	if len(c.Types) > 0 {
+		size := NewNodeApplication("calldata-size", c.Origin)
+		less := NewNodeApplication("<", c.Origin)
+		less.AddChild(size)
+		less.AddChild(NewNodeU64(uint64(0x04+0x20*len(c.Types)), c.Origin))
+		when := NewNodeApplication("when", c.Origin)
+		when.AddChild(less)
+		when.AddChild(NewNodeApplication("revert", c.Origin))
+		body.AddChild(when)
+	}
+
+	if body.NumChildren() == 1 {
+		return returnAppl
+	}
+
+	body.AddChild(returnAppl)
+	return body
+}
+
 // fnDispatch converts
 //
-// (dispatch ("totalSupply()" totalSupply)
+// (dispatch ("totalSupply()" totalSupply :view)
 //
-//	("balanceOf(address)" balanceOf)
+//	("balanceOf(address)" balanceOf :view)
 //	("transfer(address,uint256)" transfer)
-//	("transferFrom("address,address,uint256)" transferFrom))
+//	("name()" name :view :returns "(string)")
+//	("deposit()" deposit :payable)
+//	(:receive deposit))
 //
 // to
 //
-// (case (>> (calldata-load 0) 0xe0)
+// (progn
+//
+//	(unless (calldata-size) (progn (deposit) (stop)))
+//	(case (>> (calldata-load 0) 0xe0)
+//	  ((selector "totalSupply()")                 (progn (when (call-value) (revert))
+//	                                                     (return (totalSupply))))
+//	  ((selector "balanceOf(address)")            (progn (when (call-value) (revert))
+//	                                                     (when (< (calldata-size) 0x24) (revert))
+//	                                                     (return (balanceOf (calldata-decode "address" 0x4)))))
+//	  ((selector "name()")                        (progn (when (call-value) (revert))
+//	                                                     (return-abi "(string)" (name))))
+//	  ((selector "deposit()")                     (return (deposit)))
+//	  ...
+//	  (otherwise (revert "unrecognized function"))))
 //
-//	((selector "totalSupply()")                         (return (totalSupply)))
-//	((selector "balanceOf(address)")                    (return (balanceOf    (calldata-load 0x4))))
-//	((selector "transfer(address,uint256)")             (return (transfer     (calldata-load 0x4)
-//	                                                                          (calldata-load 0x24))))
-//	((selector "transferFrom(address,address,uint256)") (return (transferFrom (calldata-load 0x4)
-//	                                                                          (calldata-load 0x24)
-//	                                                                          (calldata-load 0x44))))
-//	(otherwise (revert "unrecognized function")))
+// Each argument is decoded and validated according to its type, see
+// (calldata-decode).  Functions are non-payable unless marked with
+// :payable; :view functions are non-payable too.  If the clause
+// declares a single return type, the result of the handler is
+// ABI-encoded accordingly.  Handlers that declare multiple return
+// types should terminate on their own with (return-abi).
+//
+// The :receive handler runs when calldata is empty.  The :fallback
+// handler runs when no other function matches, including calldata
+// shorter than a selector.  Both are called with no arguments and
+// their results are discarded.
 func fnDispatch(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 	args := assertNargsGte("dispatch", call, 0)
 
@@ -145,63 +436,127 @@ func fnDispatch(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 	ans := NewNodeApplication("case", call.Origin)
 	ans.AddChild(shr)
 
+	var (
+		fallback *dispatchClause
+		receive  *dispatchClause
+	)
+
 	// Add each case.
 	for _, inp := range args {
-		// Make sure each clause is a list of two items.
-		if !inp.IsList() || inp.NumChildren() != 2 {
-			fmt.Printf("[X] inp: %v , %d , %v\n", &inp, inp.NumChildren(), &inp.Children[0])
-			panic("TODO")
-		}
+		clause := parseDispatchClause(inp)
+
+		// Register the function in the ABI.
+		v.addABIEntry(clause.abiEntry())
 
-		// Extract signature.
-		signature := inp.Children[0]
-		if !signature.IsString() {
-			panic("TODO")
+		switch clause.Kind {
+		case "fallback":
+			if fallback != nil {
+				panic(NewCompilationError(clause.Origin, "multiple :fallback clauses"))
+			}
+			fallback = &clause
+			continue
+		case "receive":
+			if receive != nil {
+				panic(NewCompilationError(clause.Origin, "multiple :receive clauses"))
+			}
+			receive = &clause
+			continue
 		}
 
 		// Create (selector) application.
-		selector := NewNodeApplication("selector", signature.Origin)
-		selector.AddChild(signature)
+		selector := NewNodeApplication("selector", clause.Signature.Origin)
+		selector.AddChild(clause.Signature)
 
-		// Extract handler.
-		symbol := inp.Children[1]
-		if !symbol.IsSymbol() {
-			panic("TODO")
-		}
+		// Create ((selector signature) body)
+		node := NewNodeList(clause.Origin)
+		node.AddChild(selector)
+		node.AddChild(clause.body())
 
-		// Create (return (handler args...))
-		handler := NewNodeApplication(symbol.ValueString, symbol.Origin)
-		for i := range NumArguments(signature.ValueString) {
-			offset := uint64(0x04 + 0x20*i)
-			arg := NewNodeApplication("calldata-load", symbol.Origin)
-			arg.AddChild(NewNodeU64(offset, symbol.Origin))
-			handler.AddChild(arg)
-		}
-		returnAppl := NewNodeApplication("return", symbol.Origin)
-		returnAppl.AddChild(handler)
-
-		// Create ((selector signature) (return (handler args...)))
-		clause := NewNodeList(inp.Origin)
-		clause.AddChild(selector)
-		clause.AddChild(returnAppl)
+		ans.AddChild(node)
+	}
 
-		ans.AddChild(clause)
+	// Add the final `otherwise` clause, which either calls the
+	// fallback function or reverts.
+	var otherwise Node
+	if fallback != nil {
+		otherwise = fallback.body()
+	} else {
+		otherwise = NewNodeApplication("revert", call.Origin)
+		otherwise.AddChild(NewNodeString("unrecognized function", call.Origin))
 	}
 
-	// Add the final `otherwise` clause.
-	revert := NewNodeApplication("revert", call.Origin)
-	revert.AddChild(NewNodeString("unrecognized function", call.Origin))
+	clause := NewNodeList(call.Origin)
+	clause.AddChild(NewNodeSymbol("otherwise", call.Origin))
+	clause.AddChild(otherwise)
+
+	ans.AddChild(clause)
+
+	// Handle empty and short calldata before looking at the
+	// selector.  Without a fallback function, short calldata is
+	// rejected, the same as unknown selectors.  Otherwise it could
+	// match a selector padded with zeros.
+	progn := NewNodeProgn()
+
+	if receive != nil {
+		unless := NewNodeApplication("unless", receive.Origin)
+		unless.AddChild(NewNodeApplication("calldata-size", receive.Origin))
+		unless.AddChild(receive.body())
+		progn.AddChild(unless)
+	}
 
-	otherwise := NewNodeList(call.Origin)
-	otherwise.AddChild(NewNodeSymbol("otherwise", call.Origin))
-	otherwise.AddChild(revert)
+	less := NewNodeApplication("<", call.Origin)
+	less.AddChild(NewNodeApplication("calldata-size", call.Origin))
+	less.AddChild(NewNodeU64(4, call.Origin))
+	when := NewNodeApplication("when", call.Origin)
+	when.AddChild(less)
+	when.AddChild(otherwise)
+	progn.AddChild(when)
 
-	ans.AddChild(otherwise)
+	progn.AddChild(ans)
+	ans = progn
 
 	// Finally, visit the translated expression.
 	ans.Accept(v, s, esp)
 }
 
+// fnEmit3 is kept for compatibility and translates
+//
+// (emit3 "Transfer(address,address,uint256)" from to value)
+//
+// to
+//
+// (emit "Transfer(address,address,uint256)" :indexed from to :data value)
+func fnEmit3(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+	args := assertNargsEq("emit3", call, 4)
+
+	emit := NewNodeApplication("emit", call.Origin)
+	emit.AddChild(args[0])
+	emit.AddChild(NewNodeSymbol(":indexed", call.Origin))
+	emit.AddChildren(args[1:3])
+	emit.AddChild(NewNodeSymbol(":data", call.Origin))
+	emit.AddChild(args[3])
+
+	emit.Accept(v, s, esp)
+}
+
+// fnIsContract translates (is-contract address) to
+// (not (zerop (extcode-size address))).  Note that contracts under
+// construction have no code yet.
+func fnIsContract(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+	args := assertNargsEq("is-contract", call, 1)
+
+	size := NewNodeApplication("extcode-size", call.Origin)
+	size.AddChildren(args)
+
+	zerop := NewNodeApplication("zerop", call.Origin)
+	zerop.AddChild(size)
+
+	not := NewNodeApplication("not", call.Origin)
+	not.AddChild(zerop)
+
+	not.Accept(v, s, esp)
+}
+
 var _lambdaCounter uint32 = 0
 
 func makeUniqueLambdaName() string {
@@ -218,25 +573,28 @@ func makeUniqueLambdaName() string {
 // (progn (defun unique (keys...) body...)
 //	(apply 'unique values))
 func fnLet(v *BytecodeVisitor, s *Scope, esp int, call Node) {
-	args := assertNargsGte("let", call, 0)
+	args := assertNargsGte("let", call, 1)
 
 	// Split the varlist to two separate lists: keys and values.
-	varlist := NewNodeNil(NewOriginEmpty())
-	if len(args) > 0 {
-		varlist = args[0]
-	}
+	varlist := args[0]
 
 	keys := NewNodeList(NewOriginEmpty())
 	values := NewNodeList(NewOriginEmpty())
 	for i := range varlist.NumChildren() {
 		pair := varlist.Children[i]
 		if !pair.IsList() || pair.NumChildren() != 2 {
-			panic("TODO")
+			panic(NewCompilationError(
+				pair.Origin,
+				fmt.Sprintf("invalid let binding: want (name value), have %v", &pair),
+			))
 		}
 
 		key := pair.Children[0]
 		if !key.IsSymbol() {
-			panic("TODO")
+			panic(NewCompilationError(
+				key.Origin,
+				fmt.Sprintf("invalid let binding: want symbol, have %v", &key),
+			))
 		}
 		keys.AddChild(key)
 
@@ -269,6 +627,17 @@ func fnLet(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 	progn.Accept(v, s, esp)
 }
 
+// fnUnchecked translates (unchecked body...) to (progn body...), where
+// arithmetic silently wraps around even if nested in (checked).
+func fnUnchecked(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+	args := assertNargsGte("unchecked", call, 0)
+
+	progn := NewNodeProgn()
+	progn.AddChildren(args)
+
+	progn.Accept(v, s, esp)
+}
+
 func fnUnless(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 	args := assertNargsGte("unless", call, 1)
 
@@ -0,0 +1,434 @@
+package mist_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/holiman/uint256"
+	"github.com/ydm/mist"
+)
+
+func TestDispatchDecode(t *testing.T) {
+	t.Parallel()
+
+	const program = `
+(defun id (x) x)
+(defun len (x) (memory-load x))
+(defun second (x) (memory-load (+ x 0x40)))
+
+(dispatch
+ ("f(uint8)"   id)
+ ("g(bool)"    id)
+ ("h(address)" id)
+ ("i(int8)"    id)
+ ("j(bytes4)"  id)
+ ("k(string)"  len)
+ ("l(uint8[])" second))`
+
+	const (
+		minusOne  = "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"
+		minusTwo  = "fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffe"
+		minus129  = "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f"
+		selector  = "deadbeef00000000000000000000000000000000000000000000000000000000"
+		dirtyTail = "deadbeef00000000000000000000000000000000000000000000000000000001"
+	)
+
+	type testCase struct {
+		calldata []byte
+		reverts  bool
+		want     uint64
+	}
+
+	cases := []testCase{
+		{encodeCall("f(uint8)", "ff"), false, 0xff},
+		{encodeCall("f(uint8)", "100"), true, 0},
+		{encodeCall("f(uint8)"), true, 0},
+		{encodeCall("g(bool)", "1"), false, 1},
+		{encodeCall("g(bool)", "2"), true, 0},
+		{encodeCall("h(address)", "ffffffffffffffffffffffffffffffffffffffff"), false, 0},
+		{encodeCall("h(address)", "1ffffffffffffffffffffffffffffffffffffffff"), true, 0},
+		{encodeCall("i(int8)", minusTwo), false, 0},
+		{encodeCall("i(int8)", minus129), true, 0},
+		{encodeCall("i(int8)", "80"), true, 0},
+		{encodeCall("j(bytes4)", selector), false, 0},
+		{encodeCall("j(bytes4)", dirtyTail), true, 0},
+		{encodeCall("k(string)", "20", "3", "6173640000000000000000000000000000000000000000000000000000000000"), false, 3},
+		{encodeCall("k(string)", "20", "40", "61"), true, 0},
+		{encodeCall("k(string)", minusOne), true, 0},
+		{encodeCall("l(uint8[])", "20", "2", "1", "2"), false, 2},
+		{encodeCall("l(uint8[])", "20", "2", "1", "100"), true, 0},
+	}
+
+	for i, c := range cases {
+		ret, err := execute(t, program, c.calldata)
+		if c.reverts {
+			if err == nil {
+				t.Errorf("case #%d: want revert, have %x", i, ret)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case #%d: %v", i, err)
+			continue
+		}
+		if c.want != 0 && !word(ret).Eq(uint256.NewInt(c.want)) {
+			t.Errorf("case #%d: have %x, want %x", i, ret, c.want)
+		}
+	}
+}
+
+func panicData(code uint64) []byte {
+	return common.FromHex(fmt.Sprintf("4e487b71%064x", code))
+}
+
+func TestChecked(t *testing.T) {
+	t.Parallel()
+
+	const program = `
+(defun add (a b) (checked (+ a b)))
+(defun add3 (a b) (checked (+ a b 1)))
+(defun sub (a b) (checked (- a b)))
+(defun mul (a b) (checked (* a b)))
+(defun pow (a b) (checked (** a b)))
+(defun div (a b) (checked (/ a b)))
+(defun mod (a b) (checked (% a b)))
+(defun wrap (a b) (checked (unchecked (+ a b))))
+(defun folded () (checked (+ 0xffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff 1)))
+(defun unfolded () (+ 0xffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff 1))
+
+(dispatch
+ ("add(uint256,uint256)"  add)
+ ("add3(uint256,uint256)" add3)
+ ("sub(uint256,uint256)"  sub)
+ ("mul(uint256,uint256)"  mul)
+ ("pow(uint256,uint256)"  pow)
+ ("div(uint256,uint256)"  div)
+ ("mod(uint256,uint256)"  mod)
+ ("wrap(uint256,uint256)" wrap)
+ ("folded()"              folded)
+ ("unfolded()"            unfolded))`
+
+	const (
+		max  = "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"
+		half = "100000000000000000000000000000000"
+	)
+
+	type testCase struct {
+		calldata []byte
+		panics   uint64 // Panic code, or 0 if the call succeeds.
+		want     string
+	}
+
+	cases := []testCase{
+		{encodeCall("add(uint256,uint256)", "2", "3"), 0, "5"},
+		{encodeCall("add(uint256,uint256)", max, "0"), 0, max},
+		{encodeCall("add(uint256,uint256)", max, "1"), 0x11, ""},
+		{encodeCall("add3(uint256,uint256)", "fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffe", "0"), 0, max},
+		{encodeCall("add3(uint256,uint256)", "fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffe", "1"), 0x11, ""},
+		{encodeCall("sub(uint256,uint256)", "3", "3"), 0, "0"},
+		{encodeCall("sub(uint256,uint256)", "2", "3"), 0x11, ""},
+		{encodeCall("mul(uint256,uint256)", "0", max), 0, "0"},
+		{encodeCall("mul(uint256,uint256)", half, "ffffffffffffffffffffffffffffffff"), 0, "ffffffffffffffffffffffffffffffff00000000000000000000000000000000"},
+		{encodeCall("mul(uint256,uint256)", half, half), 0x11, ""},
+		{encodeCall("pow(uint256,uint256)", "a", "12"), 0, "de0b6b3a7640000"},
+		{encodeCall("pow(uint256,uint256)", "2", "ff"), 0, "8000000000000000000000000000000000000000000000000000000000000000"},
+		{encodeCall("pow(uint256,uint256)", "2", "100"), 0x11, ""},
+		{encodeCall("pow(uint256,uint256)", "0", "0"), 0, "1"},
+		{encodeCall("pow(uint256,uint256)", "1", max), 0, "1"},
+		{encodeCall("pow(uint256,uint256)", max, "1"), 0, max},
+		{encodeCall("pow(uint256,uint256)", max, "2"), 0x11, ""},
+		{encodeCall("div(uint256,uint256)", "7", "2"), 0, "3"},
+		{encodeCall("div(uint256,uint256)", "7", "0"), 0x12, ""},
+		{encodeCall("mod(uint256,uint256)", "7", "2"), 0, "1"},
+		{encodeCall("mod(uint256,uint256)", "7", "0"), 0x12, ""},
+		{encodeCall("wrap(uint256,uint256)", max, "1"), 0, "0"},
+		{encodeCall("folded()"), 0x11, ""},
+		{encodeCall("unfolded()"), 0, "0"},
+	}
+
+	for i, c := range cases {
+		ret, err := execute(t, program, c.calldata)
+		if c.panics != 0 {
+			if !errors.Is(err, vm.ErrExecutionReverted) || !bytes.Equal(ret, panicData(c.panics)) {
+				t.Errorf("case #%d: want Panic(%#x), have %x (%v)", i, c.panics, ret, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case #%d: %v", i, err)
+			continue
+		}
+		if want := uint256.MustFromHex("0x" + c.want); !word(ret).Eq(want) {
+			t.Errorf("case #%d: have %x, want %s", i, ret, c.want)
+		}
+	}
+}
+
+func TestCheckedOption(t *testing.T) {
+	t.Parallel()
+
+	const program = `
+(defun inc (x) (+ x 1))
+(defun dec (x) (unchecked (- x 1)))
+(dispatch
+ ("inc(uint256)" inc)
+ ("dec(uint256)" dec))`
+
+	options := mist.Options{Init: true, Offopt: 0, Checked: true}
+
+	ret, err := executeWithOptions(t, program, options, encodeCall("inc(uint256)", "1"))
+	if err != nil || !word(ret).Eq(uint256.NewInt(2)) {
+		t.Errorf("inc(1): have %x (%v), want 2", ret, err)
+	}
+
+	ret, err = executeWithOptions(t, program, options, encodeCall("inc(uint256)", "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"))
+	if !errors.Is(err, vm.ErrExecutionReverted) || !bytes.Equal(ret, panicData(0x11)) {
+		t.Errorf("inc(max): want Panic(0x11), have %x (%v)", ret, err)
+	}
+
+	ret, err = executeWithOptions(t, program, options, encodeCall("dec(uint256)", "0"))
+	if err != nil || !word(ret).Eq(new(uint256.Int).SetAllOne()) {
+		t.Errorf("dec(0): have %x (%v), want max", ret, err)
+	}
+
+	// Checked arithmetic is only available through (checked).
+	for _, fn := range []string{"checked+", "checked-", "checked*", "checked**", "checked/", "checked%"} {
+		program := "(" + fn + " 1 2)"
+		if _, err := mist.CompileContract(program, t.Name(), options); err == nil {
+			t.Errorf("%s: want error, have none", program)
+		}
+	}
+}
+
+func TestDispatchMutability(t *testing.T) {
+	t.Parallel()
+
+	const program = `
+(defun one () 1)
+(defun two () 2)
+(defun three () 3)
+(defun deposited () (return 0xd0))
+(defun fell () (return 0xfb))
+
+(dispatch
+ ("one()"   one)
+ ("two()"   two   :view)
+ ("three()" three :payable)
+ (:receive  deposited)
+ (:fallback fell))`
+
+	type testCase struct {
+		calldata []byte
+		value    int64
+		reverts  bool
+		want     uint64
+	}
+
+	cases := []testCase{
+		{encodeCall("one()"), 0, false, 1},
+		{encodeCall("one()"), 1, true, 0},
+		{encodeCall("two()"), 0, false, 2},
+		{encodeCall("two()"), 1, true, 0},
+		{encodeCall("three()"), 0, false, 3},
+		{encodeCall("three()"), 1, false, 3},
+		{[]byte{}, 0, false, 0xd0},
+		{[]byte{}, 1, false, 0xd0},
+		{[]byte{0x01}, 0, false, 0xfb},
+		{encodeCall("four()"), 0, false, 0xfb},
+		{encodeCall("four()"), 1, true, 0},
+	}
+
+	for i, c := range cases {
+		ret, err := executeWithValue(t, program, c.value, c.calldata)
+		if c.reverts {
+			if err == nil {
+				t.Errorf("case #%d: want revert, have %x", i, ret)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case #%d: %v", i, err)
+			continue
+		}
+		if !word(ret).Eq(uint256.NewInt(c.want)) {
+			t.Errorf("case #%d: have %x, want %x", i, ret, c.want)
+		}
+	}
+}
+
+func TestDispatchNoFallback(t *testing.T) {
+	t.Parallel()
+
+	const program = `
+(defun one () 1)
+(dispatch ("one()" one :payable))`
+
+	for i, calldata := range [][]byte{{}, {0x01}, encodeCall("two()")} {
+		if ret, err := execute(t, program, calldata); err == nil {
+			t.Errorf("case #%d: want revert, have %x", i, ret)
+		}
+	}
+}
+
+func TestDispatchShortCalldata(t *testing.T) {
+	t.Parallel()
+
+	// The selector of f477() is 8c6a0b00, which the first 3 bytes
+	// would match if they were padded with zeros.
+	const program = `
+(defun f () 1)
+(defun r () 2)
+(dispatch
+ ("f477()" f)
+ (:receive r))`
+
+	if ret, err := execute(t, program, encodeCall("f477()")); err != nil || !word(ret).Eq(uint256.NewInt(1)) {
+		t.Errorf("f477(): have %x (%v), want 1", ret, err)
+	}
+	if ret, err := execute(t, program, encodeCall("f477()")[:3]); err == nil {
+		t.Errorf("short calldata: want revert, have %x", ret)
+	}
+}
+
+// manyFunctions returns a program that dispatches n functions, where
+// f<i>() returns i+1.
+func manyFunctions(n int) string {
+	var b strings.Builder
+	for i := range n {
+		fmt.Fprintf(&b, "(defun f%d () %d)\n", i, i+1)
+	}
+	b.WriteString("(dispatch")
+	for i := range n {
+		fmt.Fprintf(&b, "\n (\"f%d()\" f%d :payable)", i, i)
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+func TestDispatchStrategies(t *testing.T) {
+	t.Parallel()
+
+	strategies := []mist.DispatchStrategy{mist.DispatchLinear, mist.DispatchBinary, mist.DispatchAuto}
+
+	for _, n := range []int{1, 2, 5, 13, 30} {
+		program := manyFunctions(n)
+
+		for _, strategy := range strategies {
+			options := mist.Options{Init: true, Offopt: 0, Checked: false, Dispatch: strategy}
+
+			for i := range n {
+				ret, err := executeWithOptions(t, program, options, encodeCall(fmt.Sprintf("f%d()", i)))
+				if err != nil {
+					t.Errorf("n=%d strategy=%d f%d: %v", n, strategy, i, err)
+					continue
+				}
+				if !word(ret).Eq(uint256.NewInt(uint64(i + 1))) {
+					t.Errorf("n=%d strategy=%d f%d: have %x, want %x", n, strategy, i, ret, i+1)
+				}
+			}
+
+			if ret, err := executeWithOptions(t, program, options, encodeCall("g()")); err == nil {
+				t.Errorf("n=%d strategy=%d g: want revert, have %x", n, strategy, ret)
+			}
+		}
+	}
+}
+
+func TestCaseBinarySearch(t *testing.T) {
+	t.Parallel()
+
+	const program = `
+(defconst seven 7)
+(return
+ (case (calldata-load 0)
+   (1 10) (2 20) (3 30) (seven 70) (9 90) (100 1000) (1 11)
+   ((selector "f()") 0xf)
+   (otherwise 0)))`
+
+	options := mist.Options{Init: true, Offopt: 0, Checked: false, Dispatch: mist.DispatchBinary}
+
+	h := mist.Keccak256Hash([]byte("f()"))
+	cases := map[string]uint64{
+		"1":                        10,
+		"3":                        30,
+		"7":                        70,
+		"9":                        90,
+		"64":                       1000,
+		fmt.Sprintf("%x", h[:4]):   0xf,
+		"0":                        0,
+		"8":                        0,
+		"ffffffffffffffffffffffff": 0,
+	}
+
+	for calldata, want := range cases {
+		ret, err := executeWithOptions(t, program, options, common.FromHex(fmt.Sprintf("%064s", calldata)))
+		if err != nil {
+			t.Errorf("%s: %v", calldata, err)
+			continue
+		}
+		if !word(ret).Eq(uint256.NewInt(want)) {
+			t.Errorf("%s: have %x, want %d", calldata, ret, want)
+		}
+	}
+}
+
+func BenchmarkDispatch(b *testing.B) {
+	const n = 30
+
+	program := manyFunctions(n)
+	strategies := map[string]mist.DispatchStrategy{
+		"linear": mist.DispatchLinear,
+		"binary": mist.DispatchBinary,
+	}
+	positions := map[string]int{"first": 0, "middle": n / 2, "last": n - 1}
+
+	for name, strategy := range strategies {
+		contract, err := mist.CompileContract(program, "bench", mist.Options{Init: true, Dispatch: strategy})
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		for position, i := range positions {
+			calldata := encodeCall(fmt.Sprintf("f%d()", i))
+
+			b.Run(name+"/"+position, func(b *testing.B) {
+				var gas uint64
+				for range b.N {
+					gas = measure(b, contract.Code, calldata)
+				}
+				b.ReportMetric(float64(gas), "gas/call")
+			})
+		}
+	}
+}
+
+func TestIsContract(t *testing.T) {
+	t.Parallel()
+
+	const program = `
+(defun check (address) (is-contract address))
+(dispatch ("check(address)" check))`
+
+	cases := []struct {
+		address common.Address
+		want    uint64
+	}{
+		{contractAddress, 1},
+		{common.HexToAddress("0xdead"), 0},
+	}
+
+	for i, c := range cases {
+		ret, err := execute(t, program, encodeCall("check(address)", c.address.Hex()))
+		if err != nil {
+			t.Fatalf("case #%d: %v", i, err)
+		}
+		if have := word(ret); !have.Eq(uint256.NewInt(c.want)) {
+			t.Errorf("case #%d: have %v, want %d", i, have, c.want)
+		}
+	}
+}
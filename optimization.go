@@ -1,5 +1,11 @@
 package mist
 
+import (
+	"math/big"
+
+	"github.com/holiman/uint256"
+)
+
 // +-------------------+
 // | AST optimizations |
 // +-------------------+
@@ -10,10 +16,205 @@ const (
 	OffoptIf         = 1 << iota
 )
 
-// TODO: If an arithmetic expression is made up of constants, replace
-// it with the result instead.
+type folder struct {
+	nargs int // Exact number of arguments, or -1 if variadic.
+
+	// fold returns the result and whether the operation overflows
+	// or divides by zero, i.e. whether it would panic in checked
+	// mode.
+	fold func(xs []*uint256.Int) (*uint256.Int, bool)
+}
+
+func foldBinary(fn func(z, x, y *uint256.Int) *uint256.Int) folder {
+	return folder{2, func(xs []*uint256.Int) (*uint256.Int, bool) {
+		return fn(new(uint256.Int), xs[0], xs[1]), false
+	}}
+}
+
+func foldVariadic(fn func(z, x, y *uint256.Int) *uint256.Int) folder {
+	return folder{-1, func(xs []*uint256.Int) (*uint256.Int, bool) {
+		z := new(uint256.Int).Set(xs[0])
+		for _, x := range xs[1:] {
+			fn(z, z, x)
+		}
+		return z, false
+	}}
+}
+
+func foldBinaryOverflow(fn func(z, x, y *uint256.Int) (*uint256.Int, bool)) folder {
+	return folder{2, func(xs []*uint256.Int) (*uint256.Int, bool) {
+		return fn(new(uint256.Int), xs[0], xs[1])
+	}}
+}
+
+// foldVariadicOverflow folds right to left, the same way the compiled
+// code evaluates variadic functions, so (* 0 x y) overflows whenever
+// (* x y) does.
+func foldVariadicOverflow(fn func(z, x, y *uint256.Int) (*uint256.Int, bool)) folder {
+	return folder{-1, func(xs []*uint256.Int) (*uint256.Int, bool) {
+		last := len(xs) - 1
+		z := new(uint256.Int).Set(xs[last])
+		overflow := false
+		for i := last - 1; i >= 0; i-- {
+			_, o := fn(z, xs[i], z)
+			overflow = overflow || o
+		}
+		return z, overflow
+	}}
+}
+
+func foldDivision(fn func(z, x, y *uint256.Int) *uint256.Int) folder {
+	return folder{2, func(xs []*uint256.Int) (*uint256.Int, bool) {
+		return fn(new(uint256.Int), xs[0], xs[1]), xs[1].IsZero()
+	}}
+}
+
+func foldExp() folder {
+	return folder{2, func(xs []*uint256.Int) (*uint256.Int, bool) {
+		base, exponent := xs[0], xs[1]
+		z := new(uint256.Int).Exp(base, exponent)
+
+		// The exact result overflows if it needs more than 256
+		// bits, i.e. if bitlen(base) * exponent is large enough.
+		// Bases 0 and 1 never overflow.
+		if base.LtUint64(2) {
+			return z, false
+		}
+		if exponent.GtUint64(256) {
+			return z, true
+		}
+		exact := new(big.Int).Exp(base.ToBig(), exponent.ToBig(), nil)
+		return z, exact.BitLen() > 256
+	}}
+}
+
+func foldPredicate(fn func(x, y *uint256.Int) bool) folder {
+	return folder{2, func(xs []*uint256.Int) (*uint256.Int, bool) {
+		if fn(xs[0], xs[1]) {
+			return uint256.NewInt(1), false
+		}
+		return uint256.NewInt(0), false
+	}}
+}
+
+// foldShift folds (<< value count) and the like.  The EVM (and
+// uint256) semantics for counts of 256 and more are preserved.
+func foldShift(fn func(z, x *uint256.Int, n uint) *uint256.Int, signed bool) folder {
+	return folder{2, func(xs []*uint256.Int) (*uint256.Int, bool) {
+		value, count := xs[0], xs[1]
+		if count.GtUint64(255) {
+			if signed && value.Sign() < 0 {
+				return new(uint256.Int).SetAllOne(), false
+			}
+			return new(uint256.Int), false
+		}
+		return fn(new(uint256.Int), value, uint(count.Uint64())), false
+	}}
+}
+
+func foldUnary(fn func(z, x *uint256.Int) *uint256.Int) folder {
+	return folder{1, func(xs []*uint256.Int) (*uint256.Int, bool) {
+		return fn(new(uint256.Int), xs[0]), false
+	}}
+}
+
+var folders = map[string]folder{
+	"+":      foldVariadicOverflow((*uint256.Int).AddOverflow),
+	"*":      foldVariadicOverflow((*uint256.Int).MulOverflow),
+	"&":      foldVariadic((*uint256.Int).And),
+	"logand": foldVariadic((*uint256.Int).And),
+	"|":      foldVariadic((*uint256.Int).Or),
+	"logior": foldVariadic((*uint256.Int).Or),
+	"^":      foldVariadic((*uint256.Int).Xor),
+	"logxor": foldVariadic((*uint256.Int).Xor),
+
+	"-":    foldBinaryOverflow((*uint256.Int).SubOverflow),
+	"/":    foldDivision((*uint256.Int).Div),
+	"s/":   foldBinary((*uint256.Int).SDiv),
+	"%":    foldDivision((*uint256.Int).Mod),
+	"smod": foldBinary((*uint256.Int).SMod),
+	"**":   foldExp(),
+	"expt": foldExp(),
+
+	"+%": {3, func(xs []*uint256.Int) (*uint256.Int, bool) {
+		return new(uint256.Int).AddMod(xs[0], xs[1], xs[2]), false
+	}},
+	"*%": {3, func(xs []*uint256.Int) (*uint256.Int, bool) {
+		return new(uint256.Int).MulMod(xs[0], xs[1], xs[2]), false
+	}},
+
+	// (signextend byte-index value)
+	"signextend": foldBinary(func(z, b, x *uint256.Int) *uint256.Int {
+		return z.ExtendSign(x, b)
+	}),
+
+	"<":  foldPredicate((*uint256.Int).Lt),
+	">":  foldPredicate((*uint256.Int).Gt),
+	"s<": foldPredicate((*uint256.Int).Slt),
+	"s>": foldPredicate((*uint256.Int).Sgt),
+	"=":  foldPredicate((*uint256.Int).Eq),
+
+	"~":      foldUnary((*uint256.Int).Not),
+	"lognot": foldUnary((*uint256.Int).Not),
+
+	"<<":  foldShift((*uint256.Int).Lsh, false),
+	">>":  foldShift((*uint256.Int).Rsh, false),
+	"sar": foldShift((*uint256.Int).SRsh, true),
+}
+
+// If an arithmetic expression is made up of constants, replace it
+// with the result instead.  Expressions are folded bottom-up, so
+// (+ 1 (* 2 3)) becomes 7.  Within (checked) expressions, operations
+// that overflow or divide by zero are left for the runtime to panic.
 func optimizeArithmetic(node Node) Node {
-	return node
+	return foldArithmetic(node, false)
+}
+
+func foldArithmetic(node Node, checked bool) Node {
+	if node.Type != NodeList || node.NumChildren() < 1 || node.Children[0].IsQuote() {
+		return node
+	}
+
+	if node.Children[0].IsThisSymbol("checked") {
+		checked = true
+	} else if node.Children[0].IsThisSymbol("unchecked") {
+		checked = false
+	}
+
+	ans := NewNodeList(node.Origin)
+	for i := range node.Children {
+		ans.AddChild(foldArithmetic(node.Children[i], checked))
+	}
+
+	if !ans.Children[0].IsSymbol() {
+		return ans
+	}
+
+	f, ok := folders[ans.FunctionName()]
+	if !ok {
+		return ans
+	}
+
+	args := ans.Children[1:]
+	if (f.nargs < 0 && len(args) < 2) || (f.nargs >= 0 && len(args) != f.nargs) {
+		// Leave it to the compiler to complain.
+		return ans
+	}
+
+	xs := make([]*uint256.Int, len(args))
+	for i := range args {
+		if args[i].Type != NodeNumber {
+			return ans
+		}
+		xs[i] = args[i].ValueNumber
+	}
+
+	result, panics := f.fold(xs)
+	if checked && panics {
+		return ans
+	}
+
+	return NewNodeU256(result, node.Origin)
 }
 
 // If the condition of an (if) expression is constant, replace the
@@ -33,6 +234,10 @@ func optimizeIf(node Node) Node {
 
 	// (if cond yes no)
 	//   0    1   2  3
+	if node.NumChildren() != 4 {
+		// Malformed, left for the code generator to report.
+		return node
+	}
 	if node.Children[1].IsT() {
 		return node.Children[2]
 	} else if node.Children[1].IsNil() {
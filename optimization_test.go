@@ -41,3 +41,59 @@ func TestOptimizeIf(t *testing.T) {
 		}
 	}
 }
+
+func TestOptimizeArithmetic(t *testing.T) {
+	t.Parallel()
+
+	cases := []string{
+		"(+ 1 2 3)",
+		"(- (* (+ 3 1) (/ 4 2)) 6)",
+		"(- 0 1)",
+		"(s/ -6 2)",
+		"(smod -7 2)",
+		"(s< -1 0)",
+		"(sar -16 2)",
+		"(sar -1 0x100)",
+		"(<< 1 0x100)",
+		"(signextend 0 0xff)",
+		"(+ 1 (calldata-size))",
+		"(apply 'f '(+ 1 2))",
+		"(checked (- 0 1) (/ 1 0) (** 2 0x100) (* 0 (* 0x100 (<< 1 0xf8))))",
+		"(checked (- 3 1) (unchecked (- 0 1)))",
+	}
+
+	want := []string{
+		"(progn 6)",
+		"(progn 2)",
+		"(progn 115792089237316195423570985008687907853269984665640564039457584007913129639935)",
+		"(progn 115792089237316195423570985008687907853269984665640564039457584007913129639933)",
+		"(progn 115792089237316195423570985008687907853269984665640564039457584007913129639935)",
+		"(progn 1)",
+		"(progn 115792089237316195423570985008687907853269984665640564039457584007913129639932)",
+		"(progn 115792089237316195423570985008687907853269984665640564039457584007913129639935)",
+		"(progn 0)",
+		"(progn 115792089237316195423570985008687907853269984665640564039457584007913129639935)",
+		"(progn (+ 1 (calldata-size)))",
+		"(progn (apply (quote f) (quote (+ 1 2))))",
+		"(progn (checked (- 0 1) (/ 1 0) (** 2 256) (* 0 (* 256 452312848583266388373324160190187140051835877600158453279131187530910662656))))",
+		"(progn (checked 2 (unchecked 115792089237316195423570985008687907853269984665640564039457584007913129639935)))",
+	}
+
+	for i, c := range cases {
+		tokens, err := mist.Scan(c, fmt.Sprintf("case%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		progn, err := mist.Parse(&tokens)
+		if err != nil {
+			t.Fatal(err)
+		}
+		optimized := mist.OptimizeAST(progn, mist.OffoptIf)
+		have := optimized.String()
+
+		if diff := cmp.Diff(want[i], have); diff != "" {
+			t.Errorf("Case #%d: %s\n%s", i, c, diff)
+		}
+	}
+}
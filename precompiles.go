@@ -0,0 +1,127 @@
+package mist
+
+import (
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// +-------------+
+// | Precompiles |
+// +-------------+
+
+// Addresses of precompiled contracts.
+const (
+	precompileEcrecover = 0x01
+	precompileSha256    = 0x02
+	precompileRipemd160 = 0x03
+	precompileIdentity  = 0x04
+	precompileModexp    = 0x05
+)
+
+// callPrecompile expects [PP SZ] on the stack, where PP points to SZ
+// bytes of input in memory, and calls the precompiled contract at the
+// given address.  Up to outSize bytes of output are written to the
+// scratch space at 0x00.  Reverts if the call fails.  Leaves [].
+func (v *BytecodeVisitor) callPrecompile(address uint64, outSize uint64) {
+	v.pushU64(outSize)     // [OS PP SZ]
+	v.addOp(vm.SWAP2)      // [SZ PP OS]
+	v.pushU64(0)           // [00 SZ PP OS]
+	v.addOp(vm.SWAP2)      // [PP SZ 00 OS]
+	v.pushU64(address)     // [AD PP SZ 00 OS]
+	v.addOp(vm.GAS)        // [GG AD PP SZ 00 OS]
+	v.addOp(vm.STATICCALL) // [OK]
+	v.revertUnless()       // []
+}
+
+// callWithWords ABI-encodes the given words, passes them to a
+// precompiled contract and leaves the first word of its output [XX]
+// on the stack, or [00] if there is no output.
+func (v *BytecodeVisitor) callWithWords(s *Scope, esp int, address uint64, args []Node, origin Origin) {
+	ebp := esp
+
+	types := make([]abi.Type, len(args))
+	for i := range types {
+		types[i] = abi.Type{T: abi.UintTy, Size: 256}
+	}
+
+	v.encodeABI(s, esp, types, args, "", origin) // [PP SZ]
+	esp += 2                                     //
+	v.pushU64(0)                                 //
+	v.addOp(vm.DUP1)                             //
+	v.addOp(vm.MSTORE)                           // [PP SZ], m[00]=0
+	v.callPrecompile(address, 0x20)              // []
+	esp -= 2                                     //
+	v.pushU64(0)                                 //
+	v.addOp(vm.MLOAD)                            // [XX]
+	esp += 1                                     //
+
+	if esp != ebp+1 {
+		panic("broken invariant")
+	}
+}
+
+// fnEcrecover recovers the address that signed the given hash, or
+// results in 0 if the signature is invalid.
+func fnEcrecover(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+	args := assertNargsEq("ecrecover", call, 4) // (ecrecover hash v r s)
+
+	v.callWithWords(s, esp, precompileEcrecover, args, call.Origin)
+}
+
+// fnIdentity copies LENGTH bytes of memory from SRC to DEST and
+// results in DEST.
+func fnIdentity(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+	ebp := esp
+
+	args := assertNargsEq("identity", call, 3) // (identity dest src length)
+	esp += VisitSequence(v, s, esp, args, -1)  // [DD SS LL]
+
+	v.addOp(vm.DUP3)              // [LL DD SS LL]
+	v.addOp(vm.DUP2)              // [DD LL DD SS LL]
+	v.addOp(vm.DUP5)              // [LL DD LL DD SS LL]
+	v.addOp(vm.DUP5)              // [SS LL DD LL DD SS LL]
+	v.pushU64(precompileIdentity) // [AD SS LL DD LL DD SS LL]
+	v.addOp(vm.GAS)               // [GG AD SS LL DD LL DD SS LL]
+	v.addOp(vm.STATICCALL)        // [OK DD SS LL]
+	v.revertUnless()              // [DD SS LL]
+	v.addOp(vm.SWAP2)             // [LL SS DD]
+	v.addOp(vm.POP)               // [SS DD]
+	v.addOp(vm.POP)               // [DD]
+	esp -= 2
+
+	if esp != ebp+1 {
+		panic("broken invariant")
+	}
+}
+
+// fnModexp computes (BASE ** EXPONENT) % MODULUS over 256-bit words.
+func fnModexp(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+	args := assertNargsEq("modexp", call, 3) // (modexp base exponent modulus)
+
+	// The input is prefixed with the sizes of the operands.
+	operands := []Node{
+		NewNodeU64(0x20, call.Origin),
+		NewNodeU64(0x20, call.Origin),
+		NewNodeU64(0x20, call.Origin),
+	}
+	operands = append(operands, args...)
+
+	v.callWithWords(s, esp, precompileModexp, operands, call.Origin)
+}
+
+// fnRipemd160 hashes the given words.  The result is left-aligned,
+// just like Solidity's bytes20.
+func fnRipemd160(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+	args := assertNargsGte("ripemd160", call, 0) // (ripemd160 words...)
+
+	v.callWithWords(s, esp, precompileRipemd160, args, call.Origin)
+	v.pushU64(96)
+	v.addOp(vm.SHL)
+}
+
+// fnSha256 hashes the given words.
+func fnSha256(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+	args := assertNargsGte("sha256", call, 0) // (sha256 words...)
+
+	v.callWithWords(s, esp, precompileSha256, args, call.Origin)
+}
@@ -0,0 +1,96 @@
+package mist_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"golang.org/x/crypto/ripemd160"
+)
+
+func TestPrecompiles(t *testing.T) {
+	t.Parallel()
+
+	const program = `
+(defun recover (hash v r s) (ecrecover hash v r s))
+(defun sha (a b) (sha256 a b))
+(defun ripemd (a) (ripemd160 a))
+(defun pow (b e m) (modexp b e m))
+(defun copy (s)
+  (let ((dest (+ (memory-load 0x40) 0x200)))
+    (keccak256-mem (identity dest (+ s 0x20) (memory-load s)) (memory-load s))))
+
+(dispatch
+ ("recover(bytes32,uint8,bytes32,bytes32)" recover)
+ ("sha(uint256,uint256)"                   sha)
+ ("ripemd(uint256)"                        ripemd)
+ ("pow(uint256,uint256,uint256)"           pow)
+ ("copy(string)"                           copy))`
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := crypto.Keccak256([]byte("hello"))
+	sig, err := crypto.Sign(hash, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := crypto.PubkeyToAddress(key.PublicKey)
+
+	words := common.FromHex(fmt.Sprintf("%064x%064x", 1, 2))
+	sha := sha256.Sum256(words)
+
+	ripemd := ripemd160.New()
+	ripemd.Write(words[32:])
+	rmd := ripemd.Sum(nil)
+
+	hello := "hello, this is a string that spans more than one word"
+
+	cases := []struct {
+		calldata []byte
+		want     []byte
+	}{
+		{
+			encodeCall("recover(bytes32,uint8,bytes32,bytes32)",
+				common.Bytes2Hex(hash), fmt.Sprintf("%x", sig[64]+27), common.Bytes2Hex(sig[:32]), common.Bytes2Hex(sig[32:64])),
+			common.LeftPadBytes(signer.Bytes(), 32),
+		},
+		{
+			// Invalid v.
+			encodeCall("recover(bytes32,uint8,bytes32,bytes32)",
+				common.Bytes2Hex(hash), "01", common.Bytes2Hex(sig[:32]), common.Bytes2Hex(sig[32:64])),
+			make([]byte, 32),
+		},
+		{
+			encodeCall("sha(uint256,uint256)", "01", "02"),
+			sha[:],
+		},
+		{
+			encodeCall("ripemd(uint256)", "02"),
+			common.RightPadBytes(rmd, 32),
+		},
+		{
+			encodeCall("pow(uint256,uint256,uint256)", "03", "05", "07"),
+			common.LeftPadBytes(big.NewInt(5).Bytes(), 32),
+		},
+		{
+			append(encodeCall("copy(string)"), pack(t, []string{"string"}, hello)...),
+			crypto.Keccak256([]byte(hello)),
+		},
+	}
+
+	for i, c := range cases {
+		have, err := execute(t, program, c.calldata)
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if !bytes.Equal(have, c.want) {
+			t.Errorf("case %d: have %x, want %x", i, have, c.want)
+		}
+	}
+}
@@ -2,21 +2,19 @@ package mist
 
 import (
 	"fmt"
+	"sort"
 	"strings"
-	"sync/atomic"
 
+	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/holiman/uint256"
 )
 
 func assertNargsEq(fn string, call Node, want int) []Node {
 	if call.NumChildren() != (want + 1) {
-		panic(fmt.Sprintf(
-			"%v: have %d arguments, want %d: %v",
+		panic(NewCompilationError(
 			call.Origin,
-			call.NumChildren(),
-			(want + 1),
-			&call,
+			fmt.Sprintf("have %d arguments, want %d: %v", call.NumChildren(), (want+1), &call),
 		))
 	}
 	name := call.FunctionName()
@@ -37,13 +35,9 @@ func assertNargsEq(fn string, call Node, want int) []Node {
 
 func assertNargsGte(fn string, call Node, want int) []Node {
 	if call.NumChildren() < (want + 1) {
-		panic(fmt.Sprintf(
-			"%v: %s: have %d arguments, want at least %d: %v",
+		panic(NewCompilationError(
 			call.Origin,
-			fn,
-			call.NumChildren(),
-			(want + 1),
-			&call,
+			fmt.Sprintf("%s: have %d arguments, want at least %d: %v", fn, call.NumChildren(), (want+1), &call),
 		))
 	}
 	name := call.FunctionName()
@@ -70,6 +64,7 @@ func handleNativeFunc(v *BytecodeVisitor, s *Scope, esp int, call Node) bool {
 		op  vm.OpCode
 		inp int // Number of input stack words.
 		dir = 0
+		out = 1 // Number of output stack words.
 	)
 
 	switch fn {
@@ -81,10 +76,12 @@ func handleNativeFunc(v *BytecodeVisitor, s *Scope, esp int, call Node) bool {
 		op, inp, dir = vm.SUB, 2, -1
 	case "/":
 		op, inp, dir = vm.DIV, 2, -1
-	// SDIV is NOT implemented.
+	case "s/":
+		op, inp, dir = vm.SDIV, 2, -1
 	case "%":
 		op, inp, dir = vm.MOD, 2, -1
-	// SMOD is NOT implemented.
+	case "smod":
+		op, inp, dir = vm.SMOD, 2, -1
 	case "+%":
 		op, inp, dir = vm.ADDMOD, 3, -1
 	case "*%":
@@ -93,13 +90,16 @@ func handleNativeFunc(v *BytecodeVisitor, s *Scope, esp int, call Node) bool {
 		fallthrough
 	case "expt":
 		op, inp, dir = vm.EXP, 2, -1
-	// SIGNEXTEND is NOT implemented.
+	case "signextend": // (signextend byte-index value)
+		op, inp, dir = vm.SIGNEXTEND, 2, -1
 	case "<":
 		op, inp, dir = vm.LT, 2, -1
 	case ">":
 		op, inp, dir = vm.GT, 2, -1
-	// SLT is NOT implemented.
-	// SGT is NOT implemented.
+	case "s<":
+		op, inp, dir = vm.SLT, 2, -1
+	case "s>":
+		op, inp, dir = vm.SGT, 2, -1
 	case "=":
 		op, inp, dir = vm.EQ, 2, -1
 	case "not":
@@ -119,8 +119,10 @@ func handleNativeFunc(v *BytecodeVisitor, s *Scope, esp int, call Node) bool {
 		op, inp, dir = vm.SHL, 2, 1
 	case ">>": // (>> value count)
 		op, inp, dir = vm.SHR, 2, 1
-	// SAR is NOT implemented.
-	// KECCAK256 is NOT implemented.
+	case "sar": // (sar value count)
+		op, inp, dir = vm.SAR, 2, 1
+	case "keccak256-mem": // (keccak256-mem offset length)
+		op, inp, dir = vm.KECCAK256, 2, -1
 	case "current-address":
 		op, inp, dir = vm.ADDRESS, 0, -1
 	case "balance":
@@ -135,20 +137,26 @@ func handleNativeFunc(v *BytecodeVisitor, s *Scope, esp int, call Node) bool {
 		op, inp, dir = vm.CALLDATALOAD, 1, -1
 	case "calldata-size":
 		op, inp, dir = vm.CALLDATASIZE, 0, -1
-	// case "calldata-copy": // (calldata-copy mm-start id-offset length)
-	// 	op, nargs, dir = CALLDATACOPY, 3, -1
+	case "calldata-copy": // (calldata-copy memory-offset calldata-offset length)
+		op, inp, dir, out = vm.CALLDATACOPY, 3, -1, 0
 	case "code-size":
 		op, inp, dir = vm.CODESIZE, 0, -1
-	// case "code-copy": // (code-copy mm-start ib-offset length)
-	// 	op, nargs, dir = CODECOPY, 3, -1
+	case "code-copy": // (code-copy memory-offset code-offset length)
+		op, inp, dir, out = vm.CODECOPY, 3, -1, 0
 	case "gas-price":
 		op, inp, dir = vm.GASPRICE, 0, -1
-	// EXTCODESIZE is NOT implemented.
-	// EXTCODECOPY is NOT implemented.
-	// RETURNDATASIZE is NOT implemented.
-	// RETURNDATACOPY is NOT implemented.
-	// EXTCODEHASH is NOT implemented.
-	// BLOCKHASH is NOT implemented.
+	case "extcode-size": // (extcode-size address)
+		op, inp, dir = vm.EXTCODESIZE, 1, -1
+	case "extcode-copy": // (extcode-copy address memory-offset code-offset length)
+		op, inp, dir, out = vm.EXTCODECOPY, 4, -1, 0
+	case "returndata-size":
+		op, inp, dir = vm.RETURNDATASIZE, 0, -1
+	case "returndata-copy": // (returndata-copy memory-offset returndata-offset length)
+		op, inp, dir, out = vm.RETURNDATACOPY, 3, -1, 0
+	case "extcode-hash": // (extcode-hash address)
+		op, inp, dir = vm.EXTCODEHASH, 1, -1
+	case "block-hash": // (block-hash block-number)
+		op, inp, dir = vm.BLOCKHASH, 1, -1
 	case "coinbase":
 		op, inp, dir = vm.COINBASE, 0, -1
 	case "timestamp":
@@ -165,8 +173,13 @@ func handleNativeFunc(v *BytecodeVisitor, s *Scope, esp int, call Node) bool {
 		op, inp, dir = vm.SELFBALANCE, 0, -1
 	case "base-fee":
 		op, inp, dir = vm.BASEFEE, 0, -1
+	case "blob-hash": // (blob-hash index)
+		op, inp, dir = vm.BLOBHASH, 1, -1
+	case "blob-base-fee":
+		op, inp, dir = vm.BLOBBASEFEE, 0, -1
 	// case "pop"
-	// case "mload"
+	case "memory-load": // (memory-load offset)
+		op, inp, dir = vm.MLOAD, 1, -1
 	// case "mstore"
 	// case "mstore8"
 	// case "sload"
@@ -203,6 +216,10 @@ func handleNativeFunc(v *BytecodeVisitor, s *Scope, esp int, call Node) bool {
 			panic("broken invariant")
 		}
 		v.addOp(op)
+		if out == 0 {
+			// All expressions have a value.
+			v.VisitNil()
+		}
 		return true
 	}
 	return false
@@ -260,36 +277,82 @@ func handleBuiltinFunc(v *BytecodeVisitor, s *Scope, esp int, call Node) bool {
 	switch fn {
 	case "and":
 		fnAnd(v, s, esp, call)
+	case "aref": // (aref array index path...)
+		fnAref(v, s, esp, call)
+	case "asm": // (asm (inputs...) [:in n] [:out m] items...)
+		fnAsm(v, s, esp, call)
+	case "aset": // (aset array index path... value)
+		fnAset(v, s, esp, call)
+	case "calldata-decode": // (calldata-decode type offset)
+		fnCalldataDecode(v, s, esp, call)
 	case "case":
 		fnCase(v, s, esp, call)
+	case "checked +", "checked -", "checked *", "checked **", "checked /", "checked %":
+		fnCheckedArithmetic(v, s, esp, call)
 	case "defconst":
 		fnDefconst(v, s, esp, call)
+	case "defconstructor": // (defconstructor (args...) body...)
+		fnDefconstructor(v, s, esp, call)
+	case "deferror": // (deferror name (types...))
+		fnDeferror(v, s, esp, call)
+	case "defimmutable": // (defimmutable name)
+		fnDefimmutable(v, s, esp, call)
+	case "definterface": // (definterface name ("sig(types...)" [-> type] [:view] [:payable])...)
+		fnDefinterface(v, s, esp, call)
+	case "defstruct": // (defstruct name (field type)...)
+		fnDefstruct(v, s, esp, call)
 	case "defun":
 		fnDefun(v, s, esp, call)
 	case "defvar":
 		fnDefvar(v, s, esp, call)
-	case "emit3": // (emit3 "Transfer(address,address,uint256)" topic topic value)
-		fnEmit3(v, s, esp, call)
+	case "ecrecover": // (ecrecover hash v r s)
+		fnEcrecover(v, s, esp, call)
+	case "emit": // (emit "Transfer(address,address,uint256)" :indexed from to :data value)
+		fnEmit(v, s, esp, call)
 	case "ether":
 		fnEther(v, s, esp, call)
 	case "gethash": // (gethash table keys...)
 		fnGethash(v, s, esp, call)
 	// case "hash": // (hash "something")
 	// 	fnHash(v, s, esp, call)
+	case "identity": // (identity dest src length)
+		fnIdentity(v, s, esp, call)
 	case "if":
 		fnIf(v, s, esp, call)
+	case "keccak256": // (keccak256 words...)
+		fnKeccak256(v, s, esp, call)
+	case "keccak256-packed": // (keccak256-packed types values...)
+		fnKeccak256Packed(v, s, esp, call)
+	case "length": // (length array path...)
+		fnLength(v, s, esp, call)
+	case "memory-string": // (memory-string "literal")
+		fnMemoryString(v, s, esp, call)
+	case "modexp": // (modexp base exponent modulus)
+		fnModexp(v, s, esp, call)
+	case "pop": // (pop array path...)
+		fnPop(v, s, esp, call)
 	case "progn":
 		fnProgn(v, s, esp, call)
+	case "push": // (push value array path...)
+		fnPush(v, s, esp, call)
 	case "puthash": // (puthash table value keys...)
 		fnPuthash(v, s, esp, call)
 	case "return": // (return value)
 		fnReturn(v, s, esp, call)
-	case "revert": // (revert value)
+	case "return-abi": // (return-abi "(uint256,string)" values...)
+		fnReturnABI(v, s, esp, call)
+	case "revert": // (revert [value])
 		fnRevert(v, s, esp, call)
+	case "revert-with": // (revert-with error values...)
+		fnRevertWith(v, s, esp, call)
+	case "ripemd160": // (ripemd160 words...)
+		fnRipemd160(v, s, esp, call)
 	case "selector":
 		fnSelector(v, s, esp, call)
 	case "setq":
 		fnSetq(v, s, esp, call)
+	case "sha256": // (sha256 words...)
+		fnSha256(v, s, esp, call)
 	default:
 		return false
 	}
@@ -348,7 +411,7 @@ func handleDefinedFunc(v *BytecodeVisitor, s *Scope, esp int, call Node) bool {
 	if ptr, ok := s.GetCallAddress(name); !ok {
 		start := newSegmentJumpdest()
 		v.addSegment(start)
-		s.SetCallAddress(name, start.id)
+		s.SetCallAddress(name, start.id, call.Origin)
 
 		// First time calling this function.  Visit body and
 		// store function pointer.
@@ -434,6 +497,250 @@ func fnAnd(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 	}
 }
 
+// fnAref loads an element of a storage array, e.g.
+//
+// (aref *holders* i)
+// (aref *positions* i :amount)
+func fnAref(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+	args := assertNargsGte("aref", call, 2) // (aref array index path...)
+
+	array := getStorage(s, args[0])
+	assertStorageKind(args[0], array, StorageArray)
+
+	place := storagePlace(v, s, esp, array, args[1:]) // [SS]
+	esp += place.stackSize()                          //  --> esp=1
+	place.assertValue(call)
+	v.loadPlace(place)           // [VV]
+	esp -= place.stackSize() - 1 //  --> esp=1
+}
+
+// fnAset stores a value into an element of a storage array and
+// results in that value, e.g.
+//
+// (aset *holders* i (caller))
+// (aset *positions* i :amount 100)
+func fnAset(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+	args := assertNargsGte("aset", call, 3) // (aset array index path... value)
+
+	array := getStorage(s, args[0])
+	assertStorageKind(args[0], array, StorageArray)
+	last := len(args) - 1
+
+	place := storagePlace(v, s, esp, array, args[1:last]) // [SS]
+	esp += place.stackSize()                              //  --> esp=1
+	place.assertValue(call)
+	args[last].Accept(v, s, esp) // [VV SS]
+	esp += 1                     //  --> esp=2
+	v.addOp(vm.DUP1)             // [VV VV SS]
+	esp += 1                     //  --> esp=3
+
+	if place.Shifted {
+		v.addOp(vm.SWAP3) // [BITS VV SS VV]
+		v.addOp(vm.SWAP1) // [VV BITS SS VV]
+		v.addOp(vm.SWAP2) // [SS BITS VV VV]
+	} else {
+		v.addOp(vm.SWAP2) // [SS VV VV]
+	}
+
+	v.storePlace(place)          // [VV]
+	esp -= place.stackSize() + 1 //  --> esp=1
+}
+
+// fnCalldataDecode decodes and validates the ABI-encoded argument
+// whose head word is at the given calldata offset, e.g.
+//
+// (calldata-decode "uint8" 0x04)
+//
+// Values of static types are range checked and yielded as they are.
+// Dynamic types (string, bytes and slices of elementary types) are
+// copied to freshly allocated memory and the result is a pointer to
+// their length, followed by the data, just like Solidity's memory
+// layout.  Offsets of dynamic types are relative to the first
+// argument, i.e. they skip the 4 bytes of the selector.  Invalid
+// calldata results in a revert with no data.
+func fnCalldataDecode(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+	ebp := esp
+
+	args := assertNargsEq("calldata-decode", call, 2)
+	typ, offset := args[0], args[1]
+
+	if !typ.IsString() {
+		panic(NewCompilationError(
+			typ.Origin,
+			fmt.Sprintf("invalid type: want string, have %v", &typ),
+		))
+	}
+
+	t, err := ParseType(typ.ValueString)
+	if err != nil {
+		panic(NewCompilationError(typ.Origin, err.Error()))
+	}
+
+	offset.Accept(v, s, esp) // [HH]
+	esp += 1                 //
+	v.addOp(vm.CALLDATALOAD) // [XX]
+	esp += 0                 //
+
+	if !IsSupportedType(t) {
+		panic(NewCompilationError(typ.Origin, "unsupported type: "+typ.ValueString))
+	}
+
+	switch t.T {
+	case abi.StringTy, abi.BytesTy:
+		v.decodeDynamic(false) // [MM]
+	case abi.SliceTy:
+		v.decodeDynamic(true) // [MM LL]
+		v.validateWords(*t.Elem)
+		v.addOp(vm.SWAP1)
+		v.addOp(vm.POP) // [MM]
+	default:
+		v.validateWord(t) // [XX]
+	}
+
+	if esp != ebp+1 {
+		panic("broken invariant")
+	}
+}
+
+// validateWord expects [XX] on the stack and reverts unless XX is a
+// valid (clean) word of the given static type.
+func (v *BytecodeVisitor) validateWord(t abi.Type) {
+	switch t.T {
+	case abi.UintTy, abi.AddressTy:
+		bits := t.Size
+		if t.T == abi.AddressTy {
+			bits = 160
+		}
+		if bits < 256 {
+			v.addOp(vm.DUP1)        // [XX XX]
+			v.pushU64(uint64(bits)) // [NN XX XX]
+			v.addOp(vm.SHR)         // [HI XX]
+			v.addOp(vm.ISZERO)      // [OK XX]
+			v.revertUnless()        // [XX]
+		}
+	case abi.IntTy:
+		if t.Size < 256 {
+			v.addOp(vm.DUP1)                // [XX XX]
+			v.pushU64(uint64(t.Size/8 - 1)) // [BB XX XX]
+			v.addOp(vm.SIGNEXTEND)          // [SE XX]
+			v.addOp(vm.DUP2)                // [XX SE XX]
+			v.addOp(vm.EQ)                  // [OK XX]
+			v.revertUnless()                // [XX]
+		}
+	case abi.BoolTy:
+		v.addOp(vm.DUP1) // [XX XX]
+		v.pushU64(2)     // [02 XX XX]
+		v.addOp(vm.GT)   // [OK XX], OK=2>XX
+		v.revertUnless() // [XX]
+	case abi.FixedBytesTy:
+		if t.Size < 32 {
+			v.addOp(vm.DUP1)              // [XX XX]
+			v.pushU64(uint64(8 * t.Size)) // [NN XX XX]
+			v.addOp(vm.SHL)               // [LO XX]
+			v.addOp(vm.ISZERO)            // [OK XX]
+			v.revertUnless()              // [XX]
+		}
+	default:
+		panic(fmt.Sprintf("unsupported type: %v", t))
+	}
+}
+
+// validateWords expects [MM LL] on the stack, where MM points to LL
+// words in memory, and validates each of them.  Leaves [MM LL].
+func (v *BytecodeVisitor) validateWords(t abi.Type) {
+	if (t.T == abi.UintTy || t.T == abi.IntTy) && t.Size == 256 {
+		return
+	}
+
+	loop := newSegmentJumpdest()
+	end := newSegmentJumpdest()
+
+	v.pushU64(0)         // [II MM LL]
+	v.addSegment(loop)   //
+	v.addOp(vm.DUP3)     // [LL II MM LL]
+	v.addOp(vm.DUP2)     // [II LL II MM LL]
+	v.addOp(vm.LT)       // [LT II MM LL]
+	v.addOp(vm.ISZERO)   // [GE II MM LL]
+	v.addPointer(end.id) //
+	v.addOp(vm.JUMPI)    // [II MM LL]
+	v.addOp(vm.DUP1)     // [II II MM LL]
+	v.pushU64(5)         //
+	v.addOp(vm.SHL)      // [OF II MM LL], OF=II*0x20
+	v.addOp(vm.DUP3)     // [MM OF II MM LL]
+	v.addOp(vm.ADD)      //
+	v.pushU64(0x20)      //
+	v.addOp(vm.ADD)      // [PP II MM LL], PP=MM+0x20+OF
+	v.addOp(vm.MLOAD)    // [XX II MM LL]
+	v.validateWord(t)    // [XX II MM LL]
+	v.addOp(vm.POP)      // [II MM LL]
+	v.pushU64(1)         //
+	v.addOp(vm.ADD)      // [II MM LL], II=II+1
+	v.addPointer(loop.id)
+	v.addOp(vm.JUMP)  //
+	v.addSegment(end) // [II MM LL]
+	v.addOp(vm.POP)   // [MM LL]
+}
+
+// decodeDynamic expects [OO] on the stack, where OO is the offset of
+// a dynamic value relative to the beginning of the arguments.  Copies
+// the value to newly allocated memory and leaves [MM] on the stack,
+// where MM points to the length, followed by the data.  If words is
+// true, the length is measured in words and [MM LL] is left instead.
+func (v *BytecodeVisitor) decodeDynamic(words bool) {
+	const maxOffset = 0xffffffffffffffff
+
+	v.addOp(vm.DUP1)         // [OO OO]
+	v.pushU64(maxOffset)     // [MX OO OO]
+	v.addOp(vm.LT)           // [BD OO], BD=MX<OO
+	v.addOp(vm.ISZERO)       // [OK OO]
+	v.revertUnless()         // [OO]
+	v.pushU64(0x04)          // [04 OO]
+	v.addOp(vm.ADD)          // [PP], PP=OO+4
+	v.addOp(vm.DUP1)         // [PP PP]
+	v.addOp(vm.CALLDATALOAD) // [LL PP]
+	v.addOp(vm.DUP1)         // [LL LL PP]
+	v.pushU64(maxOffset)     // [MX LL LL PP]
+	v.addOp(vm.LT)           // [BD LL PP]
+	v.addOp(vm.ISZERO)       // [OK LL PP]
+	v.revertUnless()         // [LL PP]
+	v.addOp(vm.DUP1)         // [SZ LL PP]
+	if words {
+		v.pushU64(5)
+		v.addOp(vm.SHL) // [SZ LL PP], SZ=LL*0x20
+	}
+	v.addOp(vm.DUP1)             // [SZ SZ LL PP]
+	v.addOp(vm.DUP4)             // [PP SZ SZ LL PP]
+	v.addOp(vm.ADD)              //
+	v.pushU64(0x20)              //
+	v.addOp(vm.ADD)              // [EN SZ LL PP], EN=PP+0x20+SZ
+	v.addOp(vm.CALLDATASIZE)     // [CS EN SZ LL PP]
+	v.addOp(vm.LT)               // [BD SZ LL PP], BD=CS<EN
+	v.addOp(vm.ISZERO)           // [OK SZ LL PP]
+	v.revertUnless()             // [SZ LL PP]
+	v.pushU64(freeMemoryPointer) // [FP SZ LL PP]
+	v.addOp(vm.MLOAD)            // [MM SZ LL PP]
+	v.addOp(vm.DUP3)             // [LL MM SZ LL PP]
+	v.addOp(vm.DUP2)             // [MM LL MM SZ LL PP]
+	v.addOp(vm.MSTORE)           // [MM SZ LL PP], m[MM]=LL
+	v.addOp(vm.DUP2)             // [SZ MM SZ LL PP]
+	v.addOp(vm.DUP5)             // [PP SZ MM SZ LL PP]
+	v.pushU64(0x20)              //
+	v.addOp(vm.ADD)              // [P2 SZ MM SZ LL PP]
+	v.addOp(vm.DUP3)             // [MM P2 SZ MM SZ LL PP]
+	v.pushU64(0x20)              //
+	v.addOp(vm.ADD)              // [M2 P2 SZ MM SZ LL PP]
+	v.addOp(vm.CALLDATACOPY)     // [MM SZ LL PP], m[M2:+SZ]=c[P2:+SZ]
+	v.addOp(vm.SWAP1)            // [SZ MM LL PP]
+	v.allocate()                 // [MM LL PP]
+	v.addOp(vm.SWAP2)            // [PP LL MM]
+	v.addOp(vm.POP)              // [LL MM]
+	if words {
+		v.addOp(vm.SWAP1) // [MM LL]
+	} else {
+		v.addOp(vm.POP) // [MM]
+	}
+}
+
 func fnCase(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 	args := assertNargsGte("case", call, 1)
 
@@ -442,10 +749,9 @@ func fnCase(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 	hasOtherwise := false
 	for i := 1; i < len(args); i++ {
 		if !args[i].IsList() || args[i].NumChildren() < 2 {
-			panic(fmt.Sprintf(
-				"%v: wrong argument type for (case): want (key body...), have: %v",
+			panic(NewCompilationError(
 				call.Origin,
-				&args[i],
+				fmt.Sprintf("wrong argument type for (case): want (key body...), have: %v", &args[i]),
 			))
 		}
 		if args[i].Children[0].IsThisSymbol("otherwise") || args[i].Children[0].IsThisSymbol("t") {
@@ -453,7 +759,7 @@ func fnCase(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 			if i != len(args)-1 {
 				// We do have an otherwise clause, but
 				// it's not last in the list.
-				panic("misplaced otherwise or t clause")
+				panic(NewCompilationError(args[i].Origin, "misplaced otherwise or t clause"))
 			}
 		}
 	}
@@ -485,6 +791,12 @@ func fnCase(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 	head.Accept(v, s, esp) // [XX]
 	esp += 1
 
+	// Many constant keys are better looked up by a binary search.
+	if keys, ok := caseKeys(s, tail[:len(tail)-1]); ok && v.useBinarySearch(len(keys)) {
+		caseBinarySearch(v, s, esp, keys, tail)
+		return
+	}
+
 	// For each clause after the first one there should be a
 	// label.  Indices correspond to clauses.  The very last one
 	// -- `after` -- is placed after the whole (case).
@@ -503,7 +815,10 @@ func fnCase(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 
 		clause := tail[i]
 		if !clause.IsList() || clause.NumChildren() < 2 {
-			panic("TODO")
+			panic(NewCompilationError(
+				clause.Origin,
+				fmt.Sprintf("invalid case clause: want (key body...), have %v", &clause),
+			))
 		}
 
 		// Extract the key.
@@ -572,12 +887,177 @@ func fnCase(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 	esp -= 1                    //
 }
 
+// caseKeys returns the values of the given (case) clause keys, if all
+// of them are known at compile time: numbers, constants or
+// (selector) applications.
+func caseKeys(s *Scope, clauses []Node) ([]*uint256.Int, bool) {
+	keys := make([]*uint256.Int, len(clauses))
+	for i := range clauses {
+		key := clauses[i].Children[0]
+		if key.IsSymbol() {
+			if node, ok := s.GetConstant(key.ValueString); ok {
+				key = node
+			}
+		}
+
+		switch {
+		case key.Type == NodeNumber:
+			keys[i] = key.ValueNumber
+		case key.IsFunctionCall("selector") && key.NumChildren() == 2 && key.Children[1].IsString():
+			h := Keccak256Hash([]byte(key.Children[1].ValueString))
+			keys[i] = new(uint256.Int).SetBytes(h[:4])
+		default:
+			return nil, false
+		}
+	}
+	return keys, true
+}
+
+// caseBinarySearch compiles the clauses of a (case) whose keys are all
+// known at compile time.  The switch value is looked up by a binary
+// search among the sorted keys, which costs O(log n) comparisons
+// instead of O(n).  Stack is expected to be [XX], the same way
+// fnCase leaves it after evaluating the switch value.
+func caseBinarySearch(v *BytecodeVisitor, s *Scope, esp int, keys []*uint256.Int, clauses []Node) {
+	type entry struct {
+		key    *uint256.Int
+		clause int
+	}
+
+	// Sort the keys.  Only the first clause of duplicated keys is
+	// reachable, just like in a linear search.
+	entries := make([]entry, 0, len(keys))
+	for i := range keys {
+		entries = append(entries, entry{keys[i], i})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].key.Lt(entries[j].key)
+	})
+	unique := entries[:0]
+	for i := range entries {
+		if i == 0 || !entries[i].key.Eq(entries[i-1].key) {
+			unique = append(unique, entries[i])
+		}
+	}
+	entries = unique
+
+	// Each clause gets its own label, the last one being
+	// `otherwise`.
+	labels := make([]Segment, len(clauses))
+	for i := range labels {
+		labels[i] = newSegmentJumpdest()
+	}
+	after := newSegmentJumpdest()
+	last := len(clauses) - 1
+
+	// Emit the search tree.  Ranges of up to 4 keys are compared
+	// linearly.
+	var search func(lo, hi int)
+	search = func(lo, hi int) {
+		if hi-lo <= 4 {
+			for _, e := range entries[lo:hi] {
+				v.addOp(vm.DUP1)                  // [XX XX]
+				v.pushU256(e.key)                 // [KY XX XX]
+				v.addOp(vm.EQ)                    // [EQ XX]
+				v.addPointer(labels[e.clause].id) //
+				v.addOp(vm.JUMPI)                 // [XX]
+			}
+			v.addPointer(labels[last].id)
+			v.addOp(vm.JUMP)
+			return
+		}
+
+		mid := (lo + hi) / 2
+		left := newSegmentJumpdest()
+		v.pushU256(entries[mid].key) // [KY XX]
+		v.addOp(vm.DUP2)             // [XX KY XX]
+		v.addOp(vm.LT)               // [LT XX]
+		v.addPointer(left.id)        //
+		v.addOp(vm.JUMPI)            // [XX]
+		search(mid, hi)
+		v.addSegment(left)
+		search(lo, mid)
+	}
+	search(0, len(entries))
+
+	// Emit the bodies.  Each one starts with [XX] and ends with
+	// [RR XX].
+	for i := range clauses {
+		clause := clauses[i]
+		body := clause.Children[1]
+		if clause.NumChildren() > 2 {
+			body = NewNodeProgn()
+			body.AddChildren(clause.Children[1:])
+		}
+
+		v.addSegment(labels[i])
+		body.Accept(v, s, esp) // [RR XX]
+		if i != last {
+			v.addPointer(after.id)
+			v.addOp(vm.JUMP)
+		}
+	}
+
+	esp += 1            // Only 1 body was executed.
+	v.addSegment(after) //
+	v.addOp(vm.SWAP1)   // [XX RR]
+	esp += 0            //
+	v.addOp(vm.POP)     // [RR]
+	esp -= 1            //
+}
+
+// fnCheckedArithmetic compiles the checked counterparts of + - * ** /
+// and %, which revert with Panic(0x11) on overflow and Panic(0x12) on
+// division by zero.  These are the result of the (checked) macro and
+// can't be called directly, see checkedFunctions.
+func fnCheckedArithmetic(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+	fn := call.FunctionName()
+
+	if fn == "checked +" || fn == "checked *" {
+		args := assertNargsGte(fn, call, 2)
+		last := len(args) - 1
+
+		args[last].Accept(v, s, esp) // [AN]
+		esp += 1
+
+		for i := last - 1; i >= 0; i-- {
+			args[i].Accept(v, s, esp) // [AI ACC]
+			esp += 1
+
+			if fn == "checked +" {
+				v.checkedAdd()
+			} else {
+				v.checkedMul()
+			} // [ACC]
+			esp -= 1
+		}
+
+		return
+	}
+
+	args := assertNargsEq(fn, call, 2)
+	VisitSequence(v, s, esp, args, -1) // [A B]
+	esp += 2
+
+	switch fn {
+	case "checked -":
+		v.checkedSub()
+	case "checked **":
+		v.checkedExp()
+	case "checked /":
+		v.checkedDiv(vm.DIV)
+	case "checked %":
+		v.checkedDiv(vm.MOD)
+	} // [R]
+	esp -= 1
+}
+
 func fnDefconst(v *BytecodeVisitor, s *Scope, _ int, call Node) {
 	args := assertNargsEq("defconst", call, 2)
 	name, value := args[0], args[1]
 
 	if !name.IsSymbol() {
-		panic(fmt.Sprintf("%v: %v is not a symbol", value.Origin, value))
+		panic(NewCompilationError(value.Origin, fmt.Sprintf("%v is not a symbol", value)))
 	}
 
 	// Store into scope.
@@ -587,6 +1067,177 @@ func fnDefconst(v *BytecodeVisitor, s *Scope, _ int, call Node) {
 	v.VisitNil()
 }
 
+// fnDefconstructor defines the constructor, e.g.
+//
+// (defconstructor ((owner address) supply) (setq *owner* owner))
+//
+// The constructor is compiled separately, see compileConstructor.
+// While compiling the runtime code, this only adds it to the ABI.
+func fnDefconstructor(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+	ctor := parseConstructor(call)
+
+	if !s.IsGlobal() {
+		panic(NewCompilationError(call.Origin, "defconstructor can be used only globally"))
+	}
+
+	if v.constructor != nil {
+		ctor.compileBody(v, s, esp)
+		return
+	}
+
+	for i := range v.abi {
+		if v.abi[i].Type == "constructor" {
+			panic(NewCompilationError(call.Origin, "constructor is already defined"))
+		}
+	}
+	v.addABIEntry(ctor.abiEntry())
+
+	v.VisitNil()
+}
+
+// fnDeferror declares a custom error, e.g.
+//
+// (deferror InsufficientBalance (uint256 uint256))
+//
+// Errors are raised with (revert-with) and are part of the ABI.
+func fnDeferror(v *BytecodeVisitor, s *Scope, _ int, call Node) {
+	args := assertNargsEq("deferror", call, 2)
+	name, list := args[0], args[1]
+
+	if !name.IsSymbol() {
+		panic(NewCompilationError(
+			name.Origin,
+			fmt.Sprintf("invalid error name: want symbol, have %v", &name),
+		))
+	}
+
+	types := make([]string, 0, 4)
+	if !list.IsNil() {
+		if !list.IsList() {
+			panic(NewCompilationError(
+				list.Origin,
+				fmt.Sprintf("invalid error types: want list, have %v", &list),
+			))
+		}
+		for _, child := range list.Children {
+			if !child.IsSymbol() {
+				panic(NewCompilationError(
+					child.Origin,
+					fmt.Sprintf("invalid error type: want symbol, have %v", &child),
+				))
+			}
+			t, err := ParseType(child.ValueString)
+			if err != nil {
+				panic(NewCompilationError(child.Origin, err.Error()))
+			}
+			if !IsSupportedType(t) {
+				panic(NewCompilationError(child.Origin, "unsupported type: "+t.String()))
+			}
+			types = append(types, t.String())
+		}
+	}
+
+	e := CustomError{
+		Origin: call.Origin,
+		Name:   name.ValueString,
+		Types:  types,
+	}
+	s.Deferror(e)
+
+	entry, err := NewABIEntry("error", e.Signature())
+	if err != nil {
+		panic(NewCompilationError(call.Origin, err.Error()))
+	}
+	v.addABIEntry(entry)
+
+	// All expressions have a value.
+	v.VisitNil()
+}
+
+// fnDefimmutable declares an immutable, a value that is assigned by
+// the constructor and embedded into the deployed bytecode, e.g.
+//
+// (defimmutable owner)
+func fnDefimmutable(v *BytecodeVisitor, s *Scope, _ int, call Node) {
+	args := assertNargsEq("defimmutable", call, 1)
+
+	if !args[0].IsSymbol() {
+		panic(NewCompilationError(
+			args[0].Origin,
+			fmt.Sprintf("invalid immutable name: want symbol, have %v", &args[0]),
+		))
+	}
+
+	s.Defimmutable(call.Origin, args[0].ValueString)
+
+	v.VisitNil()
+}
+
+// fnDefinterface declares the external functions of another contract,
+// e.g.
+//
+// (definterface IERC20 ("transfer(address,uint256)" -> bool))
+// (definterface IOracle ("price()" -> uint256 :view))
+//
+// Methods are then called like (IERC20.transfer token to amount).
+func fnDefinterface(v *BytecodeVisitor, s *Scope, _ int, call Node) {
+	args := assertNargsGte("definterface", call, 1)
+
+	if !args[0].IsSymbol() || strings.Contains(args[0].ValueString, ".") {
+		panic(NewCompilationError(
+			args[0].Origin,
+			fmt.Sprintf("invalid interface name: want symbol without dots, have %v", &args[0]),
+		))
+	}
+
+	s.Definterface(NewInterface(call.Origin, args[0].ValueString, args[1:]))
+
+	v.VisitNil()
+}
+
+// fnDefstruct defines a struct type to be used in storage variables,
+// e.g.
+//
+// (defstruct Position (owner address) (amount uint256))
+func fnDefstruct(v *BytecodeVisitor, s *Scope, _ int, call Node) {
+	args := assertNargsGte("defstruct", call, 2) // (defstruct name (field type)...)
+
+	if !args[0].IsSymbol() {
+		panic(NewCompilationError(
+			args[0].Origin,
+			fmt.Sprintf("invalid struct name: want symbol, have %v", &args[0]),
+		))
+	}
+	name := args[0].ValueString
+
+	members := make([]StorageVariable, len(args)-1)
+	for i, field := range args[1:] {
+		if !field.IsList() || field.NumChildren() != 2 || !field.Children[0].IsSymbol() {
+			panic(NewCompilationError(
+				field.Origin,
+				fmt.Sprintf("invalid field: want (name type), have %v", &field),
+			))
+		}
+
+		t, err := ParseStorageType(s, field.Children[1])
+		if err != nil {
+			panic(err)
+		}
+
+		members[i] = StorageVariable{
+			Origin:     field.Origin,
+			Identifier: field.Children[0].ValueString,
+			Slot:       0,
+			Offset:     0,
+			Type:       t,
+		}
+	}
+
+	s.Defstruct(call.Origin, NewStructType(call.Origin, name, members))
+
+	v.VisitNil()
+}
+
 func fnDefun(v *BytecodeVisitor, s *Scope, _ int, node Node) {
 	fn, err := NewLispFunction(node)
 	if err != nil {
@@ -599,64 +1250,138 @@ func fnDefun(v *BytecodeVisitor, s *Scope, _ int, node Node) {
 	v.VisitNil()
 }
 
-var _storagePosition int32 = -1
-
+// fnDefvar declares a storage variable of the given type, e.g.
+//
+// (defvar *owner* address)
+// (defvar *balances* (mapping address uint256))
+//
+// Variables are laid out in storage the same way Solidity does it.
 func fnDefvar(v *BytecodeVisitor, s *Scope, _ int, call Node) {
 	args := assertNargsEq("defvar", call, 2)
 
-	if !s.IsGlobal() {
-		panic("defvar can be used only globally")
-	}
-
 	if !args[0].IsSymbol() {
-		panic("TODO")
+		panic(NewCompilationError(
+			args[0].Origin,
+			fmt.Sprintf("invalid variable name: want symbol, have %v", &args[0]),
+		))
 	}
 	identifier := args[0].ValueString
 
-	s.SetStorageVariable(identifier, atomic.AddInt32(&_storagePosition, 1))
+	t, err := ParseStorageType(s, args[1])
+	if err != nil {
+		panic(err)
+	}
+
+	s.Defvar(call.Origin, identifier, t)
 
 	v.VisitNil()
 }
 
-// I ask for forgiveness for the way this is implemented.
-func fnEmit3(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+// fnEmit emits a log entry, e.g.
+//
+// (emit "Transfer(address,address,uint256)" :indexed from to :data value)
+//
+// Arguments are given in the order of the parameters of the event,
+// each one is either :indexed or :data, which is the default for the
+// arguments that precede any keyword.  Indexed arguments become
+// topics, the rest are ABI-encoded as words into memory.  Unless the
+// event is marked as :anonymous, the first topic is the hash of the
+// event signature.
+func fnEmit(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 	ebp := esp
 
-	args := assertNargsEq("emit3", call, 4) // TODO
-	zero, additional, value := args[0], args[1:3], args[3]
+	args := assertNargsGte("emit", call, 1)
+	signature := args[0]
+
+	if !signature.IsString() {
+		panic(NewCompilationError(
+			signature.Origin,
+			fmt.Sprintf("invalid event signature: want string, have %v", &signature),
+		))
+	}
 
-	if !zero.IsString() {
-		panic("want string")
+	entry, err := NewABIEntry("event", signature.ValueString)
+	if err != nil {
+		panic(NewCompilationError(signature.Origin, err.Error()))
 	}
 
 	var (
-		h Hash = Keccak256Hash([]byte(zero.ValueString))
-		b strings.Builder
+		indexed   = make([]Node, 0, 4)
+		data      = make([]Node, 0, 4)
+		positions = make([]bool, 0, 4) // Whether each argument is indexed.
+		anonymous = false
+		section   = &data
 	)
-	for i := range len(h) {
-		b.WriteString(fmt.Sprintf("%02x", h[i]))
+	for _, arg := range args[1:] {
+		switch {
+		case arg.IsThisSymbol(":indexed"):
+			section = &indexed
+		case arg.IsThisSymbol(":data"):
+			section = &data
+		case arg.IsThisSymbol(":anonymous"):
+			anonymous = true
+		default:
+			*section = append(*section, arg)
+			positions = append(positions, section == &indexed)
+		}
+	}
+
+	// Validate the number of arguments and topics.
+	if want, have := len(entry.Inputs), len(positions); want != have {
+		panic(NewCompilationError(
+			call.Origin,
+			fmt.Sprintf(
+				"wrong number of arguments for event %s: want %d, have %d",
+				signature.ValueString,
+				want,
+				have,
+			),
+		))
 	}
-	hex := b.String()
 
-	VisitSequence(v, s, esp, additional, -1) // [T1 T2]
-	esp += len(additional)                   //
-	v.addOp(vm.PUSH32)                       //
-	v.addHex(hex)                            // [MA T1 T2]
-	esp += 1                                 //
-	v.pushU64(0x20)                          // [20 MA T1 T2]
-	esp += 1                                 //
-	v.pushU64(freeMemoryPointer)             // [FP 20 MA T1 T2]
-	esp += 1                                 //
-	v.addOp(vm.MLOAD)                        // [FM 20 MA T1 T2]
-	esp += 0                                 //
-	value.Accept(v, s, esp)                  // [XX FM 20 MA T1 T2]
-	esp += 1                                 //
-	v.addOp(vm.DUP2)                         // [FM XX FM 20 MA T1 T2]
-	esp += 1                                 //
-	v.addOp(vm.MSTORE)                       // [FM 20 MA T1 T2]
-	esp -= 2                                 //
-	v.addOp(vm.LOG3)                         // []
-	esp -= len(additional) + 3               //
+	// Register the event in the ABI.
+	for i, isIndexed := range positions {
+		entry.Inputs[i].Indexed = isIndexed
+	}
+	entry.Anonymous = anonymous
+	v.addABIEntry(entry)
+
+	topics := len(indexed)
+	if !anonymous {
+		topics += 1
+	}
+	if topics > 4 {
+		panic(NewCompilationError(
+			call.Origin,
+			fmt.Sprintf("too many indexed arguments for event %s: have %d topics, want at most 4",
+				signature.ValueString,
+				topics,
+			),
+		))
+	}
+
+	// Push the topics, the first one being on top.
+	VisitSequence(v, s, esp, indexed, -1) // [T1 T2 T3]
+	esp += len(indexed)
+	if !anonymous {
+		v.addOp(vm.PUSH32)
+		v.addHex(keccak256Hex(signature.ValueString)) // [T0 T1 T2 T3]
+		esp += 1
+	}
+
+	// Store the data words into memory.
+	v.pushU64(uint64(0x20 * len(data)))  // [SZ T0 T1 T2 T3]
+	esp += 1                             //
+	VisitSequence(v, s, esp, data, -1)   // [D0 D1... SZ T0...]
+	esp += len(data)                     //
+	v.pushU64(freeMemoryPointer)         // [FP D0 D1... SZ T0...]
+	esp += 1                             //
+	v.addOp(vm.MLOAD)                    // [FM D0 D1... SZ T0...]
+	esp += 0                             //
+	v.storeWords(len(data))              // [FM SZ T0...]
+	esp -= len(data)                     //
+	v.addOp(vm.LOG0 + vm.OpCode(topics)) // []
+	esp -= 2 + topics                    //
 
 	// All expressions have a value.
 	v.VisitNil()
@@ -671,7 +1396,10 @@ func fnEther(v *BytecodeVisitor, _ *Scope, esp int, call Node) {
 	args := assertNargsEq("ether", call, 1)
 
 	if !args[0].IsString() {
-		panic("TODO")
+		panic(NewCompilationError(
+			args[0].Origin,
+			fmt.Sprintf("invalid amount: want string, have %v", &args[0]),
+		))
 	}
 
 	inp := args[0].ValueString
@@ -683,8 +1411,8 @@ func fnEther(v *BytecodeVisitor, _ *Scope, esp int, call Node) {
 	rep := strings.Replace(val, ".", "", 1)
 	cut := rep[:sep+18]
 	ans, err := uint256.FromDecimal(cut)
-	if err != nil {
-		panic(err)
+	if err != nil || strings.Count(inp, ".") > 1 {
+		panic(NewCompilationError(args[0].Origin, "invalid amount: "+inp))
 	}
 
 	v.pushU256(ans)
@@ -694,48 +1422,57 @@ func fnEther(v *BytecodeVisitor, _ *Scope, esp int, call Node) {
 func fnGethash(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 	args := assertNargsGte("gethash", call, 2) // (gethash table keys...)
 
-	if !args[0].IsSymbol() {
-		panic("TODO")
+	table := getStorage(s, args[0])
+	assertStorageKind(args[0], table, StorageMapping)
+
+	place := storagePlace(v, s, esp, table, args[1:]) // [HH]
+	esp += place.stackSize()                          //  --> esp=1
+	place.assertValue(call)
+	v.loadPlace(place)           // [VV]
+	esp -= place.stackSize() - 1 //  --> esp=1
+}
+
+// getStorage returns the storage variable named by a symbol.
+func getStorage(s *Scope, symbol Node) StorageVariable {
+	if !symbol.IsSymbol() {
+		panic(NewCompilationError(
+			symbol.Origin,
+			fmt.Sprintf("invalid storage variable: want symbol, have %v", &symbol),
+		))
 	}
-	table := args[0].ValueString
-	pos, ok := s.GetStorageVariable(table)
+
+	variable, ok := s.GetStorageVariable(symbol.ValueString)
 	if !ok {
-		panic("TODO, void variable")
+		panic(NewCompilationError(symbol.Origin, "void variable: "+symbol.ValueString))
 	}
 
-	v.pushU64(uint64(pos)) // [PP]
-	esp += 1               //  --> esp=1
+	return variable
+}
 
-	for i := 1; i < len(args); i++ {
-		key := args[i]
-
-		v.pushU64(20)         // [20 PP]
-		esp += 1              //  --> esp=2
-		v.addOp(vm.MSTORE)    // [], m[20]=PP
-		esp -= 2              //  --> esp=0
-		key.Accept(v, s, esp) // [KK]
-		esp += 1              //  --> esp=1
-		v.pushU64(0)          // [00 KK]
-		esp += 1              //  --> esp=2
-		v.addOp(vm.MSTORE)    // [], m[00]=KK
-		esp -= 2              //  --> esp=0
-		v.pushU64(0x40)       // [40]
-		esp += 1              //  --> esp=1
-		v.pushU64(0x00)       // [00 40]
-		esp += 1              //  --> esp=2
-		v.addOp(vm.KECCAK256) // [HH]
-		esp -= 1              //  --> esp=1
-	}
-
-	v.addOp(vm.SLOAD) // [VV]
-	esp += 0          //  --> esp=1
+// assertStorageKind panics unless the storage variable named by symbol
+// is of the given kind.
+func assertStorageKind(symbol Node, variable StorageVariable, kind StorageKind) {
+	if variable.Type.Kind == kind {
+		return
+	}
+
+	what := map[StorageKind]string{
+		StorageValue:   "a value",
+		StorageMapping: "a mapping",
+		StorageArray:   "an array",
+		StorageStruct:  "a struct",
+	}
+	panic(NewCompilationError(symbol.Origin, fmt.Sprintf("%s is not %s", symbol.ValueString, what[kind])))
 }
 
 func fnHash(v *BytecodeVisitor, _ *Scope, _ int, call Node) {
 	args := assertNargsEq("hash", call, 1)
 
 	if !args[0].IsString() {
-		panic("TODO")
+		panic(NewCompilationError(
+			args[0].Origin,
+			fmt.Sprintf("invalid argument to hash: want string, have %v", &args[0]),
+		))
 	}
 
 	var (
@@ -782,6 +1519,149 @@ func fnIf(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 	// Either `yes` or `no` was evaluated, but not both.
 }
 
+// fnKeccak256 hashes the given words, i.e. (keccak256 a b) is the
+// same as Solidity's keccak256(abi.encode(a, b)) for uint256 values.
+func fnKeccak256(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+	ebp := esp
+
+	args := assertNargsGte("keccak256", call, 0)
+
+	types := make([]abi.Type, len(args))
+	for i := range types {
+		types[i] = abi.Type{T: abi.UintTy, Size: 256}
+	}
+
+	v.encodeABI(s, esp, types, args, "", call.Origin) // [PP SZ]
+	esp += 2                                          //
+	v.addOp(vm.KECCAK256)                             // [HH]
+	esp -= 1                                          //
+
+	if esp != ebp+1 {
+		panic("broken invariant")
+	}
+}
+
+// fnKeccak256Packed hashes the given values, encoded like Solidity's
+// abi.encodePacked does, e.g.
+//
+// (keccak256-packed "(address,uint96,string)" owner nonce "salt")
+func fnKeccak256Packed(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+	ebp := esp
+
+	args := assertNargsGte("keccak256-packed", call, 1)
+	types := parseTypeListArg(args[0])
+
+	v.encodePacked(s, esp, types, args[1:], call.Origin) // [PP SZ]
+	esp += 2                                             //
+	v.addOp(vm.KECCAK256)                                // [HH]
+	esp -= 1                                             //
+
+	if esp != ebp+1 {
+		panic("broken invariant")
+	}
+}
+
+// fnLength results in the length of a storage array, e.g.
+//
+// (length *holders*)
+// (length *orders* owner)
+func fnLength(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+	args := assertNargsGte("length", call, 1) // (length variable path...)
+
+	variable := getStorage(s, args[0])
+
+	place := storagePlace(v, s, esp, variable, args[1:]) // [PP]
+	assertArray(call, place)
+
+	if place.Type.IsDynamicArray() {
+		v.addOp(vm.SLOAD) // [LL]
+	} else {
+		v.addOp(vm.POP)
+		v.pushU64(place.Type.Length) // [LL]
+	}
+}
+
+// assertArray panics unless the location holds an array.
+func assertArray(call Node, place StoragePlace) {
+	if place.Type.Kind != StorageArray {
+		panic(NewCompilationError(
+			call.Origin,
+			fmt.Sprintf("%v of type %s is not an array", &call, place.Type.Name),
+		))
+	}
+}
+
+// fnMemoryString copies a string literal of any length to memory and
+// results in a pointer to its length, followed by the data, e.g.
+//
+// (return-abi "(string)" (memory-string "short"))
+//
+// Literals of up to 31 bytes are single words otherwise, while
+// string and bytes values are expected to be such pointers.
+func fnMemoryString(v *BytecodeVisitor, _ *Scope, _ int, call Node) {
+	args := assertNargsEq("memory-string", call, 1)
+
+	if !args[0].IsString() {
+		panic(NewCompilationError(
+			args[0].Origin,
+			fmt.Sprintf("invalid argument to memory-string: want string, have %v", &args[0]),
+		))
+	}
+
+	v.copyString(args[0].ValueString) // [PP]
+}
+
+// fnPop removes the last element of a dynamic storage array and
+// results in it, e.g.
+//
+// (pop *holders*)
+//
+// Popping from an empty array panics.
+func fnPop(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+	args := assertNargsGte("pop", call, 1) // (pop variable path...)
+
+	variable := getStorage(s, args[0])
+
+	array := storagePlace(v, s, esp, variable, args[1:]) // [PP]
+	assertDynamicArray(call, array)
+
+	v.addOp(vm.DUP1)
+	v.addOp(vm.SLOAD) // [LL PP]
+	v.addOp(vm.DUP1)
+	v.panicUnless(panicEmptyArray) // [LL PP]
+	v.pushU64(1)
+	v.addOp(vm.SWAP1)
+	v.addOp(vm.SUB) // [LL-1 PP]
+	v.addOp(vm.DUP1)
+	v.addOp(vm.DUP3)
+	v.addOp(vm.SSTORE) // [LL-1 PP], s[PP]=LL-1
+	v.addOp(vm.SWAP1)  // [PP LL-1]
+	v.arrayData(array.Type)
+
+	place := StoragePlace{
+		Type:    array.Type.Base,
+		Offset:  0,
+		Shifted: v.arrayElement(array.Type),
+	} // [SS] or [SS BITS]
+
+	// Load the element, then zero it the way Solidity does.
+	if place.Shifted {
+		v.addOp(vm.DUP2)
+		v.addOp(vm.DUP2)
+		v.loadPlace(place) // [XX SS BITS]
+		v.addOp(vm.SWAP2)  // [BITS SS XX]
+		v.pushU64(0)
+		v.addOp(vm.SWAP2) // [SS BITS 00 XX]
+	} else {
+		v.addOp(vm.DUP1)
+		v.loadPlace(place) // [XX SS]
+		v.addOp(vm.SWAP1)  // [SS XX]
+		v.pushU64(0)
+		v.addOp(vm.SWAP1) // [SS 00 XX]
+	}
+	v.storePlace(place) // [XX]
+}
+
 func fnProgn(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 	ebp := esp
 	args := assertNargsGte("progn", call, 0)
@@ -814,51 +1694,71 @@ func fnProgn(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 	}
 }
 
+// fnPush appends a value to a dynamic storage array and results in
+// that value, e.g.
+//
+// (push (caller) *holders*)
+func fnPush(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+	args := assertNargsGte("push", call, 2) // (push value variable path...)
+
+	variable := getStorage(s, args[1])
+
+	args[0].Accept(v, s, esp) // [VV]
+	esp += 1                  //  --> esp=1
+	v.addOp(vm.DUP1)          // [VV VV]
+	esp += 1                  //  --> esp=2
+
+	array := storagePlace(v, s, esp, variable, args[2:]) // [PP VV VV]
+	assertDynamicArray(call, array)
+
+	v.addOp(vm.DUP1)
+	v.addOp(vm.SLOAD) // [LL PP VV VV]
+	v.addOp(vm.DUP1)
+	v.pushU64(1)
+	v.addOp(vm.ADD) // [LL+1 LL PP VV VV]
+	v.addOp(vm.DUP3)
+	v.addOp(vm.SSTORE) // [LL PP VV VV], s[PP]=LL+1
+	v.addOp(vm.SWAP1)  // [PP LL VV VV]
+	v.arrayData(array.Type)
+
+	place := StoragePlace{
+		Type:    array.Type.Base,
+		Offset:  0,
+		Shifted: v.arrayElement(array.Type),
+	} // [SS VV VV] or [SS BITS VV VV]
+	v.storePlace(place) // [VV]
+}
+
+// assertDynamicArray panics unless the location holds a dynamic array
+// of value types.
+func assertDynamicArray(call Node, place StoragePlace) {
+	assertArray(call, place)
+
+	if !place.Type.IsDynamicArray() || place.Type.Base.Kind != StorageValue {
+		panic(NewCompilationError(
+			call.Origin,
+			fmt.Sprintf("%v: cannot resize %s", &call, place.Type.Name),
+		))
+	}
+}
+
 func fnPuthash(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 	args := assertNargsGte("puthash", call, 3) // (puthash table value keys...)
 
-	if !args[0].IsSymbol() {
-		panic("TODO")
-	}
-	table := args[0].ValueString
+	table := getStorage(s, args[0])
+	assertStorageKind(args[0], table, StorageMapping)
 
 	value := args[1]
 
-	pos, ok := s.GetStorageVariable(table)
-	if !ok {
-		panic("TODO, void variable")
-	}
-
-	value.Accept(v, s, esp) // [VV]
-	esp += 1                //  --> esp=1
-	v.addOp(vm.DUP1)        // [VV VV]
-	esp += 1                //  --> esp=2
-	v.pushU64(uint64(pos))  // [PP VV VV]
-	esp += 1                //  --> esp=3
-
-	for i := 2; i < len(args); i++ {
-		key := args[i]
-
-		v.pushU64(20)         // [20 PP VV VV]
-		esp += 1              //  --> esp=4
-		v.addOp(vm.MSTORE)    // [VV VV], m[20]=PP
-		esp -= 2              //  --> esp=2
-		key.Accept(v, s, esp) // [KK VV VV]
-		esp += 1              //  --> esp=3
-		v.pushU64(0)          // [00 KK VV VV]
-		esp += 1              //  --> esp=4
-		v.addOp(vm.MSTORE)    // [VV VV], m[00]=KK
-		esp -= 2              //  --> esp=2
-		v.pushU64(0x40)       // [40 VV VV]
-		esp += 1              //  --> esp=3
-		v.pushU64(0x00)       // [00 40 VV VV]
-		esp += 1              //  --> esp=4
-		v.addOp(vm.KECCAK256) // [HH VV VV]
-		esp -= 1              //  --> esp=3
-	}
-
-	v.addOp(vm.SSTORE) // [VV], s[HH]=VV
-	esp -= 2           //  --> esp=1
+	value.Accept(v, s, esp)                           // [VV]
+	esp += 1                                          //  --> esp=1
+	v.addOp(vm.DUP1)                                  // [VV VV]
+	esp += 1                                          //  --> esp=2
+	place := storagePlace(v, s, esp, table, args[2:]) // [HH VV VV]
+	esp += place.stackSize()                          //  --> esp=3
+	place.assertValue(call)
+	v.storePlace(place)          // [VV]
+	esp -= place.stackSize() + 1 //  --> esp=1
 }
 
 func fnReturn(v *BytecodeVisitor, s *Scope, esp int, call Node) {
@@ -868,45 +1768,12 @@ func fnReturn(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 	arg := args[0]
 
 	if arg.IsString() {
-		length := len(arg.ValueString)
-		hex := EncodeString(arg.ValueString)
-
-		// That's toooooooooooooooooooooo manual...
-		v.pushU64(0x60)              // [60]
-		esp += 1                     //
-		v.pushU64(freeMemoryPointer) // [FP 60]
-		esp += 1                     //
-		v.addOp(vm.MLOAD)            // [FM 60]
-		esp += 0                     //
-		v.pushU64(0x20)              // [20 FM 60]
-		esp += 1                     //
-		v.addOp(vm.DUP2)             // [FM 20 FM 60]
-		esp += 1                     //
-		v.addOp(vm.MSTORE)           // [FM 60], m[FM]=20
-		esp -= 2                     //
-		v.pushU64(uint64(length))    // [LN FM 60]
-		esp += 1                     //
-		v.addOp(vm.DUP2)             // [FM LN FM 60]
-		esp += 1                     //
-		v.pushU64(0x20)              // [20 FM LN FM 60]
-		esp += 1                     //
-		v.addOp(vm.ADD)              // [F2 LN FM 60]
-		esp -= 1                     //
-		v.addOp(vm.MSTORE)           // [FM 60], m[FM+20]=LN
-		esp -= 2                     //
-		v.addOp(vm.PUSH32)           //
-		v.addHex(hex)                // [ST FM 60]
-		esp += 1                     //
-		v.addOp(vm.DUP2)             // [FM ST FM 60]
-		esp += 1                     //
-		v.pushU64(0x40)              // [40 FM ST FM 60]
-		esp += 1                     //
-		v.addOp(vm.ADD)              // [F4 ST FM 60]
-		esp -= 1                     //
-		v.addOp(vm.MSTORE)           // [FM 60], m[FM+40]=ST
-		esp -= 2                     //
-		v.addOp(vm.RETURN)           // []
-		esp -= 2                     //
+		// Strings are returned ABI-encoded.
+		types := []abi.Type{{T: abi.StringTy}}
+		v.encodeABI(s, esp, types, args, "", call.Origin) // [PP SZ]
+		esp += 2                                          //
+		v.addOp(vm.RETURN)                                // []
+		esp -= 2                                          //
 	} else {
 		v.pushU64(0x20)              // [20]
 		esp += 1                     //
@@ -929,12 +1796,347 @@ func fnReturn(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 	}
 }
 
+// fnReturnABI ABI-encodes the given values according to the list of
+// types and returns them, e.g.
+//
+// (return-abi "(uint256,address,bool)" amount owner t)
+// (return-abi "(string)" "a string literal of any length")
+//
+// Dynamic values (string, bytes and arrays like uint256[]) are either
+// string literals or pointers to memory, where their length is
+// followed by the data, e.g. the result of (calldata-decode).
+func fnReturnABI(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+	ebp := esp
+
+	args := assertNargsGte("return-abi", call, 1)
+	types := parseTypeListArg(args[0])
+
+	v.encodeABI(s, esp, types, args[1:], "", call.Origin) // [PP SZ]
+	esp += 2                                              //
+	v.addOp(vm.RETURN)                                    // []
+	esp -= 2                                              //
+
+	if esp != ebp {
+		panic("broken invariant")
+	}
+}
+
+func parseTypeListArg(arg Node) []abi.Type {
+	if !arg.IsString() {
+		panic(NewCompilationError(
+			arg.Origin,
+			fmt.Sprintf("invalid list of types: want string, have %v", &arg),
+		))
+	}
+
+	types, err := ParseTypeList(arg.ValueString)
+	if err != nil {
+		panic(NewCompilationError(arg.Origin, err.Error()))
+	}
+
+	return types
+}
+
+// encodeABI ABI-encodes values of the given types into memory, starting
+// at the free memory pointer.  If selector (8 hexadecimal characters)
+// is given, it's prepended to the encoded data.  Leaves [PP SZ] on the
+// stack, where PP points to the encoded data and SZ is its size.  The
+// free memory pointer is not bumped.
+func (v *BytecodeVisitor) encodeABI(s *Scope, esp int, types []abi.Type, args []Node, selector string, origin Origin) {
+	ebp := esp
+
+	if len(types) != len(args) {
+		panic(NewCompilationError(
+			origin,
+			fmt.Sprintf("wrong number of values to encode: want %d, have %d", len(types), len(args)),
+		))
+	}
+
+	// String literals of dynamic types are encoded at compile
+	// time, everything else is evaluated and pushed on the stack.
+	literal := make([]bool, len(args))
+	for i := range args {
+		t := types[i]
+		if !IsSupportedType(t) {
+			panic(NewCompilationError(args[i].Origin, "unsupported type: "+t.String()))
+		}
+		literal[i] = args[i].IsString() && (t.T == abi.StringTy || t.T == abi.BytesTy)
+	}
+
+	// Evaluate values, the first one ends up on top.
+	for i := len(args) - 1; i >= 0; i-- {
+		if literal[i] {
+			continue
+		}
+		if args[i].IsString() && types[i].T == abi.FixedBytesTy {
+			// String literals of type bytesN are left-aligned.
+			v.addOp(vm.PUSH32)
+			v.addHex(padRight32(EncodeString(args[i].ValueString[:min(len(args[i].ValueString), 32)])))
+		} else {
+			args[i].Accept(v, s, esp)
+		}
+		esp += 1
+	} // [A0 A1...]
+
+	v.pushU64(freeMemoryPointer) // [FP A0 A1...]
+	esp += 1                     //
+	v.addOp(vm.MLOAD)            // [FM A0 A1...]
+	esp += 0                     //
+
+	// Store the selector, heads begin right after it.
+	if selector != "" {
+		v.addOp(vm.PUSH32)
+		v.addHex(padRight32(selector)) // [SL FM A0 A1...]
+		v.addOp(vm.DUP2)               // [FM SL FM A0 A1...]
+		v.addOp(vm.MSTORE)             // [FM A0 A1...]
+		v.pushU64(uint64(len(selector) / 2))
+		v.addOp(vm.ADD) // [BS A0 A1...], BS is the beginning of heads
+	}
+
+	v.addOp(vm.DUP1)                    // [BS BS A0 A1...]
+	esp += 1                            //
+	v.pushU64(uint64(0x20 * len(args))) //
+	v.addOp(vm.ADD)                     // [TL BS A0 A1...], TL is the tail
+	esp += 0                            //
+
+	for i := range args {
+		// Stack is [TL BS Ai...] or, if Ai is a literal, [TL BS].
+		t := types[i]
+
+		if !IsDynamicType(t) {
+			v.addOp(vm.DUP3) // [Ai TL BS Ai]
+			v.addOp(vm.DUP3) // [BS Ai TL BS Ai]
+			if i > 0 {
+				v.pushU64(uint64(0x20 * i))
+				v.addOp(vm.ADD) // [HD Ai TL BS Ai]
+			}
+			v.addOp(vm.MSTORE) // [TL BS Ai]
+			v.addOp(vm.SWAP2)  // [Ai BS TL]
+			v.addOp(vm.POP)    // [BS TL]
+			v.addOp(vm.SWAP1)  // [TL BS]
+			esp -= 1
+			continue
+		}
+
+		// Store the offset of the tail into the head.
+		v.addOp(vm.DUP2) // [BS TL BS]
+		v.addOp(vm.DUP2) // [TL BS TL BS]
+		v.addOp(vm.SUB)  // [OF TL BS]
+		v.addOp(vm.DUP3) // [BS OF TL BS]
+		if i > 0 {
+			v.pushU64(uint64(0x20 * i))
+			v.addOp(vm.ADD) // [HD OF TL BS]
+		}
+		v.addOp(vm.MSTORE) // [TL BS]
+
+		if literal[i] {
+			value := args[i].ValueString
+			encoded := EncodeString(value)
+
+			v.pushU64(uint64(len(value))) // [LN TL BS]
+			v.addOp(vm.DUP2)              // [TL LN TL BS]
+			v.addOp(vm.MSTORE)            // [TL BS]
+			for j := 0; j < len(encoded); j += 64 {
+				v.addOp(vm.PUSH32)
+				v.addHex(encoded[j : j+64]) // [WO TL BS]
+				v.addOp(vm.DUP2)            // [TL WO TL BS]
+				v.pushU64(uint64(0x20 + j/2))
+				v.addOp(vm.ADD)    // [TO WO TL BS]
+				v.addOp(vm.MSTORE) // [TL BS]
+			}
+			v.pushU64(uint64(0x20 + len(encoded)/2))
+			v.addOp(vm.ADD) // [TL BS]
+			continue
+		}
+
+		v.addOp(vm.DUP3)  // [PP TL BS PP]
+		v.addOp(vm.MLOAD) // [LN TL BS PP]
+		if t.T == abi.SliceTy {
+			v.pushU64(5)
+			v.addOp(vm.SHL) // [SZ TL BS PP]
+		}
+		v.addOp(vm.DUP1)   // [SZ SZ TL BS PP]
+		v.pushU64(0x1f)    //
+		v.addOp(vm.ADD)    //
+		v.pushU64(0x1f)    //
+		v.addOp(vm.NOT)    //
+		v.addOp(vm.AND)    // [RS SZ TL BS PP], RS is SZ rounded up
+		v.pushU64(0)       // [00 RS SZ TL BS PP]
+		v.addOp(vm.DUP4)   // [TL 00 RS SZ TL BS PP]
+		v.addOp(vm.DUP3)   // [RS TL 00 RS SZ TL BS PP]
+		v.addOp(vm.ADD)    //
+		v.addOp(vm.MSTORE) // [RS SZ TL BS PP], zero the padding
+		v.addOp(vm.SWAP1)  // [SZ RS TL BS PP]
+		v.pushU64(0x20)    //
+		v.addOp(vm.ADD)    // [S2 RS TL BS PP], S2=SZ+0x20
+		v.addOp(vm.DUP5)   // [PP S2 RS TL BS PP]
+		v.addOp(vm.DUP4)   // [TL PP S2 RS TL BS PP]
+		v.addOp(vm.MCOPY)  // [RS TL BS PP], m[TL:+S2]=m[PP:+S2]
+		v.pushU64(0x20)    //
+		v.addOp(vm.ADD)    //
+		v.addOp(vm.ADD)    // [TL BS PP], TL=TL+0x20+RS
+		v.addOp(vm.SWAP2)  // [PP BS TL]
+		v.addOp(vm.POP)    // [BS TL]
+		v.addOp(vm.SWAP1)  // [TL BS]
+		esp -= 1
+	}
+
+	// Stack is [TL BS].
+	v.addOp(vm.SWAP1) // [BS TL]
+	if selector != "" {
+		v.pushU64(uint64(len(selector) / 2))
+		v.addOp(vm.SWAP1)
+		v.addOp(vm.SUB) // [PP TL]
+	}
+	v.addOp(vm.SWAP1) // [TL PP]
+	v.addOp(vm.DUP2)  // [PP TL PP]
+	v.addOp(vm.SWAP1) // [TL PP PP]
+	v.addOp(vm.SUB)   // [SZ PP]
+	v.addOp(vm.SWAP1) // [PP SZ]
+
+	if esp != ebp+2 {
+		panic("broken invariant")
+	}
+}
+
+// encodePacked encodes values of the given types into memory the way
+// Solidity's abi.encodePacked does, i.e. static values take only as
+// many bytes as their type and string and bytes values are not
+// padded.  Like encodeABI, it leaves [PP SZ] on the stack and doesn't
+// bump the free memory pointer.
+func (v *BytecodeVisitor) encodePacked(s *Scope, esp int, types []abi.Type, args []Node, origin Origin) {
+	ebp := esp
+
+	if len(types) != len(args) {
+		panic(NewCompilationError(
+			origin,
+			fmt.Sprintf("wrong number of values to encode: want %d, have %d", len(types), len(args)),
+		))
+	}
+
+	literal := make([]bool, len(args))
+	for i := range args {
+		t := types[i]
+		if _, ok := elementarySize(t); !ok && t.T != abi.StringTy && t.T != abi.BytesTy {
+			panic(NewCompilationError(args[i].Origin, "unsupported type: "+t.String()))
+		}
+		literal[i] = args[i].IsString() && (t.T == abi.StringTy || t.T == abi.BytesTy)
+	}
+
+	// Evaluate values, the first one ends up on top.
+	for i := len(args) - 1; i >= 0; i-- {
+		if literal[i] {
+			continue
+		}
+		if args[i].IsString() && types[i].T == abi.FixedBytesTy {
+			// String literals of type bytesN are left-aligned.
+			v.addOp(vm.PUSH32)
+			v.addHex(padRight32(EncodeString(args[i].ValueString[:min(len(args[i].ValueString), 32)])))
+		} else {
+			args[i].Accept(v, s, esp)
+		}
+		esp += 1
+	} // [A0 A1...]
+
+	v.pushU64(freeMemoryPointer) // [FP A0 A1...]
+	v.addOp(vm.MLOAD)            // [FM A0 A1...]
+	v.addOp(vm.DUP1)             // [PT FM A0 A1...], PT is the cursor
+	esp += 2
+
+	for i := range args {
+		// Stack is [PT FM Ai...] or, if Ai is a literal, [PT FM].
+		t := types[i]
+
+		if literal[i] {
+			value := args[i].ValueString
+			encoded := EncodeString(value)
+			for j := 0; j < len(encoded); j += 64 {
+				v.addOp(vm.PUSH32)
+				v.addHex(encoded[j : j+64]) // [WO PT FM]
+				v.addOp(vm.DUP2)            // [PT WO PT FM]
+				if j > 0 {
+					v.pushU64(uint64(j / 2))
+					v.addOp(vm.ADD)
+				}
+				v.addOp(vm.MSTORE) // [PT FM]
+			}
+			if len(value) > 0 {
+				v.pushU64(uint64(len(value)))
+				v.addOp(vm.ADD) // [PT FM]
+			}
+			continue
+		}
+
+		if t.T == abi.StringTy || t.T == abi.BytesTy {
+			v.addOp(vm.SWAP2) // [PP FM PT]
+			v.addOp(vm.DUP1)  // [PP PP FM PT]
+			v.addOp(vm.MLOAD) // [LN PP FM PT]
+			v.addOp(vm.SWAP1) // [PP LN FM PT]
+			v.pushU64(0x20)   //
+			v.addOp(vm.ADD)   // [DA LN FM PT], DA is the data
+			v.addOp(vm.DUP2)  // [LN DA LN FM PT]
+			v.addOp(vm.SWAP1) // [DA LN LN FM PT]
+			v.addOp(vm.DUP5)  // [PT DA LN LN FM PT]
+			v.addOp(vm.MCOPY) // [LN FM PT], m[PT:+LN]=m[DA:+LN]
+			v.addOp(vm.DUP3)  // [PT LN FM PT]
+			v.addOp(vm.ADD)   // [PT' FM PT]
+			v.addOp(vm.SWAP2) // [PT FM PT']
+			v.addOp(vm.POP)   // [FM PT']
+			v.addOp(vm.SWAP1) // [PT' FM]
+			esp -= 1
+			continue
+		}
+
+		// Static values are written as whole words, the bytes past
+		// their size get overwritten by the next value or are left
+		// out.
+		size, _ := elementarySize(t)
+		v.addOp(vm.SWAP2) // [Ai FM PT]
+		if t.T != abi.FixedBytesTy && size < 32 {
+			v.pushU64(uint64(256 - 8*size))
+			v.addOp(vm.SHL) // [Ai FM PT], left-aligned
+		}
+		v.addOp(vm.DUP3)   // [PT Ai FM PT]
+		v.addOp(vm.MSTORE) // [FM PT]
+		v.addOp(vm.SWAP1)  // [PT FM]
+		v.pushU64(uint64(size))
+		v.addOp(vm.ADD) // [PT FM]
+		esp -= 1
+	}
+
+	v.addOp(vm.DUP2)  // [FM PT FM]
+	v.addOp(vm.SWAP1) // [PT FM FM]
+	v.addOp(vm.SUB)   // [SZ FM]
+	v.addOp(vm.SWAP1) // [PP SZ]
+
+	if esp != ebp+2 {
+		panic("broken invariant")
+	}
+}
+
 func fnRevert(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 	ebp := esp
 
-	args := assertNargsEq("revert", call, 1)
-	arg := args[0]
+	args := assertNargsGte("revert", call, 0)
+	if len(args) > 1 {
+		panic(NewCompilationError(
+			call.Origin,
+			fmt.Sprintf("wrong number of arguments for (revert): want at most 1, have %d", len(args)),
+		))
+	}
+
+	if len(args) == 0 {
+		// Revert with no data.
+		v.pushU64(0)       // [00]
+		esp += 1           //
+		v.addOp(vm.DUP1)   // [00 00]
+		esp += 1           //
+		v.addOp(vm.REVERT) // []
+		esp -= 2           //
+		return
+	}
 
+	arg := args[0]
 	if arg.IsString() {
 		encoded := EncodeWithSignature("Error(string)", arg.ValueString)
 
@@ -998,11 +2200,56 @@ func fnRevert(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 	}
 }
 
+// fnRevertWith reverts with a custom error declared with (deferror),
+// i.e. with its selector followed by the ABI-encoded values, e.g.
+//
+// (revert-with InsufficientBalance have want)
+func fnRevertWith(v *BytecodeVisitor, s *Scope, esp int, call Node) {
+	ebp := esp
+
+	args := assertNargsGte("revert-with", call, 1)
+	name := args[0]
+
+	if !name.IsSymbol() {
+		panic(NewCompilationError(
+			name.Origin,
+			fmt.Sprintf("invalid error name: want symbol, have %v", &name),
+		))
+	}
+
+	e, ok := s.GetError(name.ValueString)
+	if !ok {
+		panic(NewCompilationError(name.Origin, "void error: "+name.ValueString))
+	}
+
+	types := make([]abi.Type, len(e.Types))
+	for i := range e.Types {
+		t, err := ParseType(e.Types[i])
+		if err != nil {
+			panic(NewCompilationError(e.Origin, err.Error()))
+		}
+		types[i] = t
+	}
+
+	selector := keccak256Hex(e.Signature())[:8]
+	v.encodeABI(s, esp, types, args[1:], selector, call.Origin) // [PP SZ]
+	esp += 2                                                    //
+	v.addOp(vm.REVERT)                                          // []
+	esp -= 2                                                    //
+
+	if esp != ebp {
+		panic("broken invariant")
+	}
+}
+
 func fnSelector(v *BytecodeVisitor, _ *Scope, _ int, call Node) {
 	args := assertNargsEq("selector", call, 1)
 
 	if !args[0].IsString() {
-		panic("TODO")
+		panic(NewCompilationError(
+			args[0].Origin,
+			fmt.Sprintf("invalid signature: want string, have %v", &args[0]),
+		))
 	}
 
 	h := Keccak256Hash([]byte(args[0].ValueString))
@@ -1015,13 +2262,27 @@ func fnSetq(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 	args := assertNargsEq("setq", call, 2)
 
 	if !args[0].IsSymbol() {
-		panic("TODO")
+		panic(NewCompilationError(
+			args[0].Origin,
+			fmt.Sprintf("invalid variable name: want symbol, have %v", &args[0]),
+		))
 	}
 	identifier := args[0].ValueString
 
-	pos, ok := s.GetStorageVariable(identifier)
+	if immutable, ok := s.GetImmutable(identifier); ok {
+		args[1].Accept(v, s, esp) // [X]
+		esp += 1
+
+		v.storeImmutable(args[0], immutable) // [X]
+		return
+	}
+
+	variable, ok := s.GetStorageVariable(identifier)
 	if !ok {
-		panic("TODO, void variable")
+		panic(NewCompilationError(args[0].Origin, "void variable: "+identifier))
+	}
+	if variable.Type.Kind != StorageValue {
+		panic(NewCompilationError(args[0].Origin, fmt.Sprintf("cannot assign to %s", identifier)))
 	}
 
 	// Evaluate the expression and push to stack.
@@ -1031,12 +2292,8 @@ func fnSetq(v *BytecodeVisitor, s *Scope, esp int, call Node) {
 	v.addOp(vm.DUP1) // [X X]
 	esp += 1
 
-	// Push position.
-	v.pushU64(uint64(pos)) // [P X X]
-	esp += 1
-
-	v.addOp(vm.SSTORE) // [X]
-	esp -= 2
+	v.storeStorage(variable) // [X]
+	esp -= 1
 }
 
 // +----------------------+
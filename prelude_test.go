@@ -0,0 +1,278 @@
+package mist_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ydm/mist"
+)
+
+func pack(t *testing.T, types []string, values ...interface{}) []byte {
+	t.Helper()
+
+	args := make(abi.Arguments, len(types))
+	for i, s := range types {
+		typ, err := abi.NewType(s, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		args[i] = abi.Argument{Type: typ}
+	}
+
+	data, err := args.Pack(values...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestKeccak256(t *testing.T) {
+	t.Parallel()
+
+	const long = "a string literal that is definitely longer than a single word"
+
+	const program = `
+(defun words (a b) (keccak256 a b))
+(defun packed (owner nonce s)
+  (keccak256-packed "(address,uint96,string,bool,bytes2,int16)" owner nonce s t "ab" -2))
+(defun literal () (keccak256-packed "(string,uint8,string)" "` + long + `" 7 ""))
+(defun mem (s) (keccak256-mem (+ s 0x20) (memory-load s)))
+(defun empty () (keccak256))
+
+(dispatch
+ ("words(uint256,uint256)"        words)
+ ("packed(address,uint96,string)" packed)
+ ("literal()"                     literal)
+ ("mem(string)"                   mem)
+ ("empty()"                       empty))`
+
+	hello := "hello, this is a string that spans more than one word"
+	owner := common.HexToAddress("0xbeef")
+
+	cases := []struct {
+		calldata []byte
+		want     []byte
+	}{
+		{
+			encodeCall("words(uint256,uint256)", "01", "02"),
+			crypto.Keccak256(common.FromHex(fmt.Sprintf("%064x%064x", 1, 2))),
+		},
+		{
+			append(encodeCall("packed(address,uint96,string)"), pack(t, []string{"address", "uint96", "string"}, owner, big.NewInt(9), hello)...),
+			crypto.Keccak256(owner.Bytes(), common.FromHex(fmt.Sprintf("%024x", 9)), []byte(hello), []byte{1}, []byte("ab"), []byte{0xff, 0xfe}),
+		},
+		{
+			encodeCall("literal()"),
+			crypto.Keccak256([]byte(long), []byte{7}),
+		},
+		{
+			append(encodeCall("mem(string)"), pack(t, []string{"string"}, hello)...),
+			crypto.Keccak256([]byte(hello)),
+		},
+		{
+			encodeCall("empty()"),
+			crypto.Keccak256(),
+		},
+	}
+
+	for i, c := range cases {
+		have, err := execute(t, program, c.calldata)
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if !bytes.Equal(have, c.want) {
+			t.Errorf("case %d: have %x, want %x", i, have, c.want)
+		}
+	}
+}
+
+func TestLongStrings(t *testing.T) {
+	t.Parallel()
+
+	const long = "this string is definitely longer than thirty-two bytes"
+
+	const program = `
+(defun echo (s) (return-abi "(string)" s))
+(defun message () (return "` + long + `"))
+(defun fail () (revert "` + long + `"))
+(defun pass () (echo "` + long + `"))
+(defun short () (echo (memory-string "short")))
+(defun bound () (let ((s (memory-string "short"))) (return-abi "(string)" s)))
+(defun raw () (return-abi "(bytes)" #x"deadbeef"))
+
+(dispatch
+ ("message()" message)
+ ("fail()"    fail)
+ ("pass()"    pass)
+ ("short()"   short)
+ ("bound()"   bound)
+ ("raw()"     raw))`
+
+	cases := []struct {
+		calldata []byte
+		want     []byte
+		revert   bool
+	}{
+		{encodeCall("message()"), pack(t, []string{"string"}, long), false},
+		{encodeCall("fail()"), common.FromHex(mist.EncodeWithSignature("Error(string)", long)), true},
+		{encodeCall("pass()"), pack(t, []string{"string"}, long), false},
+		{encodeCall("short()"), pack(t, []string{"string"}, "short"), false},
+		{encodeCall("bound()"), pack(t, []string{"string"}, "short"), false},
+		{encodeCall("raw()"), pack(t, []string{"bytes"}, common.FromHex("deadbeef")), false},
+	}
+
+	for i, c := range cases {
+		have, err := execute(t, program, c.calldata)
+		if c.revert != (err != nil) {
+			t.Fatalf("case %d: have error %v, want revert %v", i, err, c.revert)
+		}
+		if !bytes.Equal(have, c.want) {
+			t.Errorf("case %d: have %x, want %x", i, have, c.want)
+		}
+	}
+}
+
+func TestReturnABI(t *testing.T) {
+	t.Parallel()
+
+	const long = "a string literal that is definitely longer than a single word"
+
+	const program = `
+(defun id (x) x)
+(defun tuple () (return-abi "(uint256,address,bool)" 7 0xdead t))
+(defun long () (return-abi "(string)" "` + long + `"))
+(defun pair (x s) (return-abi "(string,uint256,uint256[])" "" x s))
+(defun fixed () (return-abi "(bytes4,int8)" "abcd" -1))
+
+(dispatch
+ ("tuple()"                    tuple)
+ ("long()"                     long)
+ ("echo(string)"               id    :returns "(string)")
+ ("numbers(uint256[])"         id    :returns "(uint256[])")
+ ("pair(uint256,uint256[])"    pair)
+ ("fixed()"                    fixed))`
+
+	hello := "hello, this is a string that spans more than one word"
+	numbers := []*big.Int{big.NewInt(1), big.NewInt(2), big.NewInt(3)}
+
+	type testCase struct {
+		calldata []byte
+		want     []byte
+	}
+
+	cases := []testCase{
+		{
+			encodeCall("tuple()"),
+			pack(t, []string{"uint256", "address", "bool"}, big.NewInt(7), common.HexToAddress("0xdead"), true),
+		},
+		{
+			encodeCall("long()"),
+			pack(t, []string{"string"}, long),
+		},
+		{
+			append(encodeCall("echo(string)"), pack(t, []string{"string"}, hello)...),
+			pack(t, []string{"string"}, hello),
+		},
+		{
+			append(encodeCall("echo(string)"), pack(t, []string{"string"}, "")...),
+			pack(t, []string{"string"}, ""),
+		},
+		{
+			append(encodeCall("numbers(uint256[])"), pack(t, []string{"uint256[]"}, numbers)...),
+			pack(t, []string{"uint256[]"}, numbers),
+		},
+		{
+			append(encodeCall("pair(uint256,uint256[])"), pack(t, []string{"uint256", "uint256[]"}, big.NewInt(5), numbers)...),
+			pack(t, []string{"string", "uint256", "uint256[]"}, "", big.NewInt(5), numbers),
+		},
+		{
+			encodeCall("fixed()"),
+			pack(t, []string{"bytes4", "int8"}, [4]byte{'a', 'b', 'c', 'd'}, int8(-1)),
+		},
+	}
+
+	for i, c := range cases {
+		ret, err := execute(t, program, c.calldata)
+		if err != nil {
+			t.Errorf("case #%d: %v", i, err)
+			continue
+		}
+		if !bytes.Equal(ret, c.want) {
+			t.Errorf("case #%d: have %x, want %x", i, ret, c.want)
+		}
+	}
+
+	// A handler results in a single value.
+	invalid := `(defun tuple () 1) (dispatch ("tuple()" tuple :returns "(uint256,bool)"))`
+	if _, err := mist.CompileContract(invalid, t.Name(), mist.Options{Init: true}); err == nil {
+		t.Errorf("want error, have none: %s", invalid)
+	}
+}
+
+func TestRevertWith(t *testing.T) {
+	t.Parallel()
+
+	const program = `
+(deferror InsufficientBalance (uint256 uint256))
+(deferror Unauthorized ())
+(deferror Message (string address))
+
+(defun withdraw (x) (revert-with InsufficientBalance 10 x))
+(defun owner () (revert-with Unauthorized))
+(defun message () (revert-with Message "this message is longer than thirty-two bytes" 0xbeef))
+
+(dispatch
+ ("withdraw(uint256)" withdraw)
+ ("owner()"           owner)
+ ("message()"         message))`
+
+	selector := func(signature string) []byte {
+		h := mist.Keccak256Hash([]byte(signature))
+		return h[:4]
+	}
+
+	type testCase struct {
+		calldata []byte
+		want     []byte
+	}
+
+	cases := []testCase{
+		{
+			encodeCall("withdraw(uint256)", "2a"),
+			append(
+				selector("InsufficientBalance(uint256,uint256)"),
+				pack(t, []string{"uint256", "uint256"}, big.NewInt(10), big.NewInt(42))...,
+			),
+		},
+		{
+			encodeCall("owner()"),
+			selector("Unauthorized()"),
+		},
+		{
+			encodeCall("message()"),
+			append(
+				selector("Message(string,address)"),
+				pack(t, []string{"string", "address"}, "this message is longer than thirty-two bytes", common.HexToAddress("0xbeef"))...,
+			),
+		},
+	}
+
+	for i, c := range cases {
+		ret, err := execute(t, program, c.calldata)
+		if !errors.Is(err, vm.ErrExecutionReverted) {
+			t.Errorf("case #%d: want revert, have %v", i, err)
+			continue
+		}
+		if !bytes.Equal(ret, c.want) {
+			t.Errorf("case #%d: have %x, want %x", i, ret, c.want)
+		}
+	}
+}
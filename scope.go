@@ -1,6 +1,9 @@
 package mist
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // +-------+
 // | Scope |
@@ -77,6 +80,27 @@ func NewLispFunction(n Node) (LispFunction, error) {
 	}, nil
 }
 
+// CustomError is an error declared with (deferror).
+type CustomError struct {
+	Origin Origin
+	Name   string
+	Types  []string
+}
+
+// Signature returns the canonical signature of the error, e.g.
+// "InsufficientBalance(uint256,uint256)".
+func (e CustomError) Signature() string {
+	return fmt.Sprintf("%s(%s)", e.Name, strings.Join(e.Types, ","))
+}
+
+// Immutable is a value declared with (defimmutable), assigned in the
+// constructor and embedded into the deployed bytecode.
+type Immutable struct {
+	Origin     Origin
+	Identifier string
+	Index      int // In declaration order.
+}
+
 type StackVariable struct {
 	Origin     Origin
 	Identifier string
@@ -87,9 +111,17 @@ type Scope struct {
 	Constants     map[string]Node
 	Functions     map[string]LispFunction
 	CallAddresses map[string]int32
+	Errors        map[string]CustomError
+	Interfaces    map[string]Interface
+	Structs       map[string]StorageType
+	Immutables    map[string]Immutable
 
 	StackVariables   map[string]StackVariable
-	StorageVariables map[string]int32
+	StorageVariables map[string]StorageVariable
+
+	// Next free storage position, in bytes, i.e. 32*slot+offset.
+	// Used only in the global scope.
+	storagePosition uint64
 
 	Parent *Scope
 }
@@ -99,9 +131,13 @@ func NewScope(parent *Scope) *Scope {
 		Constants:     make(map[string]Node),
 		Functions:     make(map[string]LispFunction),
 		CallAddresses: make(map[string]int32),
+		Errors:        make(map[string]CustomError),
+		Interfaces:    make(map[string]Interface),
+		Structs:       make(map[string]StorageType),
+		Immutables:    make(map[string]Immutable),
 
 		StackVariables:   make(map[string]StackVariable),
-		StorageVariables: make(map[string]int32),
+		StorageVariables: make(map[string]StorageVariable),
 
 		Parent: parent,
 	}
@@ -147,6 +183,38 @@ func (s *Scope) GetCallAddress(identifier string) (int32, bool) {
 	return ptr, ok
 }
 
+func (s *Scope) GetError(identifier string) (CustomError, bool) {
+	e, ok := s.Errors[identifier]
+	if !ok && s.Parent != nil {
+		return s.Parent.GetError(identifier)
+	}
+	return e, ok
+}
+
+func (s *Scope) GetImmutable(identifier string) (Immutable, bool) {
+	immutable, ok := s.Immutables[identifier]
+	if !ok && s.Parent != nil {
+		return s.Parent.GetImmutable(identifier)
+	}
+	return immutable, ok
+}
+
+func (s *Scope) GetInterface(identifier string) (Interface, bool) {
+	iface, ok := s.Interfaces[identifier]
+	if !ok && s.Parent != nil {
+		return s.Parent.GetInterface(identifier)
+	}
+	return iface, ok
+}
+
+func (s *Scope) GetStruct(identifier string) (StorageType, bool) {
+	t, ok := s.Structs[identifier]
+	if !ok && s.Parent != nil {
+		return s.Parent.GetStruct(identifier)
+	}
+	return t, ok
+}
+
 func (s *Scope) GetStackVariable(identifier string) (StackVariable, bool) {
 	variable, ok := s.StackVariables[identifier]
 	if !ok && s.Parent != nil {
@@ -155,12 +223,12 @@ func (s *Scope) GetStackVariable(identifier string) (StackVariable, bool) {
 	return variable, ok
 }
 
-func (s *Scope) GetStorageVariable(identifier string) (int32, bool) {
-	pos, ok := s.StorageVariables[identifier]
+func (s *Scope) GetStorageVariable(identifier string) (StorageVariable, bool) {
+	variable, ok := s.StorageVariables[identifier]
 	if !ok && s.Parent != nil {
 		return s.Parent.GetStorageVariable(identifier)
 	}
-	return pos, ok
+	return variable, ok
 }
 
 // +---------+
@@ -169,16 +237,71 @@ func (s *Scope) GetStorageVariable(identifier string) (int32, bool) {
 
 func (s *Scope) Defconst(identifier string, value Node) {
 	if !value.IsConstant() {
-		panic(fmt.Sprintf("%v: %v is not constant", value.Origin, value))
+		panic(NewCompilationError(value.Origin, fmt.Sprintf("%v is not constant", value)))
 	}
 
 	if _, ok := s.GetConstant(identifier); ok {
-		panic(fmt.Sprintf("%v: constant %s is already defined", value.Origin, identifier))
+		panic(NewCompilationError(value.Origin, fmt.Sprintf("constant %s is already defined", identifier)))
 	}
 
 	s.Constants[identifier] = value
 }
 
+func (s *Scope) Deferror(e CustomError) {
+	if _, ok := s.GetError(e.Name); ok {
+		panic(NewCompilationError(e.Origin, fmt.Sprintf("error %s is already defined", e.Name)))
+	}
+
+	s.Errors[e.Name] = e
+}
+
+func (s *Scope) Defimmutable(origin Origin, identifier string) Immutable {
+	if !s.IsGlobal() {
+		panic(NewCompilationError(origin, "defimmutable can be used only globally"))
+	}
+
+	if _, ok := s.Immutables[identifier]; ok {
+		panic(NewCompilationError(origin, fmt.Sprintf("immutable %s is already defined", identifier)))
+	}
+	if _, ok := s.StorageVariables[identifier]; ok {
+		panic(NewCompilationError(origin, fmt.Sprintf("variable %s is already defined", identifier)))
+	}
+
+	immutable := Immutable{
+		Origin:     origin,
+		Identifier: identifier,
+		Index:      len(s.Immutables),
+	}
+	s.Immutables[identifier] = immutable
+
+	return immutable
+}
+
+func (s *Scope) Definterface(iface Interface) {
+	if !s.IsGlobal() {
+		panic(NewCompilationError(iface.Origin, "definterface can be used only globally"))
+	}
+
+	if _, ok := s.Interfaces[iface.Name]; ok {
+		panic(NewCompilationError(iface.Origin, fmt.Sprintf("interface %s is already defined", iface.Name)))
+	}
+
+	s.Interfaces[iface.Name] = iface
+}
+
+func (s *Scope) Defstruct(origin Origin, t StorageType) {
+	if !s.IsGlobal() {
+		panic(NewCompilationError(origin, "defstruct can be used only globally"))
+	}
+
+	name := t.StructName()
+	if _, ok := s.Structs[name]; ok {
+		panic(NewCompilationError(origin, fmt.Sprintf("struct %s is already defined", name)))
+	}
+
+	s.Structs[name] = t
+}
+
 func (s *Scope) Defun(fn LispFunction) {
 	s.Functions[fn.Name] = fn
 }
@@ -187,22 +310,44 @@ func (s *Scope) SetStackVariable(identifier string, variable StackVariable) {
 	s.StackVariables[identifier] = variable
 }
 
-func (s *Scope) SetStorageVariable(name string, position int32) {
-	if position < 0 {
-		panic("TODO")
+// Defvar allocates storage for a new variable in declaration order,
+// following Solidity's rules: values smaller than 32 bytes are packed
+// together into a slot as long as they fit, while mappings, arrays
+// and structs always start a new slot and are followed by a new slot.
+func (s *Scope) Defvar(origin Origin, identifier string, t StorageType) StorageVariable {
+	if !s.IsGlobal() {
+		panic(NewCompilationError(origin, "defvar can be used only globally"))
 	}
-	s.StorageVariables[name] = position
+
+	if _, ok := s.StorageVariables[identifier]; ok {
+		panic(NewCompilationError(origin, fmt.Sprintf("variable %s is already defined", identifier)))
+	}
+	if _, ok := s.Immutables[identifier]; ok {
+		panic(NewCompilationError(origin, fmt.Sprintf("immutable %s is already defined", identifier)))
+	}
+
+	slot, offset := allocateStorage(&s.storagePosition, &t)
+	variable := StorageVariable{
+		Origin:     origin,
+		Identifier: identifier,
+		Slot:       slot,
+		Offset:     offset,
+		Type:       t,
+	}
+	s.StorageVariables[identifier] = variable
+
+	return variable
 }
 
-func (s *Scope) SetCallAddress(identifier string, segmentID int32) {
+func (s *Scope) SetCallAddress(identifier string, segmentID int32, origin Origin) {
 	if segmentID <= 0 {
-		panic("TODO")
+		panic(NewCompilationError(origin, fmt.Sprintf("invalid address of function %s: %d", identifier, segmentID)))
 	}
 
 	// CallAddresses match Functions one-to-one.
 	if _, ok := s.Functions[identifier]; ok {
 		s.CallAddresses[identifier] = segmentID
 	} else {
-		s.Parent.SetCallAddress(identifier, segmentID)
+		s.Parent.SetCallAddress(identifier, segmentID, origin)
 	}
 }
@@ -0,0 +1,773 @@
+package mist
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/holiman/uint256"
+)
+
+// +-------------+
+// | StorageType |
+// +-------------+
+
+type StorageKind int
+
+const (
+	StorageValue   StorageKind = iota // Elementary types like uint8 or address.
+	StorageMapping                    // (mapping key value)
+	StorageArray                      // (array type) or (array type length)
+	StorageStruct                     // (defstruct name (field type)...)
+)
+
+// StorageType is the declared type of a storage variable, e.g. uint8
+// or (mapping address uint256).
+type StorageType struct {
+	Kind StorageKind
+	Name string // Solidity name, e.g. "mapping(address => uint256)".
+	Size int    // Number of bytes occupied, a multiple of 32 unless packed.
+
+	Elementary abi.Type          // Value types only.
+	Key        *StorageType      // Mappings only.
+	Value      *StorageType      // Mappings only.
+	Base       *StorageType      // Arrays only.
+	Length     uint64            // Arrays only, 0 if dynamically-sized.
+	Members    []StorageVariable // Structs only.
+}
+
+// maxArrayLength limits fixed-size arrays so that their size always
+// fits in an int.
+const maxArrayLength = 1 << 32
+
+// ParseStorageType parses a type declaration like uint256, bool,
+// (mapping address (mapping address uint256)), (array address) or
+// the name of a struct defined in scope s.
+func ParseStorageType(s *Scope, n Node) (StorageType, error) {
+	if n.IsSymbol() {
+		if t, ok := s.GetStruct(n.ValueString); ok {
+			return t, nil
+		}
+		t, err := ParseType(n.ValueString)
+		if err != nil {
+			return StorageType{}, NewCompilationError(n.Origin, err.Error())
+		}
+		size, ok := elementarySize(t)
+		if !ok {
+			return StorageType{}, NewCompilationError(
+				n.Origin,
+				fmt.Sprintf("unsupported storage type: %s", n.ValueString),
+			)
+		}
+		return StorageType{
+			Kind:       StorageValue,
+			Name:       t.String(),
+			Size:       size,
+			Elementary: t,
+			Key:        nil,
+			Value:      nil,
+			Base:       nil,
+			Length:     0,
+			Members:    nil,
+		}, nil
+	}
+
+	if n.IsFunctionCall("mapping") && n.NumChildren() == 3 {
+		key, err := ParseStorageType(s, n.Children[1])
+		if err != nil {
+			return StorageType{}, err
+		}
+		if key.Kind != StorageValue {
+			return StorageType{}, NewCompilationError(
+				n.Children[1].Origin,
+				fmt.Sprintf("invalid mapping key type: %v", &n.Children[1]),
+			)
+		}
+
+		value, err := ParseStorageType(s, n.Children[2])
+		if err != nil {
+			return StorageType{}, err
+		}
+
+		return StorageType{
+			Kind:       StorageMapping,
+			Name:       fmt.Sprintf("mapping(%s => %s)", key.Name, value.Name),
+			Size:       32,
+			Elementary: abi.Type{},
+			Key:        &key,
+			Value:      &value,
+			Base:       nil,
+			Length:     0,
+			Members:    nil,
+		}, nil
+	}
+
+	if n.IsFunctionCall("array") && n.NumChildren() <= 3 {
+		base, err := ParseStorageType(s, n.Children[1])
+		if err != nil {
+			return StorageType{}, err
+		}
+
+		if n.NumChildren() == 2 {
+			return StorageType{
+				Kind:       StorageArray,
+				Name:       base.Name + "[]",
+				Size:       32, // Just the length.
+				Elementary: abi.Type{},
+				Key:        nil,
+				Value:      nil,
+				Base:       &base,
+				Length:     0,
+				Members:    nil,
+			}, nil
+		}
+
+		length := n.Children[2]
+		if length.Type != NodeNumber || length.ValueNumber.IsZero() || length.ValueNumber.GtUint64(maxArrayLength) {
+			return StorageType{}, NewCompilationError(
+				length.Origin,
+				fmt.Sprintf("invalid array length: %v", &length),
+			)
+		}
+
+		// Packed elements share slots, others occupy whole slots.
+		// Either way the array as a whole occupies whole slots.
+		var (
+			count = length.ValueNumber.Uint64()
+			slots = count * base.slots()
+		)
+		if perSlot := base.perSlot(); perSlot > 1 {
+			slots = (count + perSlot - 1) / perSlot
+		}
+
+		return StorageType{
+			Kind:       StorageArray,
+			Name:       fmt.Sprintf("%s[%d]", base.Name, count),
+			Size:       int(32 * slots),
+			Elementary: abi.Type{},
+			Key:        nil,
+			Value:      nil,
+			Base:       &base,
+			Length:     count,
+			Members:    nil,
+		}, nil
+	}
+
+	return StorageType{}, NewCompilationError(n.Origin, fmt.Sprintf("invalid storage type: %v", &n))
+}
+
+// NewStructType lays out the members of a struct the same way
+// top-level storage variables are laid out, starting from slot 0.
+func NewStructType(origin Origin, name string, members []StorageVariable) StorageType {
+	if len(members) == 0 {
+		panic(NewCompilationError(origin, fmt.Sprintf("struct %s has no fields", name)))
+	}
+
+	var position uint64
+
+	seen := make(map[string]bool, len(members))
+	for i := range members {
+		member := &members[i]
+		if seen[member.Identifier] {
+			panic(NewCompilationError(
+				member.Origin,
+				fmt.Sprintf("duplicate field %s in struct %s", member.Identifier, name),
+			))
+		}
+		seen[member.Identifier] = true
+
+		member.Slot, member.Offset = allocateStorage(&position, &member.Type)
+	}
+
+	return StorageType{
+		Kind:       StorageStruct,
+		Name:       "struct " + name,
+		Size:       int((position + 31) / 32 * 32),
+		Elementary: abi.Type{},
+		Key:        nil,
+		Value:      nil,
+		Base:       nil,
+		Length:     0,
+		Members:    members,
+	}
+}
+
+// elementarySize returns the number of bytes a value of the given
+// elementary type occupies in storage.
+func elementarySize(t abi.Type) (int, bool) {
+	switch t.T {
+	case abi.UintTy, abi.IntTy:
+		return t.Size / 8, true
+	case abi.AddressTy:
+		return 20, true
+	case abi.BoolTy:
+		return 1, true
+	case abi.FixedBytesTy:
+		return t.Size, true
+	default:
+		return 0, false
+	}
+}
+
+// IsPacked tells whether values of this type occupy less than a whole
+// slot and may share it with other values.
+func (t *StorageType) IsPacked() bool {
+	return t.Kind == StorageValue && t.Size < 32
+}
+
+// IsDynamicArray tells whether this is an array whose length is
+// stored at its slot.
+func (t *StorageType) IsDynamicArray() bool {
+	return t.Kind == StorageArray && t.Length == 0
+}
+
+// StructName returns the name a struct was defined with.
+func (t *StorageType) StructName() string {
+	return strings.TrimPrefix(t.Name, "struct ")
+}
+
+// Member returns the member of a struct named by a keyword like
+// :owner.
+func (t *StorageType) Member(keyword Node) (*StorageVariable, bool) {
+	if !keyword.IsSymbol() || !strings.HasPrefix(keyword.ValueString, ":") {
+		return nil, false
+	}
+	for i := range t.Members {
+		if t.Members[i].Identifier == keyword.ValueString[1:] {
+			return &t.Members[i], true
+		}
+	}
+	return nil, false
+}
+
+// slots returns the number of slots occupied by a value of this type,
+// assuming it doesn't share them.
+func (t *StorageType) slots() uint64 {
+	return uint64(t.Size+31) / 32
+}
+
+// perSlot returns the number of array elements of this type that fit
+// in a single slot.
+func (t *StorageType) perSlot() uint64 {
+	if t.IsPacked() {
+		return 32 / uint64(t.Size)
+	}
+	return 1
+}
+
+// allocateStorage reserves room for a value of type t at position, the
+// next free storage position in bytes, i.e. 32*slot+offset, and
+// returns the slot and offset of the value.  Values smaller than 32
+// bytes are packed together into a slot as long as they fit, while
+// everything else starts a new slot and is followed by a new slot.
+func allocateStorage(position *uint64, t *StorageType) (uint64, int) {
+	const word = 32
+
+	offset := *position % word
+	if !t.IsPacked() || offset+uint64(t.Size) > word {
+		// Start a new slot.
+		*position += (word - offset) % word
+	}
+	slot, offset := *position/word, *position%word
+
+	*position += uint64(t.Size)
+	if !t.IsPacked() {
+		// Whatever follows starts a new slot too.
+		*position += (word - *position%word) % word
+	}
+
+	return slot, int(offset)
+}
+
+// +-----------------+
+// | StorageVariable |
+// +-----------------+
+
+type StorageVariable struct {
+	Origin     Origin
+	Identifier string
+	Slot       uint64
+	Offset     int // In bytes, from the least significant end of the slot.
+	Type       StorageType
+}
+
+// storageMask returns the bits occupied by a value of type t at the
+// given offset within its slot, e.g. 0xff00 for a uint8 at offset 1.
+func storageMask(t *StorageType, offset int) *uint256.Int {
+	ans := new(uint256.Int).Lsh(uint256.NewInt(1), uint(8*t.Size))
+	ans.SubUint64(ans, 1)
+	return ans.Lsh(ans, uint(8*offset))
+}
+
+// +-------------------+
+// | Storage functions |
+// +-------------------+
+
+// loadStorage pushes the value of a storage variable of a value type
+// onto the stack.
+func (v *BytecodeVisitor) loadStorage(sv StorageVariable) {
+	v.pushU64(sv.Slot)
+	v.loadSlot(&sv.Type, sv.Offset)
+}
+
+// storeStorage expects [XX ...] on the stack, pops XX and stores it
+// into a storage variable of a value type.
+func (v *BytecodeVisitor) storeStorage(sv StorageVariable) {
+	v.pushU64(sv.Slot)
+	v.storeSlot(&sv.Type, sv.Offset)
+}
+
+// loadSlot expects [SLOT ...] on the stack and replaces SLOT with the
+// value of type t found at the given offset within it.
+func (v *BytecodeVisitor) loadSlot(t *StorageType, offset int) {
+	v.addOp(vm.SLOAD) // [SS]
+
+	if !t.IsPacked() {
+		return
+	}
+
+	if offset > 0 {
+		v.pushU64(uint64(8 * offset))
+		v.addOp(vm.SHR)
+	}
+	v.unpack(t) // [XX]
+}
+
+// loadShifted is like loadSlot, but expects [SLOT BITS ...], where
+// BITS is the offset of the value within SLOT in bits.
+func (v *BytecodeVisitor) loadShifted(t *StorageType) {
+	v.addOp(vm.SLOAD) // [SS BITS]
+	v.addOp(vm.SWAP1) // [BITS SS]
+	v.addOp(vm.SHR)   // [SS']
+	v.unpack(t)       // [XX]
+}
+
+// storeSlot expects [SLOT XX ...] on the stack, pops both and stores
+// XX as a value of type t at the given offset within SLOT.  Packed
+// values are truncated to their size and the rest of the slot is
+// preserved.
+func (v *BytecodeVisitor) storeSlot(t *StorageType, offset int) {
+	if !t.IsPacked() {
+		v.addOp(vm.SSTORE) // []
+		return
+	}
+
+	v.addOp(vm.SWAP1) // [XX SLOT]
+	v.pack(t)         // [XX SLOT], cleaned up
+	if offset > 0 {
+		v.pushU64(uint64(8 * offset))
+		v.addOp(vm.SHL)
+	} // [VV SLOT], shifted into place
+
+	v.addOp(vm.DUP2)
+	v.addOp(vm.SLOAD) // [SS VV SLOT]
+	v.pushU256(new(uint256.Int).Not(storageMask(t, offset)))
+	v.addOp(vm.AND)    // [S' VV SLOT], S' has VV's bits cleared
+	v.addOp(vm.OR)     // [NS SLOT]
+	v.addOp(vm.SWAP1)  // [SLOT NS]
+	v.addOp(vm.SSTORE) // []
+}
+
+// storeShifted is like storeSlot, but expects [SLOT BITS XX ...],
+// where BITS is the offset of the value within SLOT in bits.
+func (v *BytecodeVisitor) storeShifted(t *StorageType) {
+	v.addOp(vm.SWAP2) // [XX BITS SLOT]
+	v.pack(t)         // [XX BITS SLOT], cleaned up
+	v.addOp(vm.DUP2)
+	v.addOp(vm.SHL)   // [VV BITS SLOT], shifted into place
+	v.addOp(vm.SWAP1) // [BITS VV SLOT]
+	v.pushU256(storageMask(t, 0))
+	v.addOp(vm.SWAP1)
+	v.addOp(vm.SHL) // [MM VV SLOT]
+	v.addOp(vm.NOT)
+	v.addOp(vm.DUP3)
+	v.addOp(vm.SLOAD)  // [SS ~MM VV SLOT]
+	v.addOp(vm.AND)    // [S' VV SLOT], S' has VV's bits cleared
+	v.addOp(vm.OR)     // [NS SLOT]
+	v.addOp(vm.SWAP1)  // [SLOT NS]
+	v.addOp(vm.SSTORE) // []
+}
+
+// unpack converts a packed value of type t, found in the lowest bytes
+// of the word on top of the stack, to its stack representation: high
+// bits are cleared, signed integers are sign extended and bytesN are
+// left-aligned.
+func (v *BytecodeVisitor) unpack(t *StorageType) {
+	v.pushU256(storageMask(t, 0))
+	v.addOp(vm.AND)
+
+	switch t.Elementary.T {
+	case abi.IntTy:
+		v.pushU64(uint64(t.Size - 1))
+		v.addOp(vm.SIGNEXTEND)
+	case abi.FixedBytesTy:
+		v.pushU64(uint64(256 - 8*t.Size))
+		v.addOp(vm.SHL)
+	}
+}
+
+// pack is the inverse of unpack: it truncates the value on top of the
+// stack to the lowest t.Size bytes.  Booleans become 0 or 1 and bytesN
+// keep only their leading bytes.
+func (v *BytecodeVisitor) pack(t *StorageType) {
+	switch t.Elementary.T {
+	case abi.BoolTy:
+		v.addOp(vm.ISZERO)
+		v.addOp(vm.ISZERO)
+	case abi.FixedBytesTy:
+		v.pushU64(uint64(256 - 8*t.Size))
+		v.addOp(vm.SHR)
+	default:
+		v.pushU256(storageMask(t, 0))
+		v.addOp(vm.AND)
+	}
+}
+
+// cleanKey converts the value on top of the stack to the canonical
+// form of the value type t, the way Solidity does before hashing a
+// mapping key: dirty high bits are cleared, signed integers are sign
+// extended, booleans become 0 or 1 and bytesN keep only their leading
+// bytes.
+func (v *BytecodeVisitor) cleanKey(t *StorageType) {
+	if t.Size >= 32 {
+		return
+	}
+
+	switch t.Elementary.T {
+	case abi.BoolTy:
+		v.addOp(vm.ISZERO)
+		v.addOp(vm.ISZERO)
+	case abi.IntTy:
+		v.pushU64(uint64(t.Size - 1))
+		v.addOp(vm.SIGNEXTEND)
+	case abi.FixedBytesTy:
+		v.pushU256(new(uint256.Int).Lsh(storageMask(t, 0), uint(256-8*t.Size)))
+		v.addOp(vm.AND)
+	default:
+		v.pushU256(storageMask(t, 0))
+		v.addOp(vm.AND)
+	}
+}
+
+// +----------------+
+// | Storage access |
+// +----------------+
+
+// StoragePlace is a location in storage that holds a value of Type.
+// Its slot is computed at runtime and, unless Shifted is set, the
+// offset within the slot is known at compile time.
+type StoragePlace struct {
+	Type    *StorageType
+	Offset  int  // In bytes, if not Shifted.
+	Shifted bool // The offset in bits is on the stack below the slot.
+}
+
+// storagePlace pushes the location of the part of a storage variable
+// selected by path, which consists of keys for mappings, indices for
+// arrays and keywords like :owner for struct fields.  It leaves [SLOT]
+// or, for packed array elements, [SLOT BITS] on the stack.
+//
+// Locations are derived the way Solidity does it: m[k] is at
+// keccak256(k . p), where p is the slot of m and k is cleaned up and
+// padded to 32 bytes; the elements of a dynamic array start at
+// keccak256(p), where its length is stored, while fixed-size arrays
+// and structs are laid out in place.  Array indices are checked
+// against the length and out-of-bounds access panics.
+func storagePlace(v *BytecodeVisitor, s *Scope, esp int, variable StorageVariable, path []Node) StoragePlace {
+	ebp := esp
+
+	place := StoragePlace{
+		Type:    &variable.Type,
+		Offset:  variable.Offset,
+		Shifted: false,
+	}
+
+	v.pushU64(variable.Slot) // [PP]
+	esp += 1                 //  --> esp=ebp+1
+
+	for _, node := range path {
+		t := place.Type
+		if place.Shifted || t.Kind == StorageValue {
+			panic(NewCompilationError(
+				node.Origin,
+				fmt.Sprintf("invalid access to %s: %s has no elements", variable.Identifier, t.Name),
+			))
+		}
+
+		switch t.Kind {
+		case StorageMapping:
+			// The key is evaluated first, it may use the scratch
+			// space itself, e.g. in a nested (gethash).
+			node.Accept(v, s, esp) // [KK PP]
+			esp += 1               //  --> esp=ebp+2
+			v.cleanKey(t.Key)      // [KK PP], cleaned up
+			v.pushU64(0x00)        // [00 KK PP]
+			esp += 1               //  --> esp=ebp+3
+			v.addOp(vm.MSTORE)     // [PP], m[00]=KK
+			esp -= 2               //  --> esp=ebp+1
+			v.pushU64(0x20)        // [20 PP]
+			esp += 1               //  --> esp=ebp+2
+			v.addOp(vm.MSTORE)     // [], m[20]=PP
+			esp -= 2               //  --> esp=ebp
+			v.pushU64(0x40)        // [40]
+			esp += 1               //  --> esp=ebp+1
+			v.pushU64(0x00)        // [00 40]
+			esp += 1               //  --> esp=ebp+2
+			v.addOp(vm.KECCAK256)  // [HH]
+			esp -= 1               //  --> esp=ebp+1
+
+			place = StoragePlace{Type: t.Value, Offset: 0, Shifted: false}
+
+		case StorageArray:
+			node.Accept(v, s, esp) // [II PP]
+			esp += 1               //  --> esp=ebp+2
+			if t.IsDynamicArray() {
+				v.addOp(vm.DUP2)
+				v.addOp(vm.SLOAD) // [LL II PP]
+			} else {
+				v.pushU64(t.Length) // [LL II PP]
+			}
+			v.addOp(vm.DUP2)             // [II LL II PP]
+			v.addOp(vm.LT)               // [II<LL II PP]
+			v.panicUnless(panicIndex)    // [II PP]
+			v.addOp(vm.SWAP1)            // [PP II]
+			v.arrayData(t)               // [BB II]
+			shifted := v.arrayElement(t) // [SS] or [SS BITS]
+			if !shifted {
+				esp -= 1 //  --> esp=ebp+1
+			}
+
+			place = StoragePlace{Type: t.Base, Offset: 0, Shifted: shifted}
+
+		case StorageStruct:
+			member, ok := t.Member(node)
+			if !ok {
+				panic(NewCompilationError(
+					node.Origin,
+					fmt.Sprintf("invalid access to %s: %s has no field %v", variable.Identifier, t.Name, &node),
+				))
+			}
+			if member.Slot > 0 {
+				v.pushU64(member.Slot)
+				v.addOp(vm.ADD) // [SS]
+			}
+
+			place = StoragePlace{Type: &member.Type, Offset: member.Offset, Shifted: false}
+		}
+	}
+
+	if esp != ebp+place.stackSize() {
+		panic("broken invariant")
+	}
+
+	return place
+}
+
+// stackSize returns the number of stack items that make up the
+// location.
+func (p StoragePlace) stackSize() int {
+	if p.Shifted {
+		return 2
+	}
+	return 1
+}
+
+// assertValue panics unless the location holds a value type, i.e.
+// something that fits on the stack.
+func (p StoragePlace) assertValue(call Node) {
+	if p.Type.Kind != StorageValue {
+		panic(NewCompilationError(
+			call.Origin,
+			fmt.Sprintf("%v of type %s cannot be used as a value", &call, p.Type.Name),
+		))
+	}
+}
+
+// loadPlace replaces the location on top of the stack with the value
+// it holds.
+func (v *BytecodeVisitor) loadPlace(p StoragePlace) {
+	if p.Shifted {
+		v.loadShifted(p.Type)
+	} else {
+		v.loadSlot(p.Type, p.Offset)
+	}
+}
+
+// storePlace expects the location on top of the stack, followed by a
+// value, and pops both, storing the value at the location.
+func (v *BytecodeVisitor) storePlace(p StoragePlace) {
+	if p.Shifted {
+		v.storeShifted(p.Type)
+	} else {
+		v.storeSlot(p.Type, p.Offset)
+	}
+}
+
+// arrayData expects [PP ...], the slot of an array of type t, and
+// replaces it with the slot of its first element.
+func (v *BytecodeVisitor) arrayData(t *StorageType) {
+	if !t.IsDynamicArray() {
+		return
+	}
+
+	v.pushU64(0x00)
+	v.addOp(vm.MSTORE) // [], m[00]=PP
+	v.pushU64(0x20)
+	v.pushU64(0x00)
+	v.addOp(vm.KECCAK256) // [BB]
+}
+
+// arrayElement expects [BB II ...], the slot of the first element of
+// an array of type t and an index, and replaces them with the location
+// of the element at that index.  Packed elements that share slots are
+// located by [SS BITS], in which case the returned value is true.
+func (v *BytecodeVisitor) arrayElement(t *StorageType) bool {
+	perSlot := t.Base.perSlot()
+
+	if perSlot == 1 {
+		v.addOp(vm.SWAP1) // [II BB]
+		if slots := t.Base.slots(); slots > 1 {
+			v.pushU64(slots)
+			v.addOp(vm.MUL)
+		}
+		v.addOp(vm.ADD) // [SS]
+		return false
+	}
+
+	v.addOp(vm.DUP2) // [II BB II]
+	v.pushU64(perSlot)
+	v.addOp(vm.SWAP1)
+	v.addOp(vm.DIV)   // [II/N BB II]
+	v.addOp(vm.ADD)   // [SS II]
+	v.addOp(vm.SWAP1) // [II SS]
+	v.pushU64(perSlot)
+	v.addOp(vm.SWAP1)
+	v.addOp(vm.MOD) // [II%N SS]
+	v.pushU64(uint64(8 * t.Base.Size))
+	v.addOp(vm.MUL)   // [BITS SS]
+	v.addOp(vm.SWAP1) // [SS BITS]
+	return true
+}
+
+// +---------------+
+// | StorageLayout |
+// +---------------+
+
+// StorageLayout describes where storage variables live, in the same
+// JSON format solc uses for its storageLayout output.
+type StorageLayout struct {
+	Storage []StorageLayoutEntry         `json:"storage"`
+	Types   map[string]StorageLayoutType `json:"types"`
+}
+
+type StorageLayoutEntry struct {
+	AstID    int    `json:"astId"`
+	Contract string `json:"contract"`
+	Label    string `json:"label"`
+	Offset   int    `json:"offset"`
+	Slot     string `json:"slot"`
+	Type     string `json:"type"`
+}
+
+type StorageLayoutType struct {
+	Encoding      string               `json:"encoding"`
+	Label         string               `json:"label"`
+	NumberOfBytes string               `json:"numberOfBytes"`
+	Key           string               `json:"key,omitempty"`
+	Value         string               `json:"value,omitempty"`
+	Base          string               `json:"base,omitempty"`
+	Members       []StorageLayoutEntry `json:"members,omitempty"`
+}
+
+// ID returns the identifier solc uses for the type, e.g. "t_uint256",
+// "t_mapping(t_address,t_uint256)" or "t_array(t_address)dyn_storage".
+// Unlike solc, struct identifiers don't include an AST id.
+func (t *StorageType) ID() string {
+	switch t.Kind {
+	case StorageMapping:
+		return fmt.Sprintf("t_mapping(%s,%s)", t.Key.ID(), t.Value.ID())
+	case StorageArray:
+		if t.IsDynamicArray() {
+			return fmt.Sprintf("t_array(%s)dyn_storage", t.Base.ID())
+		}
+		return fmt.Sprintf("t_array(%s)%d_storage", t.Base.ID(), t.Length)
+	case StorageStruct:
+		return fmt.Sprintf("t_struct(%s)_storage", t.StructName())
+	default:
+		return "t_" + t.Name
+	}
+}
+
+// NewStorageLayout describes the storage variables of the given
+// (global) scope in declaration order.  Source is used in place of
+// the contract name.
+func NewStorageLayout(s *Scope, source string) StorageLayout {
+	variables := make([]StorageVariable, 0, len(s.StorageVariables))
+	for _, variable := range s.StorageVariables {
+		variables = append(variables, variable)
+	}
+	// Variables are allocated in declaration order.
+	sort.Slice(variables, func(i, j int) bool {
+		a, b := variables[i], variables[j]
+		return a.Slot < b.Slot || (a.Slot == b.Slot && a.Offset < b.Offset)
+	})
+
+	layout := StorageLayout{
+		Storage: nil,
+		Types:   make(map[string]StorageLayoutType),
+	}
+	layout.Storage = layout.addEntries(variables, source)
+
+	return layout
+}
+
+// addEntries describes variables, or struct members, and their types.
+func (l *StorageLayout) addEntries(variables []StorageVariable, source string) []StorageLayoutEntry {
+	entries := make([]StorageLayoutEntry, len(variables))
+	for i, variable := range variables {
+		entries[i] = StorageLayoutEntry{
+			AstID:    i,
+			Contract: source,
+			Label:    variable.Identifier,
+			Offset:   variable.Offset,
+			Slot:     strconv.FormatUint(variable.Slot, 10),
+			Type:     variable.Type.ID(),
+		}
+		l.addType(&variable.Type, source)
+	}
+	return entries
+}
+
+func (l *StorageLayout) addType(t *StorageType, source string) {
+	entry := StorageLayoutType{
+		Encoding:      "inplace",
+		Label:         t.Name,
+		NumberOfBytes: strconv.Itoa(t.Size),
+		Key:           "",
+		Value:         "",
+		Base:          "",
+		Members:       nil,
+	}
+
+	switch t.Kind {
+	case StorageMapping:
+		entry.Encoding = "mapping"
+		entry.Key = t.Key.ID()
+		entry.Value = t.Value.ID()
+		l.addType(t.Key, source)
+		l.addType(t.Value, source)
+	case StorageArray:
+		if t.IsDynamicArray() {
+			entry.Encoding = "dynamic_array"
+		}
+		entry.Base = t.Base.ID()
+		l.addType(t.Base, source)
+	case StorageStruct:
+		entry.Members = l.addEntries(t.Members, source)
+	}
+
+	l.Types[t.ID()] = entry
+}
@@ -0,0 +1,545 @@
+package mist_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/go-cmp/cmp"
+	"github.com/holiman/uint256"
+	"github.com/ydm/mist"
+)
+
+func TestStoragePacking(t *testing.T) {
+	t.Parallel()
+
+	const program = `
+(defvar *a* uint8)
+(defvar *b* bool)
+(defvar *c* address)
+(defvar *d* uint256)
+(defvar *e* int16)
+(defvar *f* bytes4)
+(defvar *m* (mapping address uint256))
+(defvar *g* uint128)
+(defvar *h* uint128)
+(defvar *i* uint8)
+
+(setq *a* 0x1ff)
+(setq *b* 7)
+(setq *c* 0xdead)
+(setq *d* 0x1234)
+(setq *e* -2)
+(setq *f* (<< 0x61626364 224))
+(setq *g* 0x11)
+(setq *h* 0x22)
+(setq *i* 0x33)
+(setq *b* nil)
+
+(return-abi "(uint8,bool,address,uint256,int16,bytes4,uint128,uint128,uint8)"
+            *a* *b* *c* *d* *e* *f* *g* *h* *i*)`
+
+	ret, db, err := executeWithState(t, program, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := pack(t,
+		[]string{"uint8", "bool", "address", "uint256", "int16", "bytes4", "uint128", "uint128", "uint8"},
+		uint8(0xff), false, common.HexToAddress("0xdead"), big.NewInt(0x1234), int16(-2),
+		[4]byte{'a', 'b', 'c', 'd'}, big.NewInt(0x11), big.NewInt(0x22), uint8(0x33),
+	)
+	if !bytes.Equal(ret, want) {
+		t.Errorf("have %x, want %x", ret, want)
+	}
+
+	slots := []string{
+		"0xdead00ff",                           // a, b and c
+		"0x1234",                               // d
+		"0x61626364fffe",                       // e and f
+		"0x0",                                  // m
+		"0x2200000000000000000000000000000011", // g and h
+		"0x33",                                 // i
+	}
+	for i, slot := range slots {
+		have := db.GetState(contractAddress, common.BigToHash(big.NewInt(int64(i))))
+		if want := uint256.MustFromHex(slot); !new(uint256.Int).SetBytes(have[:]).Eq(want) {
+			t.Errorf("slot %d: have %x, want %s", i, have, slot)
+		}
+	}
+}
+
+func TestStorageMapping(t *testing.T) {
+	t.Parallel()
+
+	const program = `
+(defvar *zero*       (mapping uint256 uint256))
+(defvar *balances*   (mapping address uint256))
+(defvar *allowances* (mapping address (mapping address uint256)))
+(defvar *flags*      (mapping int8 bool))
+(defvar *tags*       (mapping bytes4 uint8))
+
+(puthash *zero*       0x11  0)
+(puthash *balances*   0x22  0xdead)
+(puthash *allowances* 0x33  0xaaaa 0xbbbb)
+(puthash *flags*      7     -1)
+(puthash *tags*       0x1ff (<< 0x61626364 224))
+
+;; Keys are cleaned up before hashing, so dirty bits don't matter.
+(return-abi "(uint256,uint256,uint256,bool,uint8)"
+            (gethash *zero* 0)
+            (gethash *balances* (| 0xdead (<< 1 160)))
+            (gethash *allowances* 0xaaaa 0xbbbb)
+            (gethash *flags* 0xff)
+            (gethash *tags* (| (<< 0x61626364 224) 0xff)))`
+
+	ret, db, err := executeWithState(t, program, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := pack(t,
+		[]string{"uint256", "uint256", "uint256", "bool", "uint8"},
+		big.NewInt(0x11), big.NewInt(0x22), big.NewInt(0x33), true, uint8(0xff),
+	)
+	if !bytes.Equal(ret, want) {
+		t.Errorf("have %x, want %x", ret, want)
+	}
+
+	// slot computes the location of m[key] the way Solidity does,
+	// where p is the slot of m.
+	slot := func(key, p common.Hash) common.Hash {
+		return crypto.Keccak256Hash(key[:], p[:])
+	}
+	number := func(x int64) common.Hash {
+		return common.BigToHash(big.NewInt(x))
+	}
+
+	cases := []struct {
+		slot common.Hash
+		want int64
+	}{
+		// keccak256(uint256(0) . uint256(0)), as computed by solc
+		// for mapping(uint256 => uint256) at slot 0.
+		{common.HexToHash("0xad3228b676f7d3cd4284a5443f17f1962b36e491b30a40b2405849e597ba5fb5"), 0x11},
+		{slot(number(0xdead), number(1)), 0x22},
+		{slot(number(0xbbbb), slot(number(0xaaaa), number(2))), 0x33},
+		{slot(common.HexToHash("0x"+strings.Repeat("ff", 32)), number(3)), 1},
+		{slot(common.BytesToHash(common.RightPadBytes([]byte("abcd"), 32)), number(4)), 0xff},
+	}
+	for i, c := range cases {
+		have := db.GetState(contractAddress, c.slot)
+		if want := number(c.want); have != want {
+			t.Errorf("case %d: slot %x: have %x, want %x", i, c.slot, have, want)
+		}
+	}
+}
+
+func TestStorageMappingNestedKey(t *testing.T) {
+	t.Parallel()
+
+	// The key uses the scratch space as well.
+	const program = `
+(defvar *a* (mapping uint256 uint256))
+(defvar *b* (mapping uint256 uint256))
+
+(puthash *b* 7 1)
+(puthash *a* 99 7)
+(return (gethash *a* (gethash *b* 1)))`
+
+	ret, err := execute(t, program, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := word(ret); !have.Eq(uint256.NewInt(0x63)) {
+		t.Errorf("have %v, want 0x63", have)
+	}
+}
+
+func TestStorageArrays(t *testing.T) {
+	t.Parallel()
+
+	const program = `
+(defvar *holders* (array address))
+(defvar *small*   (array uint8))
+(defvar *fixed*   (array uint128 3))
+(defvar *after*   uint8)
+(defvar *orders*  (mapping address (array uint256)))
+
+(push 0xaa *holders*)
+(push 0xbb *holders*)
+(push 0xcc *holders*)
+
+(push 1     *small*)
+(push 0x102 *small*)
+(push 3     *small*)
+(aset *small* 1 0x22)
+
+(aset *fixed* 2 0x33)
+(aset *fixed* 0 0x11)
+(setq *after* 0x44)
+
+(push 5 *orders* 0xabc)
+
+(let ((popped (pop *holders*)))
+  (return-abi "(address,address,uint256,uint256,uint8,uint8,uint256,uint128,uint128,uint256,uint256)"
+              popped
+              (aref *holders* 1)
+              (length *holders*)
+              (length *small*)
+              (aref *small* 1)
+              (aref *small* 2)
+              (length *fixed*)
+              (aref *fixed* 2)
+              (aref *fixed* 1)
+              (length *orders* 0xabc)
+              (gethash *orders* 0xabc 0)))`
+
+	ret, db, err := executeWithState(t, program, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := pack(t,
+		[]string{"address", "address", "uint256", "uint256", "uint8", "uint8", "uint256", "uint128", "uint128", "uint256", "uint256"},
+		common.HexToAddress("0xcc"), common.HexToAddress("0xbb"), big.NewInt(2),
+		big.NewInt(3), uint8(0x22), uint8(3),
+		big.NewInt(3), big.NewInt(0x33), big.NewInt(0),
+		big.NewInt(1), big.NewInt(5),
+	)
+	if !bytes.Equal(ret, want) {
+		t.Errorf("have %x, want %x", ret, want)
+	}
+
+	// The elements of a dynamic array at slot p start at
+	// keccak256(p), just like in Solidity.
+	data := func(p common.Hash) *big.Int {
+		return new(big.Int).SetBytes(crypto.Keccak256(p[:]))
+	}
+	number := func(x int64) common.Hash {
+		return common.BigToHash(big.NewInt(x))
+	}
+	element := func(p common.Hash, i int64) common.Hash {
+		return common.BigToHash(new(big.Int).Add(data(p), big.NewInt(i)))
+	}
+	orders := crypto.Keccak256Hash(number(0xabc).Bytes(), number(5).Bytes())
+
+	cases := []struct {
+		slot common.Hash
+		want string
+	}{
+		{number(0), "0x2"},              // length of *holders*
+		{element(number(0), 0), "0xaa"}, //
+		{element(number(0), 1), "0xbb"}, //
+		{element(number(0), 2), "0x0"},  // popped
+		{number(1), "0x3"},              // length of *small*
+		{element(number(1), 0), "0x32201"},
+		{number(2), "0x11"}, // *fixed*[0] and *fixed*[1]
+		{number(3), "0x33"}, // *fixed*[2]
+		{number(4), "0x44"}, // *after*
+		{number(5), "0x0"},  // *orders*
+		{orders, "0x1"},
+		{element(orders, 0), "0x5"},
+	}
+	for i, c := range cases {
+		have := db.GetState(contractAddress, c.slot)
+		if want := uint256.MustFromHex(c.want); !new(uint256.Int).SetBytes(have[:]).Eq(want) {
+			t.Errorf("case %d: slot %x: have %x, want %s", i, c.slot, have, c.want)
+		}
+	}
+}
+
+func TestStorageNestedKeys(t *testing.T) {
+	t.Parallel()
+
+	// Every mapping path is used with a key that is itself read from
+	// a mapping.
+	const program = `
+(defvar *n*      (mapping uint256 uint256))
+(defvar *m*      (mapping uint256 uint256))
+(defvar *orders* (mapping uint256 (array uint256)))
+(defvar *a*      (array uint256))
+
+(puthash *n* 5 1)
+(puthash *n* 1 2)
+(puthash *m* 0x11 (gethash *n* 1))
+(push 0x22 *orders* (gethash *n* 1))
+(push 0x33 *orders* (gethash *n* 1))
+(push 0x55 *a*)
+(push 0x66 *a*)
+(aset *a* (gethash *n* 2) 0x44)
+(puthash *m* (pop *orders* (gethash *n* 1)) 9)
+
+(return-abi "(uint256,uint256,uint256,uint256,uint256)"
+            (gethash *m* (gethash *n* 1))
+            (gethash *m* 5)
+            (aref *a* (gethash *n* 2))
+            (gethash *m* 9)
+            (length *orders* (gethash *n* 1)))`
+
+	ret, err := execute(t, program, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := pack(t,
+		[]string{"uint256", "uint256", "uint256", "uint256", "uint256"},
+		big.NewInt(0x11), big.NewInt(0x11), big.NewInt(0x44), big.NewInt(0x33), big.NewInt(1),
+	)
+	if !bytes.Equal(ret, want) {
+		t.Errorf("have %x, want %x", ret, want)
+	}
+}
+
+func TestStorageArraysPanic(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		program string
+		code    uint64
+	}{
+		{"(defvar *a* (array uint256)) (aref *a* 0)", 0x32},
+		{"(defvar *a* (array uint256)) (push 1 *a*) (aref *a* 1)", 0x32},
+		{"(defvar *a* (array uint8 4)) (aset *a* 4 1)", 0x32},
+		{"(defvar *a* (array uint256)) (pop *a*)", 0x31},
+		{"(defvar *a* (array uint8)) (push 1 *a*) (pop *a*) (pop *a*)", 0x31},
+	}
+
+	for i, c := range cases {
+		ret, err := execute(t, c.program, nil)
+		if !errors.Is(err, vm.ErrExecutionReverted) || !bytes.Equal(ret, panicData(c.code)) {
+			t.Errorf("case %d: want Panic(%#x), have %x (%v)", i, c.code, ret, err)
+		}
+	}
+}
+
+func TestStorageStructs(t *testing.T) {
+	t.Parallel()
+
+	const program = `
+(defstruct Position (owner address) (active bool) (amount uint256))
+
+(defvar *count*     uint256)
+(defvar *positions* (mapping uint256 Position))
+(defvar *pair*      (array Position 2))
+
+(puthash *positions* 0xdead 7 :owner)
+(puthash *positions* t      7 :active)
+(puthash *positions* 100    7 :amount)
+(aset *pair* 1 :amount 55)
+(aset *pair* 1 :active 1)
+
+(return-abi "(address,bool,uint256,uint256,bool,address)"
+            (gethash *positions* 7 :owner)
+            (gethash *positions* 7 :active)
+            (gethash *positions* 7 :amount)
+            (aref *pair* 1 :amount)
+            (aref *pair* 1 :active)
+            (aref *pair* 0 :owner))`
+
+	ret, db, err := executeWithState(t, program, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := pack(t,
+		[]string{"address", "bool", "uint256", "uint256", "bool", "address"},
+		common.HexToAddress("0xdead"), true, big.NewInt(100), big.NewInt(55), true, common.Address{},
+	)
+	if !bytes.Equal(ret, want) {
+		t.Errorf("have %x, want %x", ret, want)
+	}
+
+	// A Position takes two slots: owner and active share the first
+	// one, amount takes the second.
+	number := func(x int64) common.Hash {
+		return common.BigToHash(big.NewInt(x))
+	}
+	position := new(big.Int).SetBytes(crypto.Keccak256(number(7).Bytes(), number(1).Bytes()))
+
+	cases := []struct {
+		slot common.Hash
+		want string
+	}{
+		{common.BigToHash(position), "0x1000000000000000000000000000000000000dead"},
+		{common.BigToHash(new(big.Int).Add(position, big.NewInt(1))), "0x64"},
+		{number(4), "0x10000000000000000000000000000000000000000"}, // *pair*[1].owner and active
+		{number(5), "0x37"}, // *pair*[1].amount
+	}
+	for i, c := range cases {
+		have := db.GetState(contractAddress, c.slot)
+		if want := uint256.MustFromHex(c.want); !new(uint256.Int).SetBytes(have[:]).Eq(want) {
+			t.Errorf("case %d: slot %x: have %x, want %s", i, c.slot, have, c.want)
+		}
+	}
+}
+
+func TestStorageErrors(t *testing.T) {
+	t.Parallel()
+
+	cases := []string{
+		"(defvar *a* (array uint256)) *a*",
+		"(defvar *a* (array uint256)) (aref *a*)",
+		"(defvar *a* (array uint256 0))",
+		"(defvar *a* (array uint256 2)) (push 1 *a*)",
+		"(defvar *a* (mapping uint256 uint256)) (aref *a* 0)",
+		"(defvar *a* (mapping uint256 uint256)) (gethash *a* 0 1)",
+		"(defvar *a* (mapping uint256 (mapping uint256 uint256))) (gethash *a* 0)",
+		"(defstruct P (x uint8)) (defvar *a* (mapping uint256 P)) (gethash *a* 0)",
+		"(defstruct P (x uint8)) (defvar *a* (mapping uint256 P)) (gethash *a* 0 :y)",
+		"(defstruct P (x uint8) (x uint8))",
+		"(defstruct P (x uint8)) (defstruct P (y uint8))",
+		"(defvar *a* P)",
+	}
+
+	compile := func(program string) error {
+		_, err := mist.CompileContract(program, t.Name(), mist.Options{Init: true})
+		return err
+	}
+
+	for i, c := range cases {
+		if err := compile(c); err == nil {
+			t.Errorf("case %d: want error, have none: %s", i, c)
+		}
+	}
+}
+
+func TestStorageLayout(t *testing.T) {
+	t.Parallel()
+
+	const program = `
+(defvar *owner*    address)
+(defvar *paused*   bool)
+(defvar *balances* (mapping address uint256))
+(defvar *decimals* uint8)
+(defvar *supply*   uint256)`
+
+	// This is what solc outputs for the equivalent Solidity
+	// contract, except for astId and contract.
+	const want = `{
+  "storage": [
+    {"astId": 0, "contract": "token.mist", "label": "*owner*",    "offset": 0,  "slot": "0", "type": "t_address"},
+    {"astId": 1, "contract": "token.mist", "label": "*paused*",   "offset": 20, "slot": "0", "type": "t_bool"},
+    {"astId": 2, "contract": "token.mist", "label": "*balances*", "offset": 0,  "slot": "1", "type": "t_mapping(t_address,t_uint256)"},
+    {"astId": 3, "contract": "token.mist", "label": "*decimals*", "offset": 0,  "slot": "2", "type": "t_uint8"},
+    {"astId": 4, "contract": "token.mist", "label": "*supply*",   "offset": 0,  "slot": "3", "type": "t_uint256"}
+  ],
+  "types": {
+    "t_address": {"encoding": "inplace", "label": "address", "numberOfBytes": "20"},
+    "t_bool":    {"encoding": "inplace", "label": "bool",    "numberOfBytes": "1"},
+    "t_mapping(t_address,t_uint256)": {
+      "encoding": "mapping",
+      "key": "t_address",
+      "label": "mapping(address => uint256)",
+      "numberOfBytes": "32",
+      "value": "t_uint256"
+    },
+    "t_uint256": {"encoding": "inplace", "label": "uint256", "numberOfBytes": "32"},
+    "t_uint8":   {"encoding": "inplace", "label": "uint8",   "numberOfBytes": "1"}
+  }
+}`
+
+	contract, err := mist.CompileContract(program, "token.mist", mist.Options{Init: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := json.Marshal(contract.StorageLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var have, expected any
+	if err := json.Unmarshal(encoded, &have); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(want), &expected); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(expected, have); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestStorageLayoutComposite(t *testing.T) {
+	t.Parallel()
+
+	const program = `
+(defstruct Position (owner address) (amount uint256))
+(defvar *holders*   (array address))
+(defvar *fixed*     (array uint8 3))
+(defvar *positions* (mapping address Position))`
+
+	// This is what solc outputs for the equivalent Solidity
+	// contract, except for astId, contract and the AST id solc puts
+	// in struct type identifiers.
+	const want = `{
+  "storage": [
+    {"astId": 0, "contract": "c.mist", "label": "*holders*",   "offset": 0, "slot": "0", "type": "t_array(t_address)dyn_storage"},
+    {"astId": 1, "contract": "c.mist", "label": "*fixed*",     "offset": 0, "slot": "1", "type": "t_array(t_uint8)3_storage"},
+    {"astId": 2, "contract": "c.mist", "label": "*positions*", "offset": 0, "slot": "2", "type": "t_mapping(t_address,t_struct(Position)_storage)"}
+  ],
+  "types": {
+    "t_address": {"encoding": "inplace", "label": "address", "numberOfBytes": "20"},
+    "t_array(t_address)dyn_storage": {
+      "base": "t_address",
+      "encoding": "dynamic_array",
+      "label": "address[]",
+      "numberOfBytes": "32"
+    },
+    "t_array(t_uint8)3_storage": {
+      "base": "t_uint8",
+      "encoding": "inplace",
+      "label": "uint8[3]",
+      "numberOfBytes": "32"
+    },
+    "t_mapping(t_address,t_struct(Position)_storage)": {
+      "encoding": "mapping",
+      "key": "t_address",
+      "label": "mapping(address => struct Position)",
+      "numberOfBytes": "32",
+      "value": "t_struct(Position)_storage"
+    },
+    "t_struct(Position)_storage": {
+      "encoding": "inplace",
+      "label": "struct Position",
+      "members": [
+        {"astId": 0, "contract": "c.mist", "label": "owner",  "offset": 0, "slot": "0", "type": "t_address"},
+        {"astId": 1, "contract": "c.mist", "label": "amount", "offset": 0, "slot": "1", "type": "t_uint256"}
+      ],
+      "numberOfBytes": "64"
+    },
+    "t_uint256": {"encoding": "inplace", "label": "uint256", "numberOfBytes": "32"},
+    "t_uint8":   {"encoding": "inplace", "label": "uint8",   "numberOfBytes": "1"}
+  }
+}`
+
+	contract, err := mist.CompileContract(program, "c.mist", mist.Options{Init: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := json.Marshal(contract.StorageLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var have, expected any
+	if err := json.Unmarshal(encoded, &have); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(want), &expected); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(expected, have); diff != "" {
+		t.Error(diff)
+	}
+}
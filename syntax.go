@@ -1,111 +1,168 @@
 package mist
 
-import "fmt"
+import "errors"
 
-func consume(tokens *TokenIterator, types ...int) Token {
-	if !tokens.HasNext() {
-		panic("incomplete code")
+func parseAtom(tokens *TokenIterator) Node {
+	next := tokens.Next()
+	switch next.Type {
+	case TokenNumber:
+		return NewNodeU256(next.ValueNumber, next.Origin)
+	case TokenString:
+		return NewNodeString(next.ValueString, next.Origin)
+	case TokenSymbol:
+		return NewNodeSymbol(next.ValueString, next.Origin)
+	default:
+		panic("broken invariant")
 	}
+}
 
-	next := tokens.Peek()
+func parseList(tokens *TokenIterator) (Node, error) {
+	left := tokens.Next()
+	root := NewNodeList(left.Origin)
 
-	for _, tokenType := range types {
-		if next.Type == tokenType {
-			return tokens.Next()
+	for tokens.HasNext() {
+		next := tokens.Peek()
+		if next.Type == TokenRightParen {
+			tokens.Next()
+			return root, nil
 		}
-	}
-
-	panic("TODO")
-}
-
-func consumeExcept(tokens *TokenIterator, types ...int) Token {
-	if !tokens.HasNext() {
-		panic("TODO")
-	}
 
-	next := tokens.Peek()
+		if next.Type == TokenDatumComment {
+			if err := skipDatum(tokens); err != nil {
+				return root, err
+			}
+			continue
+		}
 
-	for _, tokenType := range types {
-		if next.Type == tokenType {
-			panic(fmt.Sprintf("%v: unexpected token %s", next.Origin, next.Short()))
+		child, err := parse(tokens)
+		if err != nil {
+			return root, err
 		}
+		root.AddChild(child)
 	}
 
-	return tokens.Next()
+	return root, NewSyntaxError(left.Origin, "unclosed parenthesis")
 }
 
-func parseAtom(tokens *TokenIterator) Node {
-	next := consumeExcept(tokens, TokenLeftParen, TokenRightParen, TokenQuote)
+// parse parses the next expression.  The caller makes sure there is a
+// next token and it's not a datum comment.
+func parse(tokens *TokenIterator) (Node, error) {
+	next := tokens.Peek()
 	switch next.Type {
 	case TokenLeftParen:
-		fallthrough
+		return parseList(tokens)
 	case TokenRightParen:
-		fallthrough
+		return Node{}, NewSyntaxError(next.Origin, "unmatched closing parenthesis")
 	case TokenQuote:
-		panic("TODO")
-	case TokenNumber:
-		return NewNodeU256(next.ValueNumber, next.Origin)
-	case TokenString:
-		return NewNodeString(next.ValueString, next.Origin)
-	case TokenSymbol:
-		return NewNodeSymbol(next.ValueString, next.Origin)
+		tokens.Next() // Consume the quote token.
+		child, err := parseFollowing(tokens, next)
+		if err != nil {
+			return Node{}, err
+		}
+		return NewNodeQuote(child, next.Origin), nil
+	case TokenNumber, TokenString, TokenSymbol:
+		return parseAtom(tokens), nil
 	default:
-		panic("TODO")
+		panic("broken invariant")
 	}
 }
 
-func parseList(tokens *TokenIterator) Node {
-	left := consume(tokens, TokenLeftParen)
-	defer consume(tokens, TokenRightParen)
-
-	root := NewNodeList(left.Origin)
-
+// parseFollowing parses the expression that has to follow a prefix
+// like a quote or a datum comment.
+func parseFollowing(tokens *TokenIterator, prefix Token) (Node, error) {
 	for tokens.HasNext() {
 		next := tokens.Peek()
-		if next.Type == TokenLeftParen {
-			// That's a nested list, go deeper.
-			root.AddChild(parseList(tokens))
-		} else if next.Type == TokenRightParen {
+		if next.Type == TokenRightParen {
 			break
-		} else {
-			root.AddChild(parse(tokens))
 		}
+		if next.Type == TokenDatumComment {
+			if err := skipDatum(tokens); err != nil {
+				return Node{}, err
+			}
+			continue
+		}
+		return parse(tokens)
 	}
 
-	return root
+	return Node{}, NewSyntaxError(prefix.Origin, "missing expression after "+prefix.Short())
 }
 
-func parse(tokens *TokenIterator) Node {
-	for tokens.HasNext() {
-		next := tokens.Peek()
-		switch next.Type {
-		case TokenLeftParen:
-			return parseList(tokens)
-		case TokenRightParen:
-			panic("unbalanced parentheses")
-		case TokenQuote:
-			tokens.Next() // Consume the quote token.
-			child := parse(tokens)
-			quote := NewNodeQuote(child, next.Origin)
-			return quote
-		case TokenNumber:
-			fallthrough
-		case TokenString:
-			fallthrough
-		case TokenSymbol:
-			return parseAtom(tokens)
+// skipDatum consumes a datum comment #; along with the expression
+// that follows it.
+func skipDatum(tokens *TokenIterator) error {
+	_, err := parseFollowing(tokens, tokens.Next())
+	return err
+}
+
+// resync finds where parsing should continue after an error in the
+// top-level form that starts at the given index.  That's right after
+// the form if its parentheses are balanced.  Otherwise, the form is
+// assumed to end before the next opening parenthesis at the beginning
+// of a line and the innermost parenthesis left open by then is
+// returned as well.
+func resync(tokens *TokenIterator, start int) (int, *Token) {
+	var open []int
+
+	for i := start; i < len(tokens.tokens); i++ {
+		tok := tokens.tokens[i]
+		switch {
+		case tok.Type == TokenLeftParen && tok.Origin.Column == 0 && i > start && len(open) > 0:
+			return i, &tokens.tokens[open[len(open)-1]]
+		case tok.Type == TokenLeftParen:
+			open = append(open, i)
+		case tok.Type == TokenRightParen && len(open) > 0:
+			open = open[:len(open)-1]
+		}
+		if len(open) <= 0 && tok.Type != TokenQuote && tok.Type != TokenDatumComment {
+			return i + 1, nil
 		}
 	}
 
-	panic("unreachable")
+	if len(open) > 0 {
+		return len(tokens.tokens), &tokens.tokens[open[len(open)-1]]
+	}
+	return len(tokens.tokens), nil
 }
 
-func Parse(tokens *TokenIterator) Node {
+// Parse parses all top-level forms.  A syntax error skips the rest of
+// the form it's found in, so that errors in later forms are reported
+// as well.  All of them are joined in the returned error.
+func Parse(tokens *TokenIterator) (Node, error) {
 	progn := NewNodeProgn()
 
+	var errs []error
 	for tokens.HasNext() {
-		progn.AddChild(parse(tokens))
+		next := tokens.Peek()
+		if next.Type == TokenDatumComment {
+			if err := skipDatum(tokens); err != nil {
+				errs = append(errs, err)
+				tokens.index, _ = resync(tokens, tokens.index)
+			}
+			continue
+		}
+
+		start := tokens.index
+		child, err := parse(tokens)
+		if err == nil {
+			progn.AddChild(child)
+			continue
+		}
+
+		if next.Type == TokenRightParen {
+			// Nothing to resync, just skip the parenthesis.
+			errs = append(errs, err)
+			tokens.Next()
+			continue
+		}
+
+		var unclosed *Token
+		tokens.index, unclosed = resync(tokens, start)
+		if unclosed != nil {
+			// Point at the parenthesis that's missing its partner.
+			err = NewSyntaxError(unclosed.Origin, "unclosed parenthesis")
+		}
+		errs = append(errs, err)
 	}
 
-	return progn
+	return progn, errors.Join(errs...)
 }
@@ -0,0 +1,100 @@
+package mist_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/ydm/mist"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	cases := []string{
+		"(+ 1 2) (f 'x '(a b))",
+		"(f #;(g) x) #;y",
+		"",
+	}
+
+	want := []string{
+		"(progn (+ 1 2) (f (quote x) (quote (a b))))",
+		"(progn (f x))",
+		"(progn)",
+	}
+
+	for i, c := range cases {
+		tokens, err := mist.Scan(c, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		progn, err := mist.Parse(&tokens)
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if diff := cmp.Diff(want[i], progn.String()); diff != "" {
+			t.Errorf("case %d: %s", i, diff)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		program string
+		want    []string
+	}{
+		{")", []string{"1:0 unmatched closing parenthesis"}},
+		{"(f))", []string{"1:3 unmatched closing parenthesis"}},
+		{"(f (g)", []string{"1:0 unclosed parenthesis"}},
+		{"(f (g (h))", []string{"1:0 unclosed parenthesis"}},
+		{"(f (g (h)", []string{"1:3 unclosed parenthesis"}},
+		{"'", []string{"1:0 missing expression after '"}},
+		{"(f ')", []string{"1:3 missing expression after '"}},
+		{"(f #;)", []string{"1:3 missing expression after #;"}},
+		{"#;", []string{"1:0 missing expression after #;"}},
+		{"'(f", []string{"1:1 unclosed parenthesis"}},
+		{
+			"(defun f ()\n  (g (h)\n(defun g ()\n  1)\n(h ')\n(i))",
+			[]string{
+				"2:2 unclosed parenthesis",
+				"5:3 missing expression after '",
+				"6:3 unmatched closing parenthesis",
+			},
+		},
+	}
+
+	for i, c := range cases {
+		tokens, err := mist.Scan(c.program, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = mist.Parse(&tokens)
+		if err == nil {
+			t.Errorf("case %d: want error, have none", i)
+			continue
+		}
+
+		errs := []error{err}
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			errs = joined.Unwrap()
+		}
+
+		have := make([]string, len(errs))
+		for j, e := range errs {
+			var syntaxError mist.SyntaxError
+			if !errors.As(e, &syntaxError) {
+				t.Fatalf("case %d: want syntax error, have %v", i, e)
+			}
+			have[j] = fmt.Sprintf("%d:%d %s", syntaxError.Origin.Line, syntaxError.Origin.Column, syntaxError.Message)
+		}
+
+		if diff := cmp.Diff(c.want, have); diff != "" {
+			t.Errorf("case %d: %s", i, diff)
+		}
+	}
+}